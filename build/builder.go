@@ -0,0 +1,375 @@
+package build
+
+import (
+	"bucket/container"
+	"bucket/image"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 镜像没有设置 PATH 时 RUN 使用的默认值
+const defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+type Options struct {
+	ContextDir     string                 // 构建上下文目录, COPY 和 ADD 的源路径相对于它
+	Tags           []string               // 构建完成后给镜像打的 tag
+	BuildArgs      map[string]string      // --build-arg 给出的 ARG 值
+	NoCache        bool                   // 不使用构建缓存
+	LegacyImageDir string                 // 旧版本 <name>.tar 镜像所在的目录, 基础镜像不在存储中时从这里导入
+	Registry       *image.RegistryOptions // 基础镜像在本地找不到时用来拉取
+	Output         io.Writer              // 构建过程和 RUN 的输出
+}
+
+// 执行一条 RUN: 在 layerDirs 组成的文件系统上运行命令, 把修改打包到 tarPath
+type runFunc func(layerDirs []string, initConfig *container.InitConfig, env []string, output io.Writer, tarPath string) error
+
+// 多阶段构建中的一个阶段
+type stage struct {
+	name   string
+	config *image.ImageConfig
+	parent string
+	key    string
+}
+
+type Builder struct {
+	store  *image.Store
+	opts   *Options
+	ignore *Ignore
+	cache  *cache
+	run    runFunc
+
+	globalArgs map[string]string // 第一个 FROM 之前声明的 ARG, 只能在 FROM 中使用
+	stages     []*stage          // 已经完成的阶段
+	rootfs     map[string]string // COPY --from 用到的阶段展开后的目录, 构建结束后删除
+	// 当前阶段的状态
+	stageName string
+	config    *image.ImageConfig
+	parent    string
+	args      map[string]string
+	key       string // 当前的缓存 key
+}
+
+func NewBuilder(store *image.Store, opts *Options) (*Builder, error) {
+	ignore, err := LoadIgnore(opts.ContextDir)
+	if err != nil {
+		return nil, fmt.Errorf("load ignore file error: %v", err)
+	}
+	if opts.Output == nil {
+		opts.Output = ioutil.Discard
+	}
+	return &Builder{
+		store:  store,
+		opts:   opts,
+		ignore: ignore,
+		cache:  &cache{dir: store.BuildCacheDir()},
+		run:    runInContainer,
+	}, nil
+}
+
+// 依次执行各条指令, 返回最后一个阶段生成的镜像
+func (b *Builder) Build(instructions []*Instruction) (*image.Image, error) {
+	b.globalArgs, b.stages, b.rootfs = map[string]string{}, nil, map[string]string{}
+	b.config, b.parent = nil, ""
+	defer func() {
+		for _, dir := range b.rootfs {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+	for i, ins := range instructions {
+		fmt.Fprintf(b.opts.Output, "Step %d/%d : %s\n", i+1, len(instructions), ins.Original)
+		if b.config == nil && ins.Command != "FROM" && ins.Command != "ARG" {
+			return nil, fmt.Errorf("line %d: %s before FROM", ins.Line, ins.Command)
+		}
+		if err := b.dispatch(ins); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %v", ins.Line, ins.Command, err)
+		}
+	}
+	if b.config == nil {
+		return nil, fmt.Errorf("no FROM instruction")
+	}
+
+	// 使用最后一步的时间, 全部命中缓存时得到和上次相同的镜像
+	created := time.Now().UTC()
+	if n := len(b.config.History); n > 0 && b.config.History[n-1].Created != nil {
+		created = *b.config.History[n-1].Created
+	}
+	b.config.Created = &created
+	img, err := b.store.CreateImage(b.config, "", b.parent)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(b.opts.Output, "Successfully built %s\n", img.ShortID())
+	for _, tag := range b.opts.Tags {
+		if err := b.store.Tag(img.ID, tag); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(b.opts.Output, "Successfully tagged %s\n", tag)
+	}
+	return b.store.Get(img.ID)
+}
+
+func (b *Builder) dispatch(ins *Instruction) error {
+	switch ins.Command {
+	case "FROM":
+		return b.from(ins)
+	case "ARG":
+		return b.arg(ins)
+	case "RUN":
+		return b.runCommand(ins)
+	case "COPY", "ADD":
+		return b.copy(ins)
+	case "CMD", "ENTRYPOINT":
+		// 和 Dockerfile 一样, 命令中的变量留给容器中的 shell 处理
+		return b.change(ins, ins.Args)
+	default:
+		return b.change(ins, expand(ins.Args, b.lookup))
+	}
+}
+
+// 执行一步: 缓存命中时直接使用缓存的配置, 否则执行 fn 并把结果写入缓存
+func (b *Builder) step(desc string, fn func() error) error {
+	key := chainKey(b.key, desc)
+	if !b.opts.NoCache {
+		if config := b.cache.get(b.store, key); config != nil {
+			fmt.Fprintln(b.opts.Output, " ---> Using cache")
+			b.config, b.key = config, key
+			return nil
+		}
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	b.key = key
+	return b.cache.put(key, b.config)
+}
+
+// 不产生新层的指令只修改配置
+func (b *Builder) change(ins *Instruction, args string) error {
+	desc := ins.Command + " " + args
+	return b.step(desc, func() error {
+		if err := image.ApplyChange(&b.config.Config, desc); err != nil {
+			return err
+		}
+		b.addHistory(desc, true)
+		return nil
+	})
+}
+
+// FROM image [AS name], image 也可以是前面阶段的名字
+func (b *Builder) from(ins *Instruction) error {
+	fields := strings.Fields(expand(ins.Args, func(name string) (string, bool) {
+		value, ok := b.globalArgs[name]
+		return value, ok
+	}))
+	name := ""
+	switch {
+	case len(fields) == 3 && strings.EqualFold(fields[1], "AS"):
+		name = strings.ToLower(fields[2])
+	case len(fields) != 1:
+		return fmt.Errorf("expect FROM <image> [AS <name>], got %q", ins.Args)
+	}
+	ref := fields[0]
+
+	if b.config != nil {
+		b.stages = append(b.stages, &stage{name: b.stageName, config: b.config, parent: b.parent, key: b.key})
+	}
+	b.stageName, b.args = name, map[string]string{}
+	if s := b.findStage(ref); s != nil {
+		b.config, b.parent, b.key = s.config.Copy(), s.parent, s.key
+		return nil
+	}
+	if ref == "scratch" {
+		b.config, b.parent, b.key = image.NewImageConfig(), "", chainKey("", "FROM scratch")
+		return nil
+	}
+
+	img, err := b.resolveImage(ref)
+	if err != nil {
+		return err
+	}
+	config, err := b.store.Config(img)
+	if err != nil {
+		return err
+	}
+	b.config, b.parent, b.key = config.Copy(), img.ID, chainKey("", "FROM "+img.ID)
+	return nil
+}
+
+// 按名字或序号查找已经完成的阶段
+func (b *Builder) findStage(ref string) *stage {
+	for i, s := range b.stages {
+		if (s.name != "" && s.name == strings.ToLower(ref)) || strconv.Itoa(i) == ref {
+			return s
+		}
+	}
+	return nil
+}
+
+// 依次从镜像存储, 旧版本的镜像目录和仓库中查找镜像
+func (b *Builder) resolveImage(ref string) (*image.Image, error) {
+	img, err := b.store.Lookup(ref)
+	if !image.IsNotFound(err) {
+		return img, err
+	}
+	img, err = b.store.ImportLegacy(ref, b.opts.LegacyImageDir)
+	if !image.IsNotFound(err) {
+		if err == nil {
+			fmt.Fprintf(b.opts.Output, "Imported %s from %s\n", ref, b.opts.LegacyImageDir)
+		}
+		return img, err
+	}
+	fmt.Fprintf(b.opts.Output, "Pulling %s\n", ref)
+	return b.store.Pull(ref, b.opts.Registry, b.opts.Output)
+}
+
+// ARG name[=default], --build-arg 给出的值优先; 阶段内不带默认值的 ARG 继承 FROM 之前的同名 ARG
+func (b *Builder) arg(ins *Instruction) error {
+	kv := strings.SplitN(ins.Args, "=", 2)
+	name := kv[0]
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid ARG %q", ins.Args)
+	}
+	value, ok := b.opts.BuildArgs[name]
+	if !ok && len(kv) == 2 {
+		value, ok = expand(strings.Trim(kv[1], `"`), b.lookup), true
+	}
+	if b.config == nil {
+		b.globalArgs[name] = value
+		return nil
+	}
+	if global, defined := b.globalArgs[name]; !ok && defined {
+		value = global
+	}
+	b.args[name] = value
+	// ARG 的值会影响之后的 RUN, 所以也是缓存 key 的一部分
+	b.key = chainKey(b.key, "ARG "+name+"="+value)
+	return nil
+}
+
+// 变量先在镜像的 ENV 中查找, 再查 ARG
+func (b *Builder) lookup(name string) (string, bool) {
+	if b.config != nil {
+		for _, kv := range b.config.Config.Env {
+			if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 && parts[0] == name {
+				return parts[1], true
+			}
+		}
+	}
+	value, ok := b.args[name]
+	return value, ok
+}
+
+func (b *Builder) runCommand(ins *Instruction) error {
+	args, ok := parseJSONArgs(ins.Args)
+	if !ok {
+		args = []string{"/bin/sh", "-c", ins.Args}
+	}
+	// ARG 只在构建时作为环境变量, 不写入镜像; 同名时 ENV 优先
+	var argEnv []string
+	for name, value := range b.args {
+		argEnv = append(argEnv, name+"="+value)
+	}
+	env := image.MergeEnv(argEnv, b.config.Config.Env)
+	if !hasEnv(env, "PATH") {
+		env = append(env, defaultPath)
+	}
+
+	layerDirs, err := b.store.DiffLayerDirs(b.config.RootFS.DiffIDs)
+	if err != nil {
+		return err
+	}
+	initConfig := &container.InitConfig{
+		Args:       args,
+		WorkingDir: b.config.Config.WorkingDir,
+		User:       b.config.Config.User,
+	}
+	createdBy := strings.Join(args, " ")
+	return b.step("RUN "+createdBy, func() error {
+		return b.commitLayer(createdBy, func(tarPath string) error {
+			return b.run(layerDirs, initConfig, env, b.opts.Output, tarPath)
+		})
+	})
+}
+
+// 用 fill 生成一个层的 tar 包, 注册后加到当前镜像的最上层
+func (b *Builder) commitLayer(createdBy string, fill func(tarPath string) error) error {
+	tmpFile, err := ioutil.TempFile("", "bucket-build-*.tar")
+	if err != nil {
+		return err
+	}
+	tarPath := tmpFile.Name()
+	_ = tmpFile.Close()
+	defer func() {
+		_ = os.Remove(tarPath)
+	}()
+	if err := fill(tarPath); err != nil {
+		return err
+	}
+	layer, err := b.store.RegisterLayer(tarPath)
+	if err != nil {
+		return err
+	}
+	b.config.RootFS.Type = "layers"
+	b.config.RootFS.DiffIDs = append(b.config.RootFS.DiffIDs, layer.DiffID)
+	b.addHistory(createdBy, false)
+	return nil
+}
+
+func (b *Builder) addHistory(createdBy string, emptyLayer bool) {
+	now := time.Now().UTC()
+	b.config.History = append(b.config.History, image.History{
+		Created:    &now,
+		CreatedBy:  createdBy,
+		EmptyLayer: emptyLayer,
+	})
+}
+
+func hasEnv(env []string, name string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// 在一个临时的 bucket 容器中执行命令, 结束后把可写层打包
+func runInContainer(layerDirs []string, initConfig *container.InitConfig, env []string, output io.Writer, tarPath string) error {
+	containerName := fmt.Sprintf("build-%d", time.Now().UnixNano())
+	cmd, writePipe, err := container.NewBuildProcess(containerName, layerDirs, env, output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = container.DeleteMountPoint(containerName)
+		container.DeleteWriteLayer(containerName)
+	}()
+	if err := cmd.Start(); err != nil {
+		_ = writePipe.Close()
+		return err
+	}
+	content, err := json.Marshal(initConfig)
+	if err == nil {
+		_, err = writePipe.Write(content)
+	}
+	_ = writePipe.Close()
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("command %q returned a non-zero code: %d", strings.Join(initConfig.Args, " "), exitErr.ExitCode())
+		}
+		return err
+	}
+	return container.WriteLayerDiff(containerName, tarPath)
+}
@@ -0,0 +1,251 @@
+package build
+
+import (
+	"bucket/container"
+	"bucket/image"
+	"bucket/utils"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := image.NewStore(path.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contextDir := path.Join(dir, "context")
+	writeFiles(t, contextDir, map[string]string{
+		".bucketignore": "**/*.log\nsecret\n",
+		"app/main.sh":   "echo hi",
+		"app/debug.log": "noise",
+		"secret/key":    "key",
+		"config.json":   "{}",
+	})
+	if err := os.Symlink("/etc/passwd", path.Join(contextDir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	var output strings.Builder
+	builder, err := NewBuilder(store, &Options{
+		ContextDir: contextDir,
+		Tags:       []string{"app:v1"},
+		BuildArgs:  map[string]string{"VERSION": "2"},
+		Output:     &output,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不启动容器, 把命令和工作目录写到新层的 ran 文件中
+	var runEnv []string
+	builder.run = func(layerDirs []string, initConfig *container.InitConfig, env []string, out io.Writer, tarPath string) error {
+		runEnv = env
+		if len(layerDirs) != 2 {
+			return fmt.Errorf("expect 2 layers under RUN, got %d", len(layerDirs))
+		}
+		src := path.Join(dir, "run")
+		writeFiles(t, src, map[string]string{"ran": strings.Join(initConfig.Args, " ") + "\n" + initConfig.WorkingDir})
+		return exec.Command("tar", "-cf", tarPath, "-C", src, ".").Run()
+	}
+
+	instructions, err := Parse(strings.NewReader(`
+FROM scratch
+ARG VERSION=1
+ARG NAME=app
+ENV APP_HOME=/opt/$NAME
+WORKDIR ${APP_HOME}
+COPY app/ ./
+COPY config.json /etc/
+RUN echo $VERSION
+LABEL version=$VERSION
+EXPOSE 8080
+CMD ["./main.sh"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := builder.Build(instructions)
+	if err != nil {
+		t.Fatalf("build error: %v\n%s", err, output.String())
+	}
+	if !strings.Contains(output.String(), "Step 11/11 : CMD") || len(img.Tags) != 1 || img.Tags[0] != "app:v1" {
+		t.Errorf("unexpected build result %+v\n%s", img, output.String())
+	}
+
+	config, err := store.Config(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.Config
+	if c.WorkingDir != "/opt/app" || c.Labels["version"] != "2" || len(c.Cmd) != 1 || c.Ports()[0] != "8080/tcp" {
+		t.Errorf("unexpected config %+v", c)
+	}
+	if len(c.Env) != 1 || c.Env[0] != "APP_HOME=/opt/app" {
+		t.Errorf("ARG should not be persisted in image env: %v", c.Env)
+	}
+	if !hasEnv(runEnv, "VERSION") || !hasEnv(runEnv, "PATH") {
+		t.Errorf("RUN should see ARG and default PATH: %v", runEnv)
+	}
+	if len(config.RootFS.DiffIDs) != 3 || len(config.History) != 8 {
+		t.Errorf("unexpected layers %d history %d", len(config.RootFS.DiffIDs), len(config.History))
+	}
+
+	dirs, err := store.LayerDirs(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path.Join(dirs[0], "ran"))
+	if err != nil || string(content) != "/bin/sh -c echo $VERSION\n/opt/app" {
+		t.Errorf("unexpected RUN layer %q %v", content, err)
+	}
+	if _, err := os.Stat(path.Join(dirs[2], "opt/app/main.sh")); err != nil {
+		t.Errorf("COPY dir should copy its content: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dirs[2], "opt/app/debug.log")); !os.IsNotExist(err) {
+		t.Errorf("ignored file should not be copied")
+	}
+	if _, err := os.Stat(path.Join(dirs[1], "etc/config.json")); err != nil {
+		t.Errorf("COPY file into dir: %v", err)
+	}
+
+	for _, bad := range []string{"COPY secret /", "COPY escape /", "COPY missing /", "RUN true"} {
+		instructions, _ := Parse(strings.NewReader("FROM scratch\n" + bad))
+		if bad == "RUN true" {
+			instructions = instructions[1:]
+		}
+		if _, err := builder.Build(instructions); err == nil {
+			t.Errorf("build %q should fail", bad)
+		}
+	}
+}
+
+func TestBuildCacheAndStages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := image.NewStore(path.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contextDir := path.Join(dir, "context")
+	writeFiles(t, contextDir, map[string]string{"a.txt": "a"})
+
+	// RUN 删除 a.txt 并生成 b.txt, 删除用 aufs 的 whiteout 表示
+	runs := 0
+	stub := func(layerDirs []string, initConfig *container.InitConfig, env []string, out io.Writer, tarPath string) error {
+		runs++
+		src := path.Join(dir, fmt.Sprintf("run-%d", runs))
+		writeFiles(t, src, map[string]string{"out/.wh.a.txt": "", "out/b.txt": "b"})
+		return exec.Command("tar", "-cf", tarPath, "-C", src, ".").Run()
+	}
+	buildfile := `
+FROM scratch AS builder
+COPY a.txt /out/a.txt
+RUN make
+FROM scratch
+COPY --from=builder /out /app
+`
+	build := func(noCache bool) (*image.Image, string) {
+		var output strings.Builder
+		builder, err := NewBuilder(store, &Options{ContextDir: contextDir, NoCache: noCache, Output: &output})
+		if err != nil {
+			t.Fatal(err)
+		}
+		builder.run = stub
+		instructions, err := Parse(strings.NewReader(buildfile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := builder.Build(instructions)
+		if err != nil {
+			t.Fatalf("build error: %v\n%s", err, output.String())
+		}
+		return img, output.String()
+	}
+
+	first, _ := build(false)
+	dirs, err := store.LayerDirs(first)
+	if err != nil || len(dirs) != 1 {
+		t.Fatalf("final stage should have one layer: %v %v", dirs, err)
+	}
+	if _, err := os.Stat(path.Join(dirs[0], "app/b.txt")); err != nil {
+		t.Errorf("file from builder stage should be copied: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dirs[0], "app/a.txt")); !os.IsNotExist(err) {
+		t.Errorf("file deleted in builder stage should not be copied")
+	}
+
+	second, output := build(false)
+	if second.ID != first.ID || runs != 1 || strings.Count(output, "Using cache") != 3 {
+		t.Errorf("rebuild should use cache: runs %d, same id %v\n%s", runs, second.ID == first.ID, output)
+	}
+
+	// 上下文中的文件变化后, COPY 和之后的 RUN 都要重新执行
+	writeFiles(t, contextDir, map[string]string{"a.txt": "changed"})
+	build(false)
+	if runs != 2 {
+		t.Errorf("changed COPY source should invalidate cache, runs %d", runs)
+	}
+	build(true)
+	if runs != 3 {
+		t.Errorf("--no-cache should rerun, runs %d", runs)
+	}
+}
+
+func TestAddArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := path.Join(dir, "src")
+	writeFiles(t, src, map[string]string{"lib/a.txt": "a"})
+
+	archive := path.Join(dir, "src.tar.gz")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	if err := utils.Tar(src, zw, nil); err != nil {
+		t.Fatal(err)
+	}
+	_ = zw.Close()
+	_ = f.Close()
+
+	if !isArchive(archive) || isArchive(path.Join(src, "lib/a.txt")) {
+		t.Fatalf("unexpected archive detection")
+	}
+	dst := path.Join(dir, "dst")
+	if err := extractArchive(archive, dst); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(path.Join(dst, "lib/a.txt")); err != nil || string(content) != "a" {
+		t.Errorf("unexpected extracted content %q %v", content, err)
+	}
+}
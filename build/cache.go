@@ -0,0 +1,107 @@
+package build
+
+import (
+	"bucket/image"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// 构建缓存. 每一步的 key 由上一步的 key 和这一步的内容算出, 第一步的上一步是基础镜像的ID,
+// 所以 key 相同说明从同一个镜像开始执行了同样的指令. 缓存的是执行完这一步后的镜像配置,
+// 其中的层仍然保存在镜像存储中
+type cache struct {
+	dir string
+}
+
+func chainKey(parent, step string) string {
+	sum := sha256.Sum256([]byte(parent + "\n" + step))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *cache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// 命中时返回缓存的配置, 配置中的层已经被删除时当作没有命中
+func (c *cache) get(store *image.Store, key string) *image.ImageConfig {
+	content, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil
+	}
+	config := &image.ImageConfig{}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil
+	}
+	if _, err := store.DiffLayerDirs(config.RootFS.DiffIDs); err != nil {
+		return nil
+	}
+	return config
+}
+
+func (c *cache) put(key string, config *image.ImageConfig) error {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	content, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path(key), content, 0644)
+}
+
+// 目录内容的摘要, 包括路径, 权限, 属主, 文件内容和链接目标, 不包括修改时间
+func checksumTree(dir string) (string, error) {
+	hash := sha256.New()
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		uid, gid := uint32(0), uint32(0)
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = stat.Uid, stat.Gid
+		}
+		fmt.Fprintf(hash, "%s\x00%o\x00%d:%d\x00", rel, info.Mode(), uid, gid)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%s\x00", link)
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(hash, f)
+			_ = f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// 参数的稳定表示, 用于计算缓存 key
+func sortedPairs(m map[string]string) []string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
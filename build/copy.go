@@ -0,0 +1,429 @@
+package build
+
+import (
+	"bucket/image"
+	"bucket/utils"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// COPY/ADD [--from=<stage|image>] src... dest, 源路径相对于构建上下文或者 --from 指定的阶段的根目录,
+// 可以使用通配符; ADD 还可以是 http(s) 地址, 本地的 tar 包会被解压到目标目录
+func (b *Builder) copy(ins *Instruction) error {
+	for flag := range ins.Flags {
+		if flag != "from" || ins.Command != "COPY" {
+			return fmt.Errorf("unsupported flag --%s", flag)
+		}
+	}
+	args, ok := parseJSONArgs(ins.Args)
+	if !ok {
+		args = strings.Fields(ins.Args)
+	}
+	for i := range args {
+		args[i] = expand(args[i], b.lookup)
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("requires at least two arguments")
+	}
+	sources, dest := args[:len(args)-1], args[len(args)-1]
+	// 以 / 结尾表示目标是目录
+	destIsDir := strings.HasSuffix(dest, "/")
+	if !strings.HasPrefix(dest, "/") {
+		dest = path.Join("/", b.config.Config.WorkingDir, dest)
+	}
+
+	// 从其他阶段复制时不使用忽略规则
+	root, ignore := b.opts.ContextDir, b.ignore
+	if from, ok := ins.Flags["from"]; ok {
+		var err error
+		if root, err = b.stageRootfs(expand(from, b.lookup)); err != nil {
+			return err
+		}
+		ignore = &Ignore{}
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	staging, err := ioutil.TempDir("", "bucket-copy-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(staging)
+	}()
+	// 层的根目录会成为容器根目录的属性
+	if err := os.Chmod(staging, 0755); err != nil {
+		return err
+	}
+	layerDirs, err := b.store.DiffLayerDirs(b.config.RootFS.DiffIDs)
+	if err != nil {
+		return err
+	}
+
+	var files []string
+	for _, src := range sources {
+		if ins.Command == "ADD" && isURL(src) {
+			files = append(files, src)
+			continue
+		}
+		matches, err := matchFiles(root, ignore, src)
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+	destIsDir = destIsDir || len(files) > 1
+	for _, file := range files {
+		if err := b.copyOne(ins.Command == "ADD", file, dest, destIsDir, staging, layerDirs, root, ignore); err != nil {
+			return err
+		}
+	}
+
+	// 缓存按复制的内容命中, 不管文件来自哪里
+	checksum, err := checksumTree(staging)
+	if err != nil {
+		return err
+	}
+	createdBy := ins.Command + " " + strings.Join(args, " ")
+	return b.step(createdBy+" "+checksum, func() error {
+		return b.commitLayer(createdBy, func(tarPath string) error {
+			f, err := os.Create(tarPath)
+			if err != nil {
+				return err
+			}
+			if err := utils.Tar(staging, f, nil); err != nil {
+				_ = f.Close()
+				return err
+			}
+			return f.Close()
+		})
+	})
+}
+
+// root 中和 src 匹配且没有被忽略的文件, 符号链接按 root 为根解析
+func matchFiles(root string, ignore *Ignore, src string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(root, filepath.Clean("/"+src)))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, match := range matches {
+		rel, _ := filepath.Rel(root, match)
+		resolved, err := utils.SecureJoin(root, rel)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(resolved)
+		if err != nil {
+			continue
+		}
+		// 被忽略的目录中可能有重新包含的文件
+		if !ignore.Excluded(rel) || (info.IsDir() && ignore.HasExceptions()) {
+			files = append(files, resolved)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: no such file or directory", src)
+	}
+	return files, nil
+}
+
+// 把阶段或者镜像的各层展开到临时目录, 作为 COPY --from 的根目录
+func (b *Builder) stageRootfs(from string) (string, error) {
+	var diffIDs []string
+	if s := b.findStage(from); s != nil {
+		diffIDs = s.config.RootFS.DiffIDs
+	} else {
+		img, err := b.resolveImage(from)
+		if err != nil {
+			return "", err
+		}
+		config, err := b.store.Config(img)
+		if err != nil {
+			return "", err
+		}
+		diffIDs = config.RootFS.DiffIDs
+	}
+	id := strings.Join(diffIDs, ",")
+	if dir, ok := b.rootfs[id]; ok {
+		return dir, nil
+	}
+	dir, err := ioutil.TempDir("", "bucket-stage-")
+	if err != nil {
+		return "", err
+	}
+	b.rootfs[id] = dir
+	if err := flattenLayers(b.store, diffIDs, dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// 从下往上依次解压各层: 先按这一层的 whiteout 删除下层的文件, 再解压这一层的其他文件
+func flattenLayers(store *image.Store, diffIDs []string, dst string) error {
+	for _, diffID := range diffIDs {
+		diffDir := store.LayerDiffPath(diffID)
+		err := filepath.Walk(diffDir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			name := info.Name()
+			if !strings.HasPrefix(name, image.WhiteoutPrefix) {
+				return nil
+			}
+			rel, _ := filepath.Rel(diffDir, filepath.Dir(p))
+			switch {
+			case name == image.WhiteoutOpaque:
+				entries, err := ioutil.ReadDir(filepath.Join(dst, rel))
+				if err != nil {
+					return nil
+				}
+				for _, entry := range entries {
+					if err := os.RemoveAll(filepath.Join(dst, rel, entry.Name())); err != nil {
+						return err
+					}
+				}
+			case strings.HasPrefix(name, image.WhiteoutMetaPrefix):
+				// aufs 自己的元数据
+			default:
+				if err := os.RemoveAll(filepath.Join(dst, rel, strings.TrimPrefix(name, image.WhiteoutPrefix))); err != nil {
+					return err
+				}
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := extractLayer(store.LayerTarPath(diffID), dst); err != nil {
+			return fmt.Errorf("extract layer %s error: %v", diffID, err)
+		}
+	}
+	return nil
+}
+
+// 解压层的 tar 包, whiteout 已经处理过了, 不解压出来
+func extractLayer(tarPath, dst string) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return utils.UntarFiltered(f, dst, func(name string) bool {
+		return strings.HasPrefix(filepath.Base(name), image.WhiteoutPrefix)
+	})
+}
+
+func (b *Builder) copyOne(add bool, src, dest string, destIsDir bool, staging string, layerDirs []string, root string, ignore *Ignore) error {
+	if add && isURL(src) {
+		target := dest
+		if destIsDir {
+			u, _ := url.Parse(src)
+			target = path.Join(dest, path.Base(u.Path))
+		}
+		if err := mkdirLike(staging, path.Dir(target), layerDirs); err != nil {
+			return err
+		}
+		return download(src, filepath.Join(staging, target))
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		// 复制的是目录里的内容
+		if err := mkdirLike(staging, dest, layerDirs); err != nil {
+			return err
+		}
+		return copyTree(src, filepath.Join(staging, dest), root, ignore)
+	case add && isArchive(src):
+		if err := mkdirLike(staging, dest, layerDirs); err != nil {
+			return err
+		}
+		if err := extractArchive(src, filepath.Join(staging, dest)); err != nil {
+			return fmt.Errorf("extract %s error: %v", filepath.Base(src), err)
+		}
+		return nil
+	default:
+		target := dest
+		if destIsDir {
+			target = path.Join(dest, filepath.Base(src))
+		}
+		if err := mkdirLike(staging, path.Dir(target), layerDirs); err != nil {
+			return err
+		}
+		return copyFile(src, filepath.Join(staging, target), info.Mode())
+	}
+}
+
+// 复制目录, 跳过 root 中被忽略的文件, 符号链接原样复制
+func copyTree(srcDir, dstDir, root string, ignore *Ignore) error {
+	return filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(srcDir, p)
+		if rootRel, err := filepath.Rel(root, p); err == nil && ignore.Excluded(rootRel) {
+			if info.IsDir() && !ignore.HasExceptions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dstDir, rel)
+		switch {
+		case rel == ".":
+			// 目标目录已经按镜像中的属性创建好了
+			return nil
+		case info.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm()|info.Mode()&(os.ModeSticky|os.ModeSetgid|os.ModeSetuid))
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			return copyFile(p, target, info.Mode())
+		}
+		// 设备文件等特殊文件不复制
+		return nil
+	})
+}
+
+// 在 staging 中创建 dir 及其上级目录, 已经存在于镜像中的目录沿用镜像中的权限和属主,
+// 否则新层会覆盖掉下层目录的属性
+func mkdirLike(staging, dir string, layerDirs []string) error {
+	current := staging
+	for _, part := range strings.Split(strings.Trim(path.Clean(dir), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		current = filepath.Join(current, part)
+		if _, err := os.Lstat(current); err == nil {
+			continue
+		}
+		rel, _ := filepath.Rel(staging, current)
+		mode, uid, gid := os.FileMode(0755), 0, 0
+		for _, layerDir := range layerDirs {
+			if info, err := os.Stat(filepath.Join(layerDir, rel)); err == nil && info.IsDir() {
+				mode = info.Mode().Perm() | info.Mode()&(os.ModeSticky|os.ModeSetgid|os.ModeSetuid)
+				if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+					uid, gid = int(stat.Uid), int(stat.Gid)
+				}
+				break
+			}
+		}
+		if err := os.Mkdir(current, 0755); err != nil {
+			return err
+		}
+		if err := os.Chmod(current, mode); err != nil {
+			return err
+		}
+		if os.Geteuid() == 0 {
+			if err := os.Lchown(current, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, mode.Perm()|mode&(os.ModeSticky|os.ModeSetgid|os.ModeSetuid))
+}
+
+func isURL(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+// 按文件头判断是否是 tar 包, 支持 gzip, bzip2, xz 和 zstd 压缩的
+func isArchive(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(bufio.NewReader(f), header)
+	header = header[:n]
+	return utils.IsCompressed(header) || (len(header) >= 262 && string(header[257:262]) == "ustar")
+}
+
+// ADD 本地的 tar 包时解压到目标目录
+func extractArchive(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := utils.DecompressStream(f)
+	if err != nil {
+		return err
+	}
+	if err := utils.Untar(r, dst); err != nil {
+		_ = r.Close()
+		return err
+	}
+	return r.Close()
+}
+
+func download(src, target string) error {
+	resp, err := http.Get(src)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: %s", src, resp.Status)
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("download %s: %v", src, err)
+	}
+	return f.Close()
+}
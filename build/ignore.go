@@ -0,0 +1,139 @@
+package build
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// 构建上下文中的忽略文件, 没有时使用 .dockerignore
+var ignoreFiles = []string{".bucketignore", ".dockerignore"}
+
+type ignorePattern struct {
+	re     *regexp.Regexp
+	negate bool
+}
+
+// 忽略规则, 语法和 .dockerignore 一样: 每行一个 glob, ** 匹配任意层目录,
+// ! 开头的规则把之前排除的文件重新加回来, 后面的规则优先
+type Ignore struct {
+	patterns []ignorePattern
+}
+
+// 读取上下文目录中的忽略文件, 没有忽略文件时返回空规则
+func LoadIgnore(contextDir string) (*Ignore, error) {
+	ignore := &Ignore{}
+	for _, name := range ignoreFiles {
+		f, err := os.Open(filepath.Join(contextDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if err := ignore.Add(scanner.Text()); err != nil {
+				return nil, err
+			}
+		}
+		return ignore, scanner.Err()
+	}
+	return ignore, nil
+}
+
+// 添加一条规则, 空行和 # 开头的注释忽略
+func (i *Ignore) Add(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	p := ignorePattern{}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = strings.TrimSpace(line[1:])
+	}
+	line = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(line)), "/")
+	re, err := regexp.Compile("^" + globToRegexp(line) + "$")
+	if err != nil {
+		return err
+	}
+	p.re = re
+	i.patterns = append(i.patterns, p)
+	return nil
+}
+
+// 相对上下文目录的路径是否被排除, 目录被排除时其中的文件也被排除
+func (i *Ignore) Excluded(rel string) bool {
+	rel = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(rel)), "/")
+	if rel == "" {
+		return false
+	}
+	excluded := false
+	for _, p := range i.patterns {
+		if p.negate == excluded && matchWithParents(p.re, rel) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+// 一个目录下只有部分文件被重新包含时, 目录本身不能整体跳过
+func (i *Ignore) HasExceptions() bool {
+	for _, p := range i.patterns {
+		if p.negate {
+			return true
+		}
+	}
+	return false
+}
+
+func matchWithParents(re *regexp.Regexp, rel string) bool {
+	for p := rel; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func globToRegexp(pattern string) string {
+	var out strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && strings.HasPrefix(pattern[i:], "**/"):
+			out.WriteString("(.*/)?")
+			i += 2
+		case c == '*' && strings.HasPrefix(pattern[i:], "**"):
+			out.WriteString(".*")
+			i++
+		case c == '*':
+			out.WriteString("[^/]*")
+		case c == '?':
+			out.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				out.WriteString(regexp.QuoteMeta(pattern[i:]))
+				return out.String()
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			out.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(pattern):
+			out.WriteString(regexp.QuoteMeta(string(pattern[i+1])))
+			i++
+		default:
+			out.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,31 @@
+package build
+
+import "testing"
+
+func TestIgnore(t *testing.T) {
+	ignore := &Ignore{}
+	for _, line := range []string{"# comment", "*.log", "/tmp", "**/node_modules", "docs", "!docs/README.md"} {
+		if err := ignore.Add(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cases := map[string]bool{
+		"app.log":               true,
+		"sub/app.log":           false,
+		"tmp/cache/file":        true,
+		"a/b/node_modules/x.js": true,
+		"node_modules":          true,
+		"docs/guide.md":         true,
+		"docs/README.md":        false,
+		"main.go":               false,
+		"tmpfile":               false,
+	}
+	for p, expect := range cases {
+		if got := ignore.Excluded(p); got != expect {
+			t.Errorf("Excluded(%q) = %v, expect %v", p, got, expect)
+		}
+	}
+	if !ignore.HasExceptions() {
+		t.Errorf("ignore with ! pattern should have exceptions")
+	}
+}
@@ -0,0 +1,173 @@
+package build
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// 构建文件中的一条指令
+type Instruction struct {
+	Command  string            // 大写的指令名, 例如 RUN
+	Flags    map[string]string // --name=value 形式的选项, 例如 COPY --from=builder
+	Args     string            // 去掉指令名和选项后的原文
+	Original string            // 原始的一行, 用于输出和镜像历史
+	Line     int               // 指令开始的行号
+}
+
+var supportedCommands = map[string]bool{
+	"FROM": true, "RUN": true, "COPY": true, "ADD": true, "ENV": true, "WORKDIR": true, "USER": true,
+	"ENTRYPOINT": true, "CMD": true, "EXPOSE": true, "LABEL": true, "ARG": true,
+}
+
+// 解析类似 Dockerfile 的构建文件: # 开头的是注释, 行尾的 \ 表示下一行是续行
+func Parse(r io.Reader) ([]*Instruction, error) {
+	var instructions []*Instruction
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var current strings.Builder
+	lineNo, startLine := 0, 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		// 续行之间的注释和空行忽略
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if current.Len() == 0 {
+			startLine = lineNo
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\"))
+			current.WriteString(" ")
+			continue
+		}
+		current.WriteString(line)
+		instruction, err := parseLine(current.String(), startLine)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, instruction)
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current.Len() > 0 {
+		instruction, err := parseLine(current.String(), startLine)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, instruction)
+	}
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("build file has no instructions")
+	}
+	return instructions, nil
+}
+
+func parseLine(line string, lineNo int) (*Instruction, error) {
+	line = strings.TrimSpace(line)
+	fields := strings.SplitN(line, " ", 2)
+	instruction := &Instruction{
+		Command:  strings.ToUpper(fields[0]),
+		Flags:    map[string]string{},
+		Original: line,
+		Line:     lineNo,
+	}
+	if !supportedCommands[instruction.Command] {
+		return nil, fmt.Errorf("line %d: unknown instruction %s", lineNo, fields[0])
+	}
+	if len(fields) > 1 {
+		instruction.Args = strings.TrimSpace(fields[1])
+	}
+	// 选项只出现在参数最前面
+	for strings.HasPrefix(instruction.Args, "--") {
+		parts := strings.SplitN(instruction.Args, " ", 2)
+		kv := strings.SplitN(strings.TrimPrefix(parts[0], "--"), "=", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		instruction.Flags[kv[0]] = value
+		instruction.Args = ""
+		if len(parts) > 1 {
+			instruction.Args = strings.TrimSpace(parts[1])
+		}
+	}
+	if instruction.Args == "" {
+		return nil, fmt.Errorf("line %d: %s requires at least one argument", lineNo, instruction.Command)
+	}
+	return instruction, nil
+}
+
+// JSON 数组形式的参数, 不是 JSON 数组时返回 false
+func parseJSONArgs(args string) ([]string, bool) {
+	if !strings.HasPrefix(args, "[") {
+		return nil, false
+	}
+	var list []string
+	if err := json.Unmarshal([]byte(args), &list); err != nil {
+		return nil, false
+	}
+	return list, true
+}
+
+// 替换 $VAR, ${VAR}, ${VAR:-default} 和 ${VAR:+value}, \$ 表示 $ 本身
+func expand(s string, lookup func(string) (string, bool)) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) && s[i+1] == '$' {
+			out.WriteByte('$')
+			i++
+			continue
+		}
+		if c != '$' || i+1 >= len(s) {
+			out.WriteByte(c)
+			continue
+		}
+
+		if s[i+1] == '{' {
+			end := strings.Index(s[i:], "}")
+			if end < 0 {
+				out.WriteString(s[i:])
+				break
+			}
+			expr := s[i+2 : i+end]
+			i += end
+			name, op, word := expr, "", ""
+			if j := strings.Index(expr, ":"); j >= 0 && j+1 < len(expr) {
+				name, op, word = expr[:j], expr[j:j+2], expr[j+2:]
+			}
+			value, ok := lookup(name)
+			switch {
+			case op == ":-" && (!ok || value == ""):
+				value = word
+			case op == ":+":
+				if ok && value != "" {
+					value = word
+				} else {
+					value = ""
+				}
+			}
+			out.WriteString(value)
+			continue
+		}
+
+		j := i + 1
+		for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z' || j > i+1 && s[j] >= '0' && s[j] <= '9') {
+			j++
+		}
+		if j == i+1 {
+			out.WriteByte(c)
+			continue
+		}
+		value, _ := lookup(s[i+1 : j])
+		out.WriteString(value)
+		i = j - 1
+	}
+	return out.String()
+}
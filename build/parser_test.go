@@ -0,0 +1,68 @@
+package build
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	content := `# comment
+ARG BASE=busybox
+FROM $BASE
+
+RUN echo a && \
+    # comment inside continuation
+    echo b
+COPY --chown=1:1 src /app/
+cmd ["/app/run"]
+`
+	instructions, err := Parse(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instructions) != 5 {
+		t.Fatalf("expect 5 instructions, got %d", len(instructions))
+	}
+	run := instructions[2]
+	if run.Command != "RUN" || run.Args != "echo a &&  echo b" || run.Line != 5 {
+		t.Errorf("unexpected RUN %+v", run)
+	}
+	copyIns := instructions[3]
+	if copyIns.Flags["chown"] != "1:1" || copyIns.Args != "src /app/" {
+		t.Errorf("unexpected COPY %+v", copyIns)
+	}
+	if instructions[4].Command != "CMD" {
+		t.Errorf("instruction name should be upper case, got %s", instructions[4].Command)
+	}
+
+	for _, bad := range []string{"FROM", "BOGUS x", ""} {
+		if _, err := Parse(strings.NewReader(bad)); err == nil {
+			t.Errorf("Parse(%q) should fail", bad)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"A": "1", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+	cases := map[string]string{
+		"$A/x":          "1/x",
+		"${A}x":         "1x",
+		"${B:-def}":     "def",
+		"${EMPTY:-def}": "def",
+		"${A:+set}":     "set",
+		"${B:+set}":     "",
+		`\$A`:           "$A",
+		"cost $5 and $": "cost $5 and $",
+		"$A_B ${A}_B":   " 1_B",
+		"no vars":       "no vars",
+	}
+	for in, expect := range cases {
+		if got := expand(in, lookup); got != expect {
+			t.Errorf("expand(%q) = %q, expect %q", in, got, expect)
+		}
+	}
+}
@@ -34,9 +34,22 @@ func (c *CgroupManager) Set(res *subsystems.ResourceConfig) error {
 	return nil
 }
 
-//释放cgroup
+// 暂停 cgroup 中的全部进程, 例如提交容器时避免文件系统在打包过程中变化
+func (c *CgroupManager) Freeze() error {
+	return subsystems.FreezerIns.SetState(c.Path, subsystems.FreezerStateFrozen)
+}
+
+// 恢复被暂停的进程
+func (c *CgroupManager) Thaw() error {
+	return subsystems.FreezerIns.SetState(c.Path, subsystems.FreezerStateThawed)
+}
+
+//释放cgroup, 已经被删除的 hierarchy 跳过, 可以重复调用
 func (c *CgroupManager) Destroy() error {
 	for _, subSysIns := range subsystems.SubsystemsIns {
+		if _, err := subsystems.GetCgroupPath(subSysIns.Name(), c.Path, false); err != nil {
+			continue
+		}
 		if err := subSysIns.Remove(c.Path); err != nil {
 			log.ConsoleLog.Warning("remove cgroup fail %v", err)
 		}
@@ -0,0 +1,86 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FreezerStateFrozen = "FROZEN"
+	FreezerStateThawed = "THAWED"
+	// 等待状态切换完成的最长时间
+	freezerTimeout = 10 * time.Second
+)
+
+// freezer 不限制资源, 用来暂停和恢复 cgroup 中的全部进程
+type FreezerSubSystem struct {
+}
+
+func (s *FreezerSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	if FindCgroupMountpoint(s.Name()) == "" {
+		return fmt.Errorf("freezer cgroup is not mounted")
+	}
+	_, err := GetCgroupPath(s.Name(), cgroupPath, true)
+	return err
+}
+
+func (s *FreezerSubSystem) Remove(cgroupPath string) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		return os.RemoveAll(subsysCgroupPath)
+	} else {
+		return err
+	}
+}
+
+func (s *FreezerSubSystem) Apply(cgroupPath string, pid int) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "tasks"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("set cgroup proc fail %v", err)
+		}
+		return nil
+	} else {
+		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+	}
+}
+
+func (s *FreezerSubSystem) Name() string {
+	return "freezer"
+}
+
+// 写入 FROZEN 或 THAWED, 等到内核完成切换; 冻结超时时恢复进程并返回错误
+func (s *FreezerSubSystem) SetState(cgroupPath, state string) error {
+	if FindCgroupMountpoint(s.Name()) == "" {
+		return fmt.Errorf("freezer cgroup is not mounted")
+	}
+	subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false)
+	if err != nil {
+		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+	}
+	stateFile := path.Join(subsysCgroupPath, "freezer.state")
+	deadline := time.Now().Add(freezerTimeout)
+	for {
+		// 冻结过程中有新进程 fork 时状态会停在 FREEZING, 需要重新写入
+		if err := ioutil.WriteFile(stateFile, []byte(state), 0644); err != nil {
+			return fmt.Errorf("set freezer state %s error: %v", state, err)
+		}
+		content, err := ioutil.ReadFile(stateFile)
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(content)) == state {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if state == FreezerStateFrozen {
+				_ = ioutil.WriteFile(stateFile, []byte(FreezerStateThawed), 0644)
+			}
+			return fmt.Errorf("timeout waiting for cgroup %s to be %s", cgroupPath, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -18,5 +18,7 @@ var (
 		&CpusetSubSystem{},
 		&MemorySubSystem{},
 		&CpuSubSystem{},
+		FreezerIns,
 	}
+	FreezerIns = &FreezerSubSystem{}
 )
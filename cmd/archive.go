@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"bucket/container"
+	"bucket/image"
+	"bucket/log"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"time"
+)
+
+var loadInput string
+var saveOutput string
+var exportOutput string
+var importChanges []string
+var importMessage string
+
+var loadCmd = &cobra.Command{
+	Use:   "load",
+	Short: "load images from a tar archive",
+	Long:  "load images from an OCI image layout or a docker save archive, read from stdin by default",
+	Run: func(cmd *cobra.Command, args []string) {
+		LoadImages(loadInput)
+	},
+}
+
+var saveCmd = &cobra.Command{
+	Use:   "save",
+	Short: "save images to a tar archive",
+	Long:  "save one or more images to a tar archive in OCI image layout, write to stdout by default",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing image name")
+			return
+		}
+		SaveImages(args, saveOutput)
+	},
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export a container's filesystem as a tar archive",
+	Long:  "export the merged root filesystem of a container as a tar archive, write to stdout by default",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing container name")
+			return
+		}
+		ExportContainer(args[0], exportOutput)
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "import a tar archive to create a filesystem image",
+	Long:  "import a tar archive (optionally gzip or zstd compressed) as a single-layer image, use - to read from stdin",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing tar archive")
+			return
+		}
+		ref := ""
+		if len(args) > 1 {
+			ref = args[1]
+		}
+		ImportImage(args[0], ref, importChanges, importMessage)
+	},
+}
+
+func init() {
+	loadCmd.Flags().StringVarP(&loadInput, "input", "i", "", "read from tar archive file, instead of stdin")
+	saveCmd.Flags().StringVarP(&saveOutput, "output", "o", "", "write to a file, instead of stdout")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "write to a file, instead of stdout")
+	importCmd.Flags().StringArrayVarP(&importChanges, "change", "c", []string{},
+		"apply Dockerfile instruction to the created image: CMD, ENTRYPOINT, ENV, WORKDIR, USER, EXPOSE, LABEL")
+	importCmd.Flags().StringVarP(&importMessage, "message", "m", "", "commit message for the imported image")
+}
+
+func LoadImages(input string) {
+	store, err := image.NewStore(container.ImageStoreUrl)
+	if err != nil {
+		log.ConsoleLog.Error("Open image store error %v", err)
+		return
+	}
+	var r io.Reader = os.Stdin
+	if input != "" {
+		f, err := os.Open(input)
+		if err != nil {
+			log.ConsoleLog.Error("Open %s error %v", input, err)
+			return
+		}
+		defer f.Close()
+		r = f
+	}
+
+	images, err := store.Load(r)
+	// 出错前已经导入的镜像也要显示
+	for _, img := range images {
+		if len(img.Tags) == 0 {
+			fmt.Printf("Loaded image ID: %s\n", img.ID)
+		}
+		for _, tag := range img.Tags {
+			fmt.Printf("Loaded image: %s\n", tag)
+		}
+	}
+	if err != nil {
+		log.ConsoleLog.Error("Load images error %v", err)
+	}
+}
+
+func SaveImages(refs []string, output string) {
+	store, err := image.NewStore(container.ImageStoreUrl)
+	if err != nil {
+		log.ConsoleLog.Error("Open image store error %v", err)
+		return
+	}
+	// 先确认镜像都存在, 避免留下不完整的文件
+	for _, ref := range refs {
+		if _, err := store.Lookup(ref); err != nil {
+			log.ConsoleLog.Error("Save image %s error %v", ref, err)
+			return
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			log.ConsoleLog.Error("Create %s error %v", output, err)
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := store.Save(w, refs); err != nil {
+		log.ConsoleLog.Error("Save images error %v", err)
+		if output != "" {
+			_ = os.Remove(output)
+		}
+	}
+}
+
+func ExportContainer(containerName, output string) {
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		log.ConsoleLog.Error("Get container %s info error %v", containerName, err)
+		return
+	}
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			log.ConsoleLog.Error("Create %s error %v", output, err)
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := container.ExportRootfs(containerInfo, w); err != nil {
+		log.ConsoleLog.Error("Export container %s error %v", containerName, err)
+		if output != "" {
+			_ = os.Remove(output)
+		}
+	}
+}
+
+func ImportImage(source, ref string, changes []string, message string) {
+	store, err := image.NewStore(container.ImageStoreUrl)
+	if err != nil {
+		log.ConsoleLog.Error("Open image store error %v", err)
+		return
+	}
+	config := image.NewImageConfig()
+	for _, change := range changes {
+		if err := image.ApplyChange(&config.Config, change); err != nil {
+			log.ConsoleLog.Error("Invalid change %q: %v", change, err)
+			return
+		}
+	}
+	now := time.Now().UTC()
+	config.Created = &now
+	config.History = []image.History{{
+		Created:   &now,
+		CreatedBy: "Imported from " + source,
+		Comment:   message,
+	}}
+
+	var r io.Reader = os.Stdin
+	if source != "-" {
+		f, err := os.Open(source)
+		if err != nil {
+			log.ConsoleLog.Error("Open %s error %v", source, err)
+			return
+		}
+		defer f.Close()
+		r = f
+	}
+	img, err := store.ImportStream(r, ref, config)
+	if err != nil {
+		log.ConsoleLog.Error("Import %s error %v", source, err)
+		return
+	}
+	fmt.Println(img.ID)
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"bucket/build"
+	"bucket/container"
+	"bucket/image"
+	"bucket/log"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var buildFile string
+var buildTags []string
+var buildArgs []string
+var buildNoCache bool
+
+var buildCmd = &cobra.Command{
+	Use:   "build",
+	Short: "build an image from a Bucketfile",
+	Long:  "build an image from a Dockerfile-like Bucketfile and a build context directory",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing build context")
+			return
+		}
+		BuildImage(args[0], buildFile, buildTags, buildArgs, buildNoCache)
+	},
+}
+
+func init() {
+	buildCmd.Flags().StringVarP(&buildFile, "file", "f", "", "name of the Bucketfile, default is PATH/Bucketfile")
+	buildCmd.Flags().StringArrayVarP(&buildTags, "tag", "t", []string{}, "name and optionally a tag in the name:tag format")
+	buildCmd.Flags().StringArrayVar(&buildArgs, "build-arg", []string{}, "set build-time variables, format: name=value")
+	buildCmd.Flags().BoolVar(&buildNoCache, "no-cache", false, "do not use cache when building the image")
+	buildCmd.Flags().BoolVar(&registryOptions.PlainHTTP, "plain-http", false, "use http to pull base images")
+	buildCmd.Flags().BoolVar(&registryOptions.Insecure, "insecure", false, "skip tls certificate verification when pulling base images")
+}
+
+func BuildImage(contextDir, file string, tags, args []string, noCache bool) {
+	if file == "" {
+		file = filepath.Join(contextDir, "Bucketfile")
+	}
+	for _, tag := range tags {
+		if _, err := image.NormalizeReference(tag); err != nil {
+			log.ConsoleLog.Error("%v", err)
+			return
+		}
+	}
+	buildArgMap := map[string]string{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) == 2 {
+			buildArgMap[kv[0]] = kv[1]
+		} else if value, ok := os.LookupEnv(kv[0]); ok {
+			// 只给出名字时使用当前环境变量的值
+			buildArgMap[kv[0]] = value
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		log.ConsoleLog.Error("Open %s error %v", file, err)
+		return
+	}
+	instructions, err := build.Parse(f)
+	_ = f.Close()
+	if err != nil {
+		log.ConsoleLog.Error("Parse %s error %v", file, err)
+		return
+	}
+
+	store, err := image.NewStore(container.ImageStoreUrl)
+	if err != nil {
+		log.ConsoleLog.Error("Open image store error %v", err)
+		return
+	}
+	builder, err := build.NewBuilder(store, &build.Options{
+		ContextDir:     contextDir,
+		Tags:           tags,
+		BuildArgs:      buildArgMap,
+		NoCache:        noCache,
+		LegacyImageDir: container.ImageUrl,
+		Registry:       registryOptions,
+		Output:         os.Stdout,
+	})
+	if err != nil {
+		log.ConsoleLog.Error("%v", err)
+		return
+	}
+	if _, err := builder.Build(instructions); err != nil {
+		log.ConsoleLog.Error("Build error %v", err)
+	}
+}
@@ -1,11 +1,23 @@
 package cmd
 
 import (
+	"bucket/cgroups"
 	"bucket/container"
+	"bucket/image"
 	"bucket/log"
 	"fmt"
 	"github.com/spf13/cobra"
-	"os/exec"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	commitChanges []string
+	commitAuthor  string
+	commitMessage string
+	commitPause   bool
 )
 
 var commitCmd = &cobra.Command{
@@ -19,17 +31,133 @@ var commitCmd = &cobra.Command{
 		}
 		containerName := args[0]
 		imageName := args[1]
-		commitContainer(containerName, imageName)
+		commitContainer(containerName, imageName, commitChanges, commitAuthor, commitMessage, commitPause)
 	},
 }
 
-func commitContainer(containerName, imageName string) {
-	mntURL := fmt.Sprintf(container.MntUrl, containerName)
-	mntURL += "/"
+func init() {
+	commitCmd.Flags().StringArrayVarP(&commitChanges, "change", "c", []string{},
+		"apply Dockerfile instruction to the created image: CMD, ENTRYPOINT, ENV, WORKDIR, USER, EXPOSE, LABEL")
+	commitCmd.Flags().StringVarP(&commitAuthor, "author", "a", "", "author of the image")
+	commitCmd.Flags().StringVarP(&commitMessage, "message", "m", "", "commit message")
+	commitCmd.Flags().BoolVarP(&commitPause, "pause", "p", true, "pause the container during commit")
+}
+
+func commitContainer(containerName, imageName string, changes []string, author, message string, pause bool) {
+	store, err := image.NewStore(container.ImageStoreUrl)
+	if err != nil {
+		log.ConsoleLog.Error("Open image store error %v", err)
+		return
+	}
+
+	// 容器所用的镜像作为新镜像的 parent, 新镜像的配置在 parent 的配置上修改,
+	// 找不到 parent 时把整个容器的文件系统作为单层镜像
+	parent := ""
+	var config *image.ImageConfig
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err == nil {
+		if parentImage, err := store.Get(containerInfo.Image); err == nil {
+			if parentConfig, err := store.Config(parentImage); err == nil {
+				parent = parentImage.ID
+				config = parentConfig.Copy()
+			}
+		}
+	}
+	if config == nil {
+		config = image.NewImageConfig()
+	}
+	for _, change := range changes {
+		if err := image.ApplyChange(&config.Config, change); err != nil {
+			log.ConsoleLog.Error("Invalid change %q: %v", change, err)
+			return
+		}
+	}
+	// 历史记录中写容器的命令, 和 docker 一样
+	createdBy := "bucket commit " + strings.Join(changes, " ")
+	if containerInfo != nil {
+		createdBy = containerInfo.Command
+		config.Container = containerInfo.Id
+		if len(changes) > 0 {
+			createdBy += " # " + strings.Join(changes, " ")
+		}
+	}
+	now := time.Now().UTC()
+	config.Created = &now
+	config.Author = author
+	config.History = append(config.History, image.History{
+		Created:   &now,
+		CreatedBy: createdBy,
+		Author:    author,
+		Comment:   message,
+	})
+
+	// 打包前暂停容器中的进程, 避免文件在打包过程中变化
+	if pause && containerInfo != nil && containerInfo.Status == container.RUNNING {
+		manager := cgroups.NewCgroupManager(container.CgroupName(containerInfo.Id))
+		if err := manager.Freeze(); err != nil {
+			log.ConsoleLog.Error("Pause container %s error %v, use --pause=false to commit without pausing", containerName, err)
+			return
+		}
+		defer func() {
+			if err := manager.Thaw(); err != nil {
+				log.ConsoleLog.Error("Unpause container %s error %v", containerName, err)
+			}
+		}()
+	}
+
+	tmpFile, err := ioutil.TempFile("", "bucket-commit-*.tar")
+	if err != nil {
+		log.ConsoleLog.Error("Create temp file error %v", err)
+		return
+	}
+	imageTar := tmpFile.Name()
+	_ = tmpFile.Close()
+	defer func() {
+		_ = os.Remove(imageTar)
+	}()
 
-	imageTar := container.RootUrl + "/" + imageName + ".tar"
+	if parent != "" {
+		// 只打包容器可写层中的修改, 作为 parent 之上的新层
+		err = container.WriteLayerDiff(containerName, imageTar)
+	} else {
+		err = tarRootfs(containerInfo, imageTar)
+	}
+	if err != nil {
+		log.ConsoleLog.Error("Tar container %s error %v", containerName, err)
+		return
+	}
 
-	if _, err := exec.Command("tar", "-czf", imageTar, "-C", mntURL, ".").CombinedOutput(); err != nil {
-		log.ConsoleLog.Error("Tar folder %s error %v", mntURL, err)
+	layer, err := store.RegisterLayer(imageTar)
+	if err != nil {
+		log.ConsoleLog.Error("Register layer error %v", err)
+		return
+	}
+	if parent == "" {
+		config.RootFS.DiffIDs = nil
+	}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.DiffID)
+
+	img, err := store.CreateImage(config, imageName, parent)
+	if err != nil {
+		log.ConsoleLog.Error("Import image %s error %v", imageName, err)
+		return
+	}
+	fmt.Println(img.ID)
+}
+
+// 没有 parent 时打包整个容器的文件系统, 数据卷除外. 已经停止的容器的根文件系统会被临时挂载
+func tarRootfs(containerInfo *container.ContainerInfo, tarPath string) error {
+	if containerInfo == nil {
+		return fmt.Errorf("container info not found")
+	}
+	f, err := os.Create(tarPath)
+	if err != nil {
+		return err
+	}
+	if err := container.ExportRootfs(containerInfo, f); err != nil {
+		_ = f.Close()
+		return err
 	}
+	return f.Close()
 }
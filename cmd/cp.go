@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"bucket/cgroups"
+	"bucket/container"
+	"bucket/log"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var cpCmd = &cobra.Command{
+	Use:   "cp",
+	Short: "copy files between a container and the host",
+	Long: "copy files between a container and the host: bucket cp SRC CONTAINER:DEST or bucket cp CONTAINER:SRC DEST, " +
+		"use - to read a tar archive from stdin or write a tar archive to stdout",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 2 {
+			log.ConsoleLog.Fatal("Missing source or destination")
+			return
+		}
+		if err := copyFiles(args[0], args[1]); err != nil {
+			log.ConsoleLog.Error("Copy error %v", err)
+		}
+	},
+}
+
+// 解析 CONTAINER:PATH, 以 / 或 . 开头的参数是宿主机路径, 宿主机上含有 : 的路径可以写成 ./a:b
+func splitCopyArg(arg string) (string, string) {
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return "", arg
+	}
+	i := strings.Index(arg, ":")
+	if i <= 0 {
+		return "", arg
+	}
+	return arg[:i], arg[i+1:]
+}
+
+// 宿主机上的相对路径转成绝对路径, 保留结尾的 / 和 /.
+func hostPath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasSuffix(p, "/.") || p == ".":
+		abs = strings.TrimSuffix(abs, "/") + "/."
+	case strings.HasSuffix(p, "/") && abs != "/":
+		abs += "/"
+	}
+	return abs, nil
+}
+
+func copyFiles(src, dst string) error {
+	srcContainer, srcPath := splitCopyArg(src)
+	dstContainer, dstPath := splitCopyArg(dst)
+	if (srcContainer == "") == (dstContainer == "") {
+		return fmt.Errorf("exactly one of source and destination must be a container path like CONTAINER:PATH")
+	}
+	containerName := srcContainer + dstContainer
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		return fmt.Errorf("get container %s info error %v", containerName, err)
+	}
+	containerPath := dstPath
+	if srcContainer != "" {
+		containerPath = srcPath
+	}
+	if tmpfs := container.TmpfsMountOf(containerInfo, containerPath); tmpfs != "" {
+		return fmt.Errorf("cannot copy files in tmpfs mount %s of container %s", tmpfs, containerName)
+	}
+	// 容器中的进程可能在解析路径之后把其中一级换成符号链接, 让读写落到宿主机上,
+	// 复制期间暂停容器, 路径解析和读写之间不会被修改
+	if containerInfo.Status == container.RUNNING {
+		manager := cgroups.NewCgroupManager(container.CgroupName(containerInfo.Id))
+		if err := manager.Freeze(); err != nil {
+			return fmt.Errorf("pause container %s error %v", containerName, err)
+		}
+		defer func() {
+			if err := manager.Thaw(); err != nil {
+				log.ConsoleLog.Error("Unpause container %s error %v", containerName, err)
+			}
+		}()
+	}
+	rootfs, unmount, err := container.MountRootfs(containerInfo)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	if srcContainer != "" {
+		if dstPath == "-" {
+			return container.ArchivePath(rootfs, srcPath, os.Stdout)
+		}
+		if dstPath, err = hostPath(dstPath); err != nil {
+			return err
+		}
+		return container.CopyPath(rootfs, srcPath, "/", dstPath)
+	}
+	if srcPath == "-" {
+		return container.ExtractPath(rootfs, dstPath, os.Stdin)
+	}
+	if srcPath, err = hostPath(srcPath); err != nil {
+		return err
+	}
+	return container.CopyPath("/", srcPath, rootfs, dstPath)
+}
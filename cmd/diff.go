@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"bucket/container"
+	"bucket/log"
+	"fmt"
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "inspect changes to files on a container's filesystem",
+	Long:  "list files added (A), changed (C) and deleted (D) in a container's filesystem relative to its image",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing container name")
+			return
+		}
+		diffContainer(args[0])
+	},
+}
+
+func diffContainer(containerName string) {
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		log.ConsoleLog.Error("Get container %s info error %v", containerName, err)
+		return
+	}
+	changes, err := container.ContainerChanges(containerInfo)
+	if err != nil {
+		log.ConsoleLog.Error("Diff container %s error %v", containerName, err)
+		return
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"bucket/container"
+	"bucket/image"
+	"bucket/log"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var (
+	historyFormat  string
+	historyNoTrunc bool
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "show the history of an image",
+	Long:  "show the layers of an image with their sizes and the commands that created them",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing image name")
+			return
+		}
+		imageHistory(args[0], historyFormat, historyNoTrunc)
+	},
+}
+
+func init() {
+	historyCmd.Flags().StringVar(&historyFormat, "format", "table", "output format: table or json")
+	historyCmd.Flags().BoolVar(&historyNoTrunc, "no-trunc", false, "don't truncate output")
+}
+
+func imageHistory(ref, format string, noTrunc bool) {
+	store, err := image.NewStore(container.ImageStoreUrl)
+	if err != nil {
+		log.ConsoleLog.Error("Open image store error %v", err)
+		return
+	}
+	img, err := store.Lookup(ref)
+	if err != nil {
+		log.ConsoleLog.Error("Get image %s error %v", ref, err)
+		return
+	}
+	entries, err := store.History(img)
+	if err != nil {
+		log.ConsoleLog.Error("Get history of %s error %v", ref, err)
+		return
+	}
+
+	switch format {
+	case "json":
+		content, err := json.MarshalIndent(entries, "", "    ")
+		if err != nil {
+			log.ConsoleLog.Error("Json marshal history error %v", err)
+			return
+		}
+		fmt.Println(string(content))
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprint(w, "IMAGE\tCREATED\tCREATED BY\tSIZE\tCOMMENT\n")
+		for _, entry := range entries {
+			// 只有最上面一行对应本地的镜像
+			id := "<missing>"
+			if entry.ID != "" {
+				id = img.ShortID()
+				if noTrunc {
+					id = entry.ID
+				}
+			}
+			created := ""
+			if entry.Created != nil {
+				created = entry.Created.Local().Format("2006-01-02 15:04:05")
+			}
+			createdBy := strings.Join(strings.Fields(entry.CreatedBy), " ")
+			if !noTrunc && len(createdBy) > 45 {
+				createdBy = createdBy[:44] + "…"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", id, created, createdBy, formatSize(entry.Size), entry.Comment)
+		}
+		if err := w.Flush(); err != nil {
+			log.ConsoleLog.Error("Flush error %v", err)
+		}
+	default:
+		log.ConsoleLog.Error("Unknown format %s, should be table or json", format)
+	}
+}
@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"bucket/container"
+	"bucket/image"
+	"bucket/log"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var imagesFormat string
+var forceRemoveImage bool
+
+var imagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "list images",
+	Long:  "list images in local image store",
+	Run: func(cmd *cobra.Command, args []string) {
+		ListImages(imagesFormat)
+	},
+}
+
+var rmiCmd = &cobra.Command{
+	Use:   "rmi",
+	Short: "remove images",
+	Long:  "remove images, refuse to remove images used by containers unless forced",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing image name")
+			return
+		}
+		for _, ref := range args {
+			removeImage(ref, forceRemoveImage)
+		}
+	},
+}
+
+var tagCmd = &cobra.Command{
+	Use:   "tag",
+	Short: "create a tag that refers to an image",
+	Long:  "create a tag TARGET_IMAGE that refers to SOURCE_IMAGE",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 2 {
+			log.ConsoleLog.Fatal("Missing source image or target image")
+			return
+		}
+		store, err := image.NewStore(container.ImageStoreUrl)
+		if err != nil {
+			log.ConsoleLog.Fatal("Open image store error %v", err)
+			return
+		}
+		if err := store.Tag(args[0], args[1]); err != nil {
+			log.ConsoleLog.Fatal("Tag image %s error %v", args[0], err)
+		}
+	},
+}
+
+func init() {
+	imagesCmd.Flags().StringVar(&imagesFormat, "format", "table", "output format: table or json")
+	rmiCmd.Flags().BoolVarP(&forceRemoveImage, "force", "f", false, "remove the image even if it is used by containers")
+}
+
+func ListImages(format string) {
+	store, err := image.NewStore(container.ImageStoreUrl)
+	if err != nil {
+		log.ConsoleLog.Error("Open image store error %v", err)
+		return
+	}
+	images, err := store.List()
+	if err != nil {
+		log.ConsoleLog.Error("List images error %v", err)
+		return
+	}
+
+	switch format {
+	case "json":
+		if images == nil {
+			images = []*image.Image{}
+		}
+		content, err := json.MarshalIndent(images, "", "    ")
+		if err != nil {
+			log.ConsoleLog.Error("Json marshal images error %v", err)
+			return
+		}
+		fmt.Println(string(content))
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprint(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE\n")
+		for _, img := range images {
+			created := img.Created.Format("2006-01-02 15:04:05")
+			tags := img.Tags
+			// 没有 tag 的镜像也要显示
+			if len(tags) == 0 {
+				tags = []string{"<none>:<none>"}
+			}
+			for _, tag := range tags {
+				repo, t := image.SplitReference(tag)
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", repo, t, img.ShortID(), created, formatSize(img.Size))
+			}
+		}
+		if err := w.Flush(); err != nil {
+			log.ConsoleLog.Error("Flush error %v", err)
+		}
+	default:
+		log.ConsoleLog.Error("Unknown format %s, should be table or json", format)
+	}
+}
+
+func removeImage(ref string, force bool) {
+	store, err := image.NewStore(container.ImageStoreUrl)
+	if err != nil {
+		log.ConsoleLog.Error("Open image store error %v", err)
+		return
+	}
+	img, err := store.Lookup(ref)
+	if err != nil {
+		log.ConsoleLog.Error("Remove image %s error %v", ref, err)
+		return
+	}
+
+	// 只删除其中一个 tag 时镜像本身还在, 不需要检查容器
+	normalized, _ := image.NormalizeReference(ref)
+	untagOnly := len(img.Tags) > 1 && contains(img.Tags, normalized)
+	if !untagOnly {
+		users := imageUsers(img.ID)
+		if len(users) > 0 && !force {
+			log.ConsoleLog.Error("Image %s is used by containers %s, use -f to force removal", ref, strings.Join(users, ", "))
+			return
+		}
+		if len(users) > 0 {
+			// 容器还挂载着镜像的层, 只删除 tag, 镜像在容器删除后可以再清理
+			log.ConsoleLog.Warning("Image %s is used by containers %s, only untag it", ref, strings.Join(users, ", "))
+			result, err := store.Untag(ref)
+			for _, line := range result {
+				fmt.Println(line)
+			}
+			if err != nil {
+				log.ConsoleLog.Error("Untag image %s error %v", ref, err)
+			}
+			return
+		}
+	}
+
+	result, err := store.Remove(ref, force)
+	for _, line := range result {
+		fmt.Println(line)
+	}
+	if err != nil {
+		log.ConsoleLog.Error("Remove image %s error %v", ref, err)
+	}
+}
+
+// 使用镜像的容器名, 包括已经停止的容器
+func imageUsers(imageID string) []string {
+	containers, err := getAllContainerInfos()
+	if err != nil {
+		return nil
+	}
+	var users []string
+	for _, c := range containers {
+		if c.Image == imageID {
+			users = append(users, c.Name)
+		}
+	}
+	return users
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func formatSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(size)
+	i := 0
+	for value >= 1000 && i < len(units)-1 {
+		value /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[i])
+	}
+	return fmt.Sprintf("%.3g%s", value, units[i])
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"bucket/log"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "show container detail",
+	Long:  "show container detail",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing container name")
+			return
+		}
+		inspectContainer(args[0])
+	},
+}
+
+func inspectContainer(containerName string) {
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		log.ConsoleLog.Error("Get container %s info error %v", containerName, err)
+		return
+	}
+	content, err := json.MarshalIndent(containerInfo, "", "    ")
+	if err != nil {
+		log.ConsoleLog.Error("Json marshal %s error %v", containerName, err)
+		return
+	}
+	fmt.Println(string(content))
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/spf13/cobra"
 	"io/ioutil"
 	"os"
+	"strings"
 	"text/tabwriter"
 )
 
@@ -21,16 +22,44 @@ var listCommand = &cobra.Command{
 }
 
 func ListContainers() {
+	containers, err := getAllContainerInfos()
+	if err != nil {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "ID\tNAME\tPID\tSTATUS\tCOMMAND\tCREATED\tPORTS\n")
+	for _, item := range containers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			item.Id,
+			item.Name,
+			item.Pid,
+			item.Status,
+			item.Command,
+			item.CreatedTime,
+			formatPorts(item.Ports))
+	}
+	if err := w.Flush(); err != nil {
+		log.ConsoleLog.Error("Flush error %v", err)
+		return
+	}
+}
+
+func getAllContainerInfos() ([]*container.ContainerInfo, error) {
 	dirURL := fmt.Sprintf(container.DefaultInfoLocation, "")
 	dirURL = dirURL[:len(dirURL)-1]
 	files, err := ioutil.ReadDir(dirURL)
 	if err != nil {
 		log.ConsoleLog.Error("Read dir %s error %v", dirURL, err)
-		return
+		return nil, err
 	}
 
 	var containers []*container.ContainerInfo
 	for _, file := range files {
+		// 网络等其他模块的数据也存放在这个目录下
+		if _, err := os.Stat(fmt.Sprintf(container.DefaultInfoLocation, file.Name()) + container.ConfigName); err != nil {
+			continue
+		}
 		tmpContainer, err := getContainerInfo(file)
 		if err != nil {
 			log.ConsoleLog.Error("Get container info error %v", err)
@@ -38,22 +67,15 @@ func ListContainers() {
 		}
 		containers = append(containers, tmpContainer)
 	}
+	return containers, nil
+}
 
-	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
-	fmt.Fprint(w, "ID\tNAME\tPID\tSTATUS\tCOMMAND\tCREATED\n")
-	for _, item := range containers {
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
-			item.Id,
-			item.Name,
-			item.Pid,
-			item.Status,
-			item.Command,
-			item.CreatedTime)
-	}
-	if err := w.Flush(); err != nil {
-		log.ConsoleLog.Error("Flush error %v", err)
-		return
+func formatPorts(ports []container.PortBinding) string {
+	var list []string
+	for _, pb := range ports {
+		list = append(list, pb.String())
 	}
+	return strings.Join(list, ", ")
 }
 
 func getContainerInfo(file os.FileInfo) (*container.ContainerInfo, error) {
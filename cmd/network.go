@@ -3,11 +3,19 @@ package cmd
 import (
 	"bucket/log"
 	"bucket/network"
+	"encoding/json"
+	"fmt"
 	"github.com/spf13/cobra"
+	"strings"
 )
 
 var driver string
 var subnet string
+var gateway string
+var ipRange string
+var internal bool
+var netOptions []string
+var forceRemoveNetwork bool
 
 var networkCmd = &cobra.Command{
 	Use:   "network",
@@ -24,8 +32,19 @@ var netCreateCmd = &cobra.Command{
 			log.ConsoleLog.Fatal("Missing network name")
 			return
 		}
+		options, err := parseNetworkOptions(netOptions)
+		if err != nil {
+			log.ConsoleLog.Fatal("%v", err)
+			return
+		}
+		// overlay 网络只能是内部网络, 没有指定 --internal 时默认打开
+		if driver == "overlay" && !cmd.Flags().Changed("internal") {
+			internal = true
+		}
 		_ = network.Init()
-		err := network.CreateNetwork(driver, subnet, args[0])
+		// 重启后先恢复已有的网络, 避免新网络和还没重建的网桥冲突
+		network.RestoreAfterBoot()
+		err = network.CreateNetwork(driver, subnet, gateway, ipRange, args[0], internal, options)
 		if err != nil {
 			log.ConsoleLog.Fatal("create network error: %+v", err)
 		}
@@ -54,17 +73,144 @@ var netRemoveCmd = &cobra.Command{
 			return
 		}
 		_ = network.Init()
-		err := network.DeleteNetwork(args[0])
+		err := network.DeleteNetwork(args[0], forceRemoveNetwork)
 		if err != nil {
 			log.ConsoleLog.Fatal("remove network error: %+v", err)
 		}
 	},
 }
 
+var netInspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "show container network detail",
+	Long:  "show subnet, gateway, driver options and connected containers of a network",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing network name")
+			return
+		}
+		_ = network.Init()
+		inspect, err := network.InspectNetwork(args[0])
+		if err != nil {
+			log.ConsoleLog.Fatal("inspect network error: %+v", err)
+			return
+		}
+		content, err := json.MarshalIndent(inspect, "", "    ")
+		if err != nil {
+			log.ConsoleLog.Fatal("Json marshal %s error %v", args[0], err)
+			return
+		}
+		fmt.Println(string(content))
+	},
+}
+
+var netPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "remove unused container networks",
+	Long:  "remove all networks without connected containers",
+	Run: func(cmd *cobra.Command, args []string) {
+		_ = network.Init()
+		pruned, err := network.PruneNetworks()
+		for _, name := range pruned {
+			fmt.Println(name)
+		}
+		if err != nil {
+			log.ConsoleLog.Fatal("prune network error: %+v", err)
+		}
+	},
+}
+
+var netRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "recreate bridges and rules of container networks",
+	Long: "recreate missing bridges, addresses and firewall rules from persisted networks and report drift. " +
+		"run only restores networks after a reboot and the network it connects to, " +
+		"after the firewall rules are flushed run this and reconcile to restore all networks and port mappings",
+	Run: func(cmd *cobra.Command, args []string) {
+		_ = network.Init()
+		result, err := network.RestoreNetworks()
+		for name, drift := range result {
+			if len(drift) == 0 {
+				fmt.Printf("%s: ok\n", name)
+				continue
+			}
+			for _, d := range drift {
+				fmt.Printf("%s: %s\n", name, d)
+			}
+		}
+		if err != nil {
+			log.ConsoleLog.Fatal("restore network error: %+v", err)
+		}
+	},
+}
+
+var netReconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "rebuild iptables rules of container networks",
+	Long:  "rebuild iptables rules from persisted networks and containers",
+	Run: func(cmd *cobra.Command, args []string) {
+		_ = network.Init()
+		containers, err := getAllContainerInfos()
+		if err != nil {
+			log.ConsoleLog.Fatal("get containers error: %+v", err)
+			return
+		}
+		if err := network.Reconcile(containers); err != nil {
+			log.ConsoleLog.Fatal("reconcile network error: %+v", err)
+		}
+	},
+}
+
+var netCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "check container network",
+	Long:  "check that the network of a container is still configured as connected, supported by cni networks",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing container name")
+			return
+		}
+		containerInfo, err := getContainerInfoByName(args[0])
+		if err != nil {
+			log.ConsoleLog.Fatal("get container %s error: %+v", args[0], err)
+			return
+		}
+		_ = network.Init()
+		if err := network.CheckNetwork(containerInfo.NetworkMode, containerInfo); err != nil {
+			log.ConsoleLog.Fatal("check network error: %+v", err)
+			return
+		}
+		log.ConsoleLog.Info("network of container %s is ok", containerInfo.Name)
+	},
+}
+
+// --opt 的格式为 key=value
+func parseNetworkOptions(opts []string) (map[string]string, error) {
+	options := map[string]string{}
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid network option %q, should be key=value", opt)
+		}
+		options[kv[0]] = kv[1]
+	}
+	return options, nil
+}
+
 func init() {
 	netCreateCmd.Flags().StringVarP(&driver, "driver", "d", "bridge", "network driver")
 	netCreateCmd.Flags().StringVarP(&subnet, "subnet", "s", "192.168.0.1/24", "subnet driver")
+	netCreateCmd.Flags().StringVar(&gateway, "gateway", "", "gateway of the subnet, the first address by default")
+	netCreateCmd.Flags().StringVar(&ipRange, "ip-range", "", "allocate container ip from a sub-range of the subnet, required by overlay networks and must not overlap between hosts")
+	netCreateCmd.Flags().BoolVar(&internal, "internal", false, "restrict external access to the network")
+	netCreateCmd.Flags().StringArrayVarP(&netOptions, "opt", "o", []string{}, "set driver specific options, e.g. com.bucket.icc=false, mtu=1400, bridge_name=br0, enable_ip_masquerade=false")
+	netRemoveCmd.Flags().BoolVarP(&forceRemoveNetwork, "force", "f", false, "remove the network even if containers are still connected")
 	networkCmd.AddCommand(netCreateCmd)
 	networkCmd.AddCommand(netListCmd)
 	networkCmd.AddCommand(netRemoveCmd)
+	networkCmd.AddCommand(netInspectCmd)
+	networkCmd.AddCommand(netPruneCmd)
+	networkCmd.AddCommand(netRestoreCmd)
+	networkCmd.AddCommand(netReconcileCmd)
+	networkCmd.AddCommand(netCheckCmd)
 }
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"bucket/container"
+	"bucket/image"
+	"bucket/log"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var registryOptions = &image.RegistryOptions{}
+
+var pullCmd = &cobra.Command{
+	Use:   "pull",
+	Short: "pull an image from a registry",
+	Long:  "pull an image or a repository from a registry that speaks the registry HTTP API v2",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing image name")
+			return
+		}
+		PullImage(args[0], registryOptions)
+	},
+}
+
+var pushCmd = &cobra.Command{
+	Use:   "push",
+	Short: "push an image to a registry",
+	Long:  "push an image to the registry in its name, e.g. localhost:5000/app:v1",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing image name")
+			return
+		}
+		PushImage(args[0], registryOptions)
+	},
+}
+
+func init() {
+	for _, c := range []*cobra.Command{pullCmd, pushCmd} {
+		c.Flags().BoolVar(&registryOptions.PlainHTTP, "plain-http", false, "use http instead of https to access the registry")
+		c.Flags().BoolVar(&registryOptions.Insecure, "insecure", false, "skip tls certificate verification of the registry")
+		c.Flags().StringVar(&registryOptions.Username, "username", os.Getenv("BUCKET_REGISTRY_USERNAME"), "registry username")
+		c.Flags().StringVar(&registryOptions.Password, "password", os.Getenv("BUCKET_REGISTRY_PASSWORD"), "registry password")
+	}
+}
+
+func PullImage(ref string, opts *image.RegistryOptions) {
+	store, err := image.NewStore(container.ImageStoreUrl)
+	if err != nil {
+		log.ConsoleLog.Error("Open image store error %v", err)
+		return
+	}
+	img, err := store.Pull(ref, opts, os.Stdout)
+	if err != nil {
+		log.ConsoleLog.Error("Pull image %s error %v", ref, err)
+		return
+	}
+	fmt.Printf("Pulled %s, image ID %s\n", ref, img.ShortID())
+}
+
+func PushImage(ref string, opts *image.RegistryOptions) {
+	store, err := image.NewStore(container.ImageStoreUrl)
+	if err != nil {
+		log.ConsoleLog.Error("Open image store error %v", err)
+		return
+	}
+	digest, err := store.Push(ref, opts, os.Stdout)
+	if err != nil {
+		log.ConsoleLog.Error("Push image %s error %v", ref, err)
+		return
+	}
+	fmt.Printf("Digest: %s\n", digest)
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"bucket/cgroups"
 	"bucket/container"
 	"bucket/log"
 	"fmt"
@@ -37,5 +38,7 @@ func removeContainer(containerName string) {
 		log.ConsoleLog.Error("Remove file %s error %v", dirURL, err)
 		return
 	}
-	container.DeleteWorkSpace(containerInfo.Volume, containerName)
+	container.DeleteWorkSpace(containerInfo.AllMounts(), containerName)
+	container.ReleaseVolumes(containerInfo)
+	_ = cgroups.NewCgroupManager(container.CgroupName(containerInfo.Id)).Destroy()
 }
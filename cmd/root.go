@@ -20,4 +20,19 @@ func init() {
 	rootCmd.AddCommand(removeCmd)
 	rootCmd.AddCommand(commitCmd)
 	rootCmd.AddCommand(networkCmd)
+	rootCmd.AddCommand(inspectCmd)
+	rootCmd.AddCommand(imagesCmd)
+	rootCmd.AddCommand(rmiCmd)
+	rootCmd.AddCommand(tagCmd)
+	rootCmd.AddCommand(loadCmd)
+	rootCmd.AddCommand(saveCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(pullCmd)
+	rootCmd.AddCommand(pushCmd)
+	rootCmd.AddCommand(buildCmd)
+	rootCmd.AddCommand(historyCmd)
+	rootCmd.AddCommand(cpCmd)
+	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(volumeCmd)
 }
@@ -4,6 +4,7 @@ import (
 	"bucket/cgroups"
 	"bucket/cgroups/subsystems"
 	"bucket/container"
+	"bucket/image"
 	"bucket/log"
 	"bucket/network"
 	"encoding/json"
@@ -20,13 +21,20 @@ var tty bool
 var input bool
 var detach bool
 var name string
-var volume string
+var volumeSpecs []string
+var mountSpecs []string
+var tmpfsSpecs []string
+var readOnly bool
 var memory string
 var cpuSet string
 var cpuShare string
 var envList []string
 var net string
 var portMapping []string
+var publishAll bool
+var entrypoint string
+var workDir string
+var user string
 
 var runCmd = &cobra.Command{
 	Use:   "run",
@@ -52,7 +60,17 @@ var runCmd = &cobra.Command{
 			CpuSet:      cpuSet,
 		}
 
-		Run(input, tty, cmdList, resConf, name, volume, imageName, envList, net, portMapping)
+		// --entrypoint "" 清空镜像的 entrypoint, 没有指定时使用镜像的
+		var entrypointOverride []string
+		if cmd.Flags().Changed("entrypoint") {
+			entrypointOverride = []string{}
+			if entrypoint != "" {
+				entrypointOverride = []string{entrypoint}
+			}
+		}
+
+		Run(input, tty, cmdList, resConf, name, volumeSpecs, mountSpecs, tmpfsSpecs, readOnly, imageName, envList, net, portMapping,
+			publishAll, entrypointOverride, workDir, user)
 	},
 }
 
@@ -61,114 +79,242 @@ func init() {
 	runCmd.Flags().BoolVarP(&input, "input", "i", true, "pen std input")
 	runCmd.Flags().BoolVarP(&detach, "detach", "d", false, "detach container")
 	runCmd.Flags().StringVarP(&name, "name", "n", "", "set container Name")
-	runCmd.Flags().StringVarP(&volume, "volume", "v", "", "set container volume")
+	runCmd.Flags().StringArrayVarP(&volumeSpecs, "volume", "v", []string{},
+		"bind mount a host directory or a volume, format: [<host path|volume name>:]<container path>[:ro,z,nocopy,rprivate...]")
+	runCmd.Flags().StringArrayVar(&mountSpecs, "mount", []string{},
+		"attach a filesystem mount, format: type=bind|volume|tmpfs,src=<source>,dst=<destination>[,readonly]")
+	runCmd.Flags().StringArrayVar(&tmpfsSpecs, "tmpfs", []string{}, "mount a tmpfs directory, format: <container path>[:size=64m,mode=1777]")
+	runCmd.Flags().BoolVar(&readOnly, "read-only", false, "mount the container's root filesystem as read only")
 	runCmd.Flags().StringVarP(&memory, "memory", "m", "", "set container memory limit")
 	runCmd.Flags().StringVarP(&cpuSet, "cpuset", "x", "", "set container cpuset")
 	runCmd.Flags().StringVarP(&cpuShare, "cpushare", "y", "", "set container cpushare")
-	runCmd.Flags().StringVarP(&net, "net", "z", "", "set container network")
+	runCmd.Flags().StringVarP(&net, "net", "z", container.NetModeNone, "set container network: host, none, container:<name> or network name")
 	runCmd.Flags().StringSliceVarP(&portMapping, "port", "p", []string{}, "set container port")
 	runCmd.Flags().StringSliceVarP(&envList, "environment", "e", []string{}, "set container env")
+	runCmd.Flags().BoolVarP(&publishAll, "publish-all", "P", false, "publish all exposed ports of the image to random host ports")
+	runCmd.Flags().StringVar(&entrypoint, "entrypoint", "", "overwrite the default entrypoint of the image")
+	runCmd.Flags().StringVarP(&workDir, "workdir", "w", "", "working directory inside the container")
+	runCmd.Flags().StringVarP(&user, "user", "u", "", "username or uid, format: <name|uid>[:<group|gid>]")
 }
 
-func Run(input, tty bool, comArray []string, res *subsystems.ResourceConfig, containerName, volume, imageName string, envSlice []string,
-	nw string, portMapping []string) {
+func Run(input, tty bool, comArray []string, res *subsystems.ResourceConfig, containerName string, volumeSpecs, mountSpecs, tmpfsSpecs []string, readOnly bool, imageName string, envSlice []string,
+	nw string, portMapping []string, publishAll bool, entrypoint []string, workDir, user string) {
 	containerID := randStringBytes(10)
 	if containerName == "" {
 		containerName = containerID
 	}
+	if nw == "" {
+		nw = container.NetModeNone
+	}
+
+	// 用镜像配置补全命令行没有给出的参数
+	store, img, err := container.GetImage(imageName)
+	if err != nil {
+		log.ConsoleLog.Error("Get image %s error %v", imageName, err)
+		return
+	}
+	imageConfig, err := store.Config(img)
+	if err != nil {
+		log.ConsoleLog.Error("Get image %s config error %v", imageName, err)
+		return
+	}
+	config := imageConfig.Config
+	if entrypoint != nil {
+		config.Entrypoint = entrypoint
+	}
+	initConfig := &container.InitConfig{
+		Args:       config.Command(comArray),
+		WorkingDir: config.WorkingDir,
+		User:       config.User,
+		ReadOnly:   readOnly,
+	}
+	if len(initConfig.Args) == 0 {
+		log.ConsoleLog.Error("No command specified and image %s has no default command", imageName)
+		return
+	}
+	if workDir != "" {
+		initConfig.WorkingDir = workDir
+	}
+	if user != "" {
+		initConfig.User = user
+	}
+	envSlice = image.MergeEnv(config.Env, envSlice)
+	if publishAll {
+		portMapping = append(portMapping, config.Ports()...)
+	}
+
+	// 端口映射在启动容器前校验, 只有连接网络的容器才能发布端口
+	ports, err := network.ParsePortSpecs(portMapping)
+	if err != nil {
+		log.ConsoleLog.Error("%v", err)
+		return
+	}
+	if len(ports) > 0 && (nw == container.NetModeNone || container.IsSharedNetMode(nw)) {
+		log.ConsoleLog.Error("Port mapping is not supported in network mode %s", nw)
+		return
+	}
+
+	mounts, err := container.ParseMounts(volumeSpecs, mountSpecs, tmpfsSpecs)
+	if err != nil {
+		log.ConsoleLog.Error("%v", err)
+		return
+	}
+
+	// container:<name> 模式下加入目标容器的 net namespace
+	var netContainer *container.ContainerInfo
+	if strings.HasPrefix(nw, container.NetModeContainerPrefix) {
+		targetName := strings.TrimPrefix(nw, container.NetModeContainerPrefix)
+		target, err := getContainerInfoByName(targetName)
+		if err != nil {
+			log.ConsoleLog.Error("Get network container %s error %v", targetName, err)
+			return
+		}
+		if target.Status != container.RUNNING {
+			log.ConsoleLog.Error("Network container %s is not running", targetName)
+			return
+		}
+		netContainer = target
+	}
+
+	// 创建工作空间前先记录容器, 它引用的卷在启动前也不会被当作没有容器使用
+	containerInfo := &container.ContainerInfo{
+		Id:          containerID,
+		Command:     strings.Join(initConfig.Args, " "),
+		CreatedTime: time.Now().Format("2006-01-02 15:04:05"),
+		Status:      container.CREATED,
+		Name:        containerName,
+		Mounts:      mounts,
+		ReadOnly:    readOnly,
+		PortMapping: portMapping,
+		Ports:       ports,
+		NetworkMode: nw,
+		Image:       img.ID,
+	}
+	if err := recordContainerInfo(containerInfo); err != nil {
+		log.ConsoleLog.Error("Record container info error %v", err)
+		return
+	}
 
-	parent, writePipe := container.NewContainerProcess(input, tty, containerName, volume, imageName, envSlice)
+	parent, writePipe := container.NewContainerProcess(input, tty, containerID, containerName, mounts, imageName, envSlice, nw)
 	if parent == nil {
 		log.ConsoleLog.Error("New parent process error")
+		deleteContainerInfo(containerName)
 		return
 	}
-	if err := parent.Start(); err != nil {
+	if netContainer != nil {
+		err = network.RunInContainerNetns(netContainer, parent.Start)
+	} else {
+		err = parent.Start()
+	}
+	if err != nil {
 		log.ConsoleLog.Error("%v", err)
+		deleteContainerInfo(containerName)
+		container.DeleteWorkSpace(mounts, containerName)
+		container.ReleaseVolumes(containerInfo)
+		return
 	}
 
-	//record container info
-	containerName, err := recordContainerInfo(parent.Process.Pid, comArray, containerName, containerID, volume)
-	if err != nil {
+	containerInfo.Pid = strconv.Itoa(parent.Process.Pid)
+	containerInfo.Status = container.RUNNING
+	if err := recordContainerInfo(containerInfo); err != nil {
 		log.ConsoleLog.Error("Record container info error %v", err)
 		return
 	}
 
-	// use bucket-cgroup as cgroup name
-	cgroupManager := cgroups.NewCgroupManager("bucket-cgroup")
-	defer cgroupManager.Destroy()
+	// 每个容器一个 cgroup, 名字由容器ID得出. 后台运行的容器此时还在 cgroup 中,
+	// 由 stop 在进程退出后或者 rm 删除
+	cgroupManager := cgroups.NewCgroupManager(container.CgroupName(containerID))
+	if tty {
+		defer cgroupManager.Destroy()
+	}
 	cgroupManager.Set(res)
 	cgroupManager.Apply(parent.Process.Pid)
 
-	if nw != "" {
+	switch {
+	case nw == container.NetModeHost || netContainer != nil:
+		// 共享已有的网络, 不需要配置
+	case nw == container.NetModeNone:
+		if err := network.SetupLoopback(containerInfo); err != nil {
+			log.ConsoleLog.Error("Error setup loopback %v", err)
+		}
+	default:
 		// config container network
 		_ = network.Init()
-		containerInfo := &container.ContainerInfo{
-			Id:          containerID,
-			Pid:         strconv.Itoa(parent.Process.Pid),
-			Name:        containerName,
-			PortMapping: portMapping,
+		network.RestoreAfterBoot()
+		if err := network.EnsureNetwork(nw); err != nil {
+			log.ConsoleLog.Error("Error restore network %v", err)
 		}
 		if err := network.Connect(nw, containerInfo); err != nil {
 			log.ConsoleLog.Error("Error Connect Network %v", err)
 			return
 		}
+		if err := recordContainerInfo(containerInfo); err != nil {
+			log.ConsoleLog.Error("Record container info error %v", err)
+			return
+		}
 	}
 
-	sendInitCommand(comArray, writePipe)
+	sendInitCommand(initConfig, writePipe)
 
 	if tty {
 		parent.Wait()
+		releaseContainerNetwork(containerInfo)
 		deleteContainerInfo(containerName)
-		container.DeleteWorkSpace(volume, containerName)
+		container.DeleteWorkSpace(containerInfo.Mounts, containerName)
+		container.ReleaseVolumes(containerInfo)
 	}
 
 }
 
-func sendInitCommand(comArray []string, writePipe *os.File) {
-	command := strings.Join(comArray, " ")
-	log.ConsoleLog.Info("command all is %s", command)
-	writePipe.WriteString(command)
+func sendInitCommand(initConfig *container.InitConfig, writePipe *os.File) {
+	log.ConsoleLog.Info("command all is %s", strings.Join(initConfig.Args, " "))
+	content, err := json.Marshal(initConfig)
+	if err != nil {
+		log.ConsoleLog.Error("Marshal init config error %v", err)
+	}
+	writePipe.Write(content)
 	writePipe.Close()
 }
 
-func recordContainerInfo(containerPID int, commandArray []string, containerName, id, volume string) (string, error) {
-	createTime := time.Now().Format("2006-01-02 15:04:05")
-	command := strings.Join(commandArray, "")
-	containerInfo := &container.ContainerInfo{
-		Id:          id,
-		Pid:         strconv.Itoa(containerPID),
-		Command:     command,
-		CreatedTime: createTime,
-		Status:      container.RUNNING,
-		Name:        containerName,
-		Volume:      volume,
-	}
-
+func recordContainerInfo(containerInfo *container.ContainerInfo) error {
 	jsonBytes, err := json.Marshal(containerInfo)
 	if err != nil {
 		log.ConsoleLog.Error("Record container info error %v", err)
-		return "", err
+		return err
 	}
 	jsonStr := string(jsonBytes)
 
-	dirUrl := fmt.Sprintf(container.DefaultInfoLocation, containerName)
+	dirUrl := fmt.Sprintf(container.DefaultInfoLocation, containerInfo.Name)
 	if err := os.MkdirAll(dirUrl, 0622); err != nil {
 		log.ConsoleLog.Error("Mkdir error %s error %v", dirUrl, err)
-		return "", err
+		return err
 	}
 	fileName := dirUrl + "/" + container.ConfigName
 	file, err := os.Create(fileName)
 	defer file.Close()
 	if err != nil {
 		log.ConsoleLog.Error("Create file %s error %v", fileName, err)
-		return "", err
+		return err
 	}
 	if _, err := file.WriteString(jsonStr); err != nil {
 		log.ConsoleLog.Error("File write string error %v", err)
-		return "", err
+		return err
 	}
 
-	return containerName, nil
+	return nil
+}
+
+// 释放容器在网络中占用的资源, 共享网络的模式没有需要释放的
+func releaseContainerNetwork(containerInfo *container.ContainerInfo) {
+	// CNI 插件可能不返回 IPv4 地址, 是否连接了网络要看网络模式而不是地址
+	nw := containerInfo.NetworkMode
+	if nw == "" || nw == container.NetModeNone || container.IsSharedNetMode(nw) {
+		return
+	}
+	_ = network.Init()
+	if err := network.Disconnect(containerInfo.NetworkMode, containerInfo); err != nil {
+		log.ConsoleLog.Error("Error Disconnect Network %v", err)
+	}
 }
 
 func deleteContainerInfo(containerId string) {
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"bucket/cgroups"
 	"bucket/container"
 	"bucket/log"
 	"encoding/json"
@@ -9,8 +10,12 @@ import (
 	"io/ioutil"
 	"strconv"
 	"syscall"
+	"time"
 )
 
+// stop 等待容器进程退出的时间
+const stopTimeout = 10 * time.Second
+
 var stopCmd = &cobra.Command{
 	Use:   "stop",
 	Short: "stop a container",
@@ -45,6 +50,13 @@ func stopContainer(containerName string) {
 		log.ConsoleLog.Error("Get container %s info error %v", containerName, err)
 		return
 	}
+	releaseContainerNetwork(containerInfo)
+	// 进程还在 cgroup 中时无法删除, 等它退出后再删, 超时的由 rm 删除
+	if waitProcessExit(pidInt, stopTimeout) {
+		_ = cgroups.NewCgroupManager(container.CgroupName(containerInfo.Id)).Destroy()
+	} else {
+		log.ConsoleLog.Warning("Container %s is still exiting, its cgroup will be removed by rm", containerName)
+	}
 	containerInfo.Status = container.STOP
 	containerInfo.Pid = " "
 	newContentBytes, err := json.Marshal(containerInfo)
@@ -59,6 +71,18 @@ func stopContainer(containerName string) {
 	}
 }
 
+// 等待进程退出, 超时返回 false
+func waitProcessExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
 func getContainerInfoByName(containerName string) (*container.ContainerInfo, error) {
 	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
 	configFilePath := dirURL + container.ConfigName
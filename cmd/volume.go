@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"bucket/container"
+	"bucket/log"
+	"bucket/volumes"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var volumeLabels []string
+var volumeListQuiet bool
+var forceRemoveVolume bool
+
+var volumeCmd = &cobra.Command{
+	Use:   "volume",
+	Short: "volume",
+	Long:  "manage named volumes",
+}
+
+var volumeCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "create a volume",
+	Long:  "create a named volume, a random name is generated if none is given",
+	Run: func(cmd *cobra.Command, args []string) {
+		name := ""
+		if len(args) > 0 {
+			name = args[0]
+		}
+		labels := map[string]string{}
+		for _, label := range volumeLabels {
+			kv := strings.SplitN(label, "=", 2)
+			if kv[0] == "" {
+				log.ConsoleLog.Fatal("invalid label %q, should be key=value", label)
+				return
+			}
+			labels[kv[0]] = ""
+			if len(kv) == 2 {
+				labels[kv[0]] = kv[1]
+			}
+		}
+		store, err := openVolumeStore()
+		if err != nil {
+			log.ConsoleLog.Fatal("Open volume store error %v", err)
+			return
+		}
+		v, err := store.Create(name, labels)
+		if err != nil {
+			log.ConsoleLog.Fatal("create volume error: %v", err)
+			return
+		}
+		fmt.Println(v.Name)
+	},
+}
+
+var volumeListCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "list volumes",
+	Long:    "list volumes",
+	Aliases: []string{"ls"},
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := openVolumeStore()
+		if err != nil {
+			log.ConsoleLog.Fatal("Open volume store error %v", err)
+			return
+		}
+		list, err := store.List()
+		if err != nil {
+			log.ConsoleLog.Fatal("list volumes error: %v", err)
+			return
+		}
+		if volumeListQuiet {
+			for _, v := range list {
+				fmt.Println(v.Name)
+			}
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+		fmt.Fprint(w, "DRIVER\tVOLUME NAME\tCONTAINERS\n")
+		for _, v := range list {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", v.Driver, v.Name, len(v.Containers))
+		}
+		if err := w.Flush(); err != nil {
+			log.ConsoleLog.Error("Flush error %v", err)
+		}
+	},
+}
+
+var volumeInspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "show volume detail",
+	Long:  "show mountpoint, labels and containers using the volumes",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing volume name")
+			return
+		}
+		store, err := openVolumeStore()
+		if err != nil {
+			log.ConsoleLog.Fatal("Open volume store error %v", err)
+			return
+		}
+		list := []*volumes.Volume{}
+		for _, name := range args {
+			v, err := store.Get(name)
+			if err != nil {
+				log.ConsoleLog.Fatal("inspect volume error: %v", err)
+				return
+			}
+			list = append(list, v)
+		}
+		content, err := json.MarshalIndent(list, "", "    ")
+		if err != nil {
+			log.ConsoleLog.Fatal("Json marshal volumes error %v", err)
+			return
+		}
+		fmt.Println(string(content))
+	},
+}
+
+var volumeRemoveCmd = &cobra.Command{
+	Use:     "remove",
+	Short:   "remove volumes",
+	Long:    "remove volumes, volumes used by containers are never removed, force only drops references of containers that no longer exist",
+	Aliases: []string{"rm"},
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 {
+			log.ConsoleLog.Fatal("Missing volume name")
+			return
+		}
+		var stale func(string) bool
+		if forceRemoveVolume {
+			var err error
+			if stale, err = staleContainer(); err != nil {
+				log.ConsoleLog.Fatal("Get containers error %v", err)
+				return
+			}
+		}
+		store, err := openVolumeStore()
+		if err != nil {
+			log.ConsoleLog.Fatal("Open volume store error %v", err)
+			return
+		}
+		for _, name := range args {
+			if err := store.Remove(name, stale); err != nil {
+				log.ConsoleLog.Error("remove volume error: %v", err)
+				continue
+			}
+			fmt.Println(name)
+		}
+	},
+}
+
+var volumePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "remove unused volumes",
+	Long:  "remove all volumes not used by any container",
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := openVolumeStore()
+		if err != nil {
+			log.ConsoleLog.Fatal("Open volume store error %v", err)
+			return
+		}
+		pruned, err := store.Prune()
+		for _, name := range pruned {
+			fmt.Println(name)
+		}
+		if err != nil {
+			log.ConsoleLog.Fatal("prune volumes error: %v", err)
+		}
+	},
+}
+
+// 判断容器是否已经不存在, 用来清理被删除的容器遗留的卷引用
+func staleContainer() (func(string) bool, error) {
+	infos, err := getAllContainerInfos()
+	if err != nil {
+		return nil, err
+	}
+	exists := map[string]bool{}
+	for _, info := range infos {
+		exists[info.Id] = true
+	}
+	return func(id string) bool {
+		return !exists[id]
+	}, nil
+}
+
+func openVolumeStore() (*volumes.Store, error) {
+	return volumes.NewStore(container.VolumeStoreUrl)
+}
+
+func init() {
+	volumeCreateCmd.Flags().StringArrayVarP(&volumeLabels, "label", "l", []string{}, "set metadata for a volume, format: key=value")
+	volumeListCmd.Flags().BoolVarP(&volumeListQuiet, "quiet", "q", false, "only display volume names")
+	volumeRemoveCmd.Flags().BoolVarP(&forceRemoveVolume, "force", "f", false, "drop references of containers that no longer exist before removing")
+	volumeCmd.AddCommand(volumeCreateCmd)
+	volumeCmd.AddCommand(volumeListCmd)
+	volumeCmd.AddCommand(volumeInspectCmd)
+	volumeCmd.AddCommand(volumeRemoveCmd)
+	volumeCmd.AddCommand(volumePruneCmd)
+}
@@ -3,12 +3,15 @@ package container
 import (
 	"bucket/log"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 )
 
 var (
+	CREATED             string = "created"
 	RUNNING             string = "running"
 	STOP                string = "stopped"
 	Exit                string = "exited"
@@ -19,29 +22,64 @@ var (
 	MntUrl              string = "/home/kain/Documents/mnt/%s"
 	WriteLayerUrl       string = "/home/kain/Documents/writeLayer/%s"
 	ImageUrl            string = "/home/kain/Documents"
+	ImageStoreUrl       string = "/home/kain/Documents/image"
+	VolumeStoreUrl      string = "/home/kain/Documents/volumes"
+)
+
+// 容器网络模式, 除此之外的值都被当作要连接的网络名
+const (
+	NetModeHost            = "host"
+	NetModeNone            = "none"
+	NetModeContainerPrefix = "container:"
 )
 
 type ContainerInfo struct {
-	Pid         string   `json:"pid"`         //容器的init进程在宿主机上的 PID
-	Id          string   `json:"id"`          //容器Id
-	Name        string   `json:"name"`        //容器名
-	Command     string   `json:"command"`     //容器内init运行命令
-	CreatedTime string   `json:"createTime"`  //创建时间
-	Status      string   `json:"status"`      //容器的状态
-	Volume      string   `json:"volume"`      //容器的数据卷
-	PortMapping []string `json:"portmapping"` //端口映射
+	Pid         string        `json:"pid"`         //容器的init进程在宿主机上的 PID
+	Id          string        `json:"id"`          //容器Id
+	Name        string        `json:"name"`        //容器名
+	Command     string        `json:"command"`     //容器内init运行命令
+	CreatedTime string        `json:"createTime"`  //创建时间
+	Status      string        `json:"status"`      //容器的状态
+	Volume      string        `json:"volume"`      //旧版本的 -v 参数, 新的挂载记录在 Mounts 中
+	Mounts      []Mount       `json:"mounts"`      //-v, --mount 和 --tmpfs 指定的挂载
+	ReadOnly    bool          `json:"readOnly"`    //根文件系统只读
+	PortMapping []string      `json:"portmapping"` //端口映射
+	Ports       []PortBinding `json:"ports"`       //解析后实际生效的端口映射
+	NetworkMode string        `json:"networkMode"` //网络模式: host, none, container:<name> 或网络名
+	IPAddress   string        `json:"ip"`          //容器在网络中分配到的IP
+	Image       string        `json:"image"`       //容器所用镜像的ID
 }
 
-func NewContainerProcess(input, tty bool, containerName, volume, imageName string, envSlice []string) (*exec.Cmd, *os.File) {
-	readPipe, writePipe, err := NewPipe()
-	if err != nil {
-		log.ConsoleLog.Error("New pipe error %v", err)
-		return nil, nil
+// 一条宿主机端口到容器端口的映射
+type PortBinding struct {
+	HostIP        string `json:"hostIp"`
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+func (pb PortBinding) String() string {
+	hostIP := pb.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
 	}
-	cmd := exec.Command("/proc/self/exe", "init")
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS |
-			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC,
+	return fmt.Sprintf("%s:%d->%d/%s", hostIP, pb.HostPort, pb.ContainerPort, pb.Protocol)
+}
+
+// 每个容器使用自己的 cgroup, 提交时可以只暂停这一个容器
+func CgroupName(containerID string) string {
+	return "bucket-" + containerID
+}
+
+// 共享宿主机或其他容器的网络时不创建新的 net namespace
+func IsSharedNetMode(netMode string) bool {
+	return netMode == NetModeHost || strings.HasPrefix(netMode, NetModeContainerPrefix)
+}
+
+func NewContainerProcess(input, tty bool, containerID, containerName string, mounts []Mount, imageName string, envSlice []string, netMode string) (*exec.Cmd, *os.File) {
+	cmd, writePipe := newInitProcess(containerName, netMode)
+	if cmd == nil {
+		return nil, nil
 	}
 
 	if tty {
@@ -65,9 +103,50 @@ func NewContainerProcess(input, tty bool, containerName, volume, imageName strin
 		cmd.Stdout = stdLogFile
 	}
 
-	cmd.ExtraFiles = []*os.File{readPipe}
 	cmd.Env = append(os.Environ(), envSlice...)
-	NewWorkSpace(volume, imageName, containerName)
+	if err := NewWorkSpace(mounts, imageName, containerID, containerName); err != nil {
+		log.ConsoleLog.Error("New workspace error %v", err)
+		return nil, nil
+	}
+	return cmd, writePipe
+}
+
+// 构建镜像时执行 RUN 的容器: 直接使用给定的层, 共享宿主机网络, 输出写到 output,
+// 环境变量只使用 envSlice, 不继承宿主机的
+func NewBuildProcess(containerName string, layerDirs []string, envSlice []string, output io.Writer) (*exec.Cmd, *os.File, error) {
+	cmd, writePipe := newInitProcess(containerName, NetModeHost)
+	if cmd == nil {
+		return nil, nil, fmt.Errorf("new init process error")
+	}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.Env = envSlice
+
+	CreateWriteLayer(containerName)
+	if err := CreateMountPoint(containerName, layerDirs); err != nil {
+		_ = writePipe.Close()
+		DeleteWriteLayer(containerName)
+		return nil, nil, err
+	}
+	return cmd, writePipe, nil
+}
+
+// 执行 bucket init 的子进程, 在新的 namespace 中以 MntUrl 下的容器目录为根
+func newInitProcess(containerName, netMode string) (*exec.Cmd, *os.File) {
+	readPipe, writePipe, err := NewPipe()
+	if err != nil {
+		log.ConsoleLog.Error("New pipe error %v", err)
+		return nil, nil
+	}
+	cmd := exec.Command("/proc/self/exe", "init")
+	cloneflags := syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC
+	if !IsSharedNetMode(netMode) {
+		cloneflags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: uintptr(cloneflags),
+	}
+	cmd.ExtraFiles = []*os.File{readPipe}
 	cmd.Dir = fmt.Sprintf(MntUrl, containerName)
 	return cmd, writePipe
 }
@@ -0,0 +1,103 @@
+package container
+
+import (
+	"bucket/utils"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 按 docker cp 的规则把 srcRoot 中的 src 复制到 dstRoot 中的 dst. 两边的路径都以各自的 root 为根解析,
+// 路径中的符号链接也在 root 中解析, 所以容器中的链接不会指到宿主机上. 宿主机一侧的 root 为 /.
+// 解析和读写不是原子的, 调用方要保证期间容器中的进程不会修改路径, 例如暂停容器
+func CopyPath(srcRoot, src, dstRoot, dst string) error {
+	srcPath, err := utils.SecureJoin(srcRoot, src)
+	if err != nil {
+		return err
+	}
+	srcInfo, err := os.Stat(srcPath)
+	if err != nil {
+		return fmt.Errorf("no such file or directory: %s", src)
+	}
+	dstPath, err := utils.SecureJoin(dstRoot, dst)
+	if err != nil {
+		return err
+	}
+
+	// 复制到 targetDir 下, 名字为 name, name 为空时只复制目录中的内容
+	targetDir, name := filepath.Dir(dstPath), filepath.Base(dstPath)
+	dstInfo, err := os.Stat(dstPath)
+	switch {
+	case err == nil && dstInfo.IsDir():
+		targetDir, name = dstPath, copyName(src)
+	case err == nil && srcInfo.IsDir():
+		return fmt.Errorf("cannot copy a directory to a file: %s", dst)
+	case err == nil:
+	case !os.IsNotExist(err):
+		return err
+	case strings.HasSuffix(dst, "/") && !srcInfo.IsDir():
+		return fmt.Errorf("destination directory does not exist: %s", dst)
+	default:
+		if parent, err := os.Stat(targetDir); err != nil || !parent.IsDir() {
+			return fmt.Errorf("destination directory does not exist: %s", filepath.Dir(dst))
+		}
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		_ = w.CloseWithError(utils.Tar(srcPath, w, &utils.TarOptions{Name: name}))
+	}()
+	err = utils.Untar(r, targetDir)
+	_ = r.CloseWithError(err)
+	return err
+}
+
+// 把 root 中的 src 打包写到 w, 包中的顶层为 src 的名字, src 以 /. 结尾时只打包其中的内容
+func ArchivePath(root, src string, w io.Writer) error {
+	srcPath, err := utils.SecureJoin(root, src)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(srcPath); err != nil {
+		return fmt.Errorf("no such file or directory: %s", src)
+	}
+	return utils.Tar(srcPath, w, &utils.TarOptions{Name: copyName(src)})
+}
+
+// 把 tar 流解开到 root 中的 dst 目录
+func ExtractPath(root, dst string, r io.Reader) error {
+	dstPath, err := utils.SecureJoin(root, dst)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dstPath); err != nil || !info.IsDir() {
+		return fmt.Errorf("destination directory does not exist: %s", dst)
+	}
+	return utils.Untar(r, dstPath)
+}
+
+// 容器中 p 所在的 tmpfs 挂载, 不在 tmpfs 中时返回空. tmpfs 只在容器的 mount namespace 中,
+// 复制时看不到其中的内容, 写入的文件也会被丢弃
+func TmpfsMountOf(info *ContainerInfo, p string) string {
+	p = filepath.Clean("/" + p)
+	for _, m := range info.AllMounts() {
+		if m.Type == MountTypeTmpfs && (p == m.Destination || strings.HasPrefix(p, strings.TrimSuffix(m.Destination, "/")+"/")) {
+			return m.Destination
+		}
+	}
+	return ""
+}
+
+// 复制到目录中时使用的名字, 和 docker 一样 src 以 /. 结尾时表示复制目录中的内容
+func copyName(src string) string {
+	if strings.HasSuffix(src, "/.") || src == "." {
+		return ""
+	}
+	name := filepath.Base(filepath.Clean("/" + src))
+	if name == "/" {
+		return ""
+	}
+	return name
+}
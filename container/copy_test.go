@@ -0,0 +1,95 @@
+package container
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCopyPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-cp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	host := path.Join(dir, "host")
+	rootfs := path.Join(dir, "rootfs")
+	for _, d := range []string{path.Join(host, "conf/sub"), path.Join(rootfs, "tmp"), path.Join(dir, "outside")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = ioutil.WriteFile(path.Join(host, "app.txt"), []byte("app"), 0644)
+	_ = ioutil.WriteFile(path.Join(host, "conf/sub/a.conf"), []byte("a"), 0644)
+	// 容器中指向绝对路径的链接按容器的根解析
+	if err := os.Symlink(path.Join(dir, "outside"), path.Join(rootfs, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	exists := func(p string) bool {
+		_, err := os.Lstat(p)
+		return err == nil
+	}
+
+	if err := CopyPath("/", path.Join(host, "app.txt"), rootfs, "/etc/app.txt"); err == nil {
+		t.Errorf("copy into missing directory should fail")
+	}
+	if err := CopyPath("/", path.Join(host, "app.txt"), rootfs, "/tmp"); err != nil || !exists(path.Join(rootfs, "tmp/app.txt")) {
+		t.Errorf("copy file into dir: %v", err)
+	}
+	if err := CopyPath("/", path.Join(host, "app.txt"), rootfs, "/tmp/renamed"); err != nil || !exists(path.Join(rootfs, "tmp/renamed")) {
+		t.Errorf("copy file to new name: %v", err)
+	}
+	if err := CopyPath("/", path.Join(host, "conf"), rootfs, "/tmp"); err != nil || !exists(path.Join(rootfs, "tmp/conf/sub/a.conf")) {
+		t.Errorf("copy dir into dir: %v", err)
+	}
+	if err := CopyPath("/", path.Join(host, "conf")+"/.", rootfs, "/tmp"); err != nil || !exists(path.Join(rootfs, "tmp/sub/a.conf")) {
+		t.Errorf("copy dir content: %v", err)
+	}
+	if err := CopyPath("/", path.Join(host, "conf"), rootfs, "/tmp/app.txt"); err == nil {
+		t.Errorf("copy dir to file should fail")
+	}
+
+	// 经过指向外部的链接写入, 只能写到容器的根之内
+	if err := os.MkdirAll(path.Join(rootfs, dir, "outside"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyPath("/", path.Join(host, "app.txt"), rootfs, "/etc/"); err != nil {
+		t.Fatal(err)
+	}
+	if exists(path.Join(dir, "outside/app.txt")) || !exists(path.Join(rootfs, dir, "outside/app.txt")) {
+		t.Errorf("symlink in container should not escape rootfs")
+	}
+
+	if err := CopyPath(rootfs, "/tmp/conf", "/", path.Join(dir, "copied")); err != nil || !exists(path.Join(dir, "copied/sub/a.conf")) {
+		t.Errorf("copy dir out of container: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := ArchivePath(rootfs, "/tmp/conf", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExtractPath(rootfs, "/etc", &buf); err != nil || !exists(path.Join(rootfs, dir, "outside/conf/sub/a.conf")) {
+		t.Errorf("extract tar stream: %v", err)
+	}
+	if err := ExtractPath(rootfs, "/missing", &buf); err == nil {
+		t.Errorf("extract into missing directory should fail")
+	}
+}
+
+func TestTmpfsMountOf(t *testing.T) {
+	info := &ContainerInfo{Mounts: []Mount{
+		{Type: MountTypeTmpfs, Destination: "/run"},
+		{Type: MountTypeBind, Source: "/host", Destination: "/data"},
+	}}
+	cases := map[string]string{
+		"/run": "/run", "run/app.pid": "/run", "/run/../run/x": "/run",
+		"/runner": "", "/data/x": "", "/": "",
+	}
+	for p, expect := range cases {
+		if got := TmpfsMountOf(info, p); got != expect {
+			t.Errorf("TmpfsMountOf(%q) = %q, expect %q", p, got, expect)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package container
+
+import (
+	"bucket/image"
+	"bucket/utils"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// overlay 的 whiteout: 删除的文件是 0/0 的字符设备, 被替换的目录有这个 xattr
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+type ChangeKind int
+
+const (
+	ChangeModify ChangeKind = iota
+	ChangeAdd
+	ChangeDelete
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdd:
+		return "A"
+	case ChangeDelete:
+		return "D"
+	}
+	return "C"
+}
+
+// 容器文件系统中的一处变化, Path 是容器中的绝对路径
+type Change struct {
+	Path string     `json:"path"`
+	Kind ChangeKind `json:"kind"`
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s %s", c.Kind, c.Path)
+}
+
+// 容器相对于镜像的变化
+func ContainerChanges(info *ContainerInfo) ([]Change, error) {
+	store, err := image.NewStore(ImageStoreUrl)
+	if err != nil {
+		return nil, err
+	}
+	img, err := store.Get(info.Image)
+	if err != nil {
+		return nil, err
+	}
+	layerDirs, err := store.LayerDirs(img)
+	if err != nil {
+		return nil, err
+	}
+	writeURL := fmt.Sprintf(WriteLayerUrl, info.Name)
+	if exists, _ := utils.PathExists(writeURL); !exists {
+		return nil, fmt.Errorf("write layer of container %s does not exist", info.Name)
+	}
+	return Changes(layerDirs, writeURL)
+}
+
+// 比较可写层 upperDir 和只读层 layerDirs (上层在前), 返回按路径排序的变化.
+// 可写层可以是 aufs 或 overlay 的格式
+func Changes(layerDirs []string, upperDir string) ([]Change, error) {
+	var changes []Change
+	// 被整个替换的目录, 其中的文件不再和下层比较
+	opaque := map[string]bool{}
+	err := filepath.Walk(upperDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upperDir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.Base(rel)
+		parent := filepath.Dir(rel)
+
+		switch {
+		case strings.HasPrefix(name, image.WhiteoutMetaPrefix):
+			// aufs 自己的文件和目录, 以及不透明目录的标记
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case strings.HasPrefix(name, image.WhiteoutPrefix):
+			deleted := filepath.Join(parent, strings.TrimPrefix(name, image.WhiteoutPrefix))
+			if !underOpaque(opaque, deleted) && lowerStat(layerDirs, deleted) != nil {
+				changes = append(changes, Change{Path: "/" + deleted, Kind: ChangeDelete})
+			}
+			return nil
+		case isOverlayWhiteout(info):
+			if !underOpaque(opaque, rel) && lowerStat(layerDirs, rel) != nil {
+				changes = append(changes, Change{Path: "/" + rel, Kind: ChangeDelete})
+			}
+			return nil
+		}
+
+		var lower os.FileInfo
+		if !underOpaque(opaque, rel) {
+			lower = lowerStat(layerDirs, rel)
+		}
+		switch {
+		case lower == nil:
+			changes = append(changes, Change{Path: "/" + rel, Kind: ChangeAdd})
+		case !sameFile(p, info, lowerPath(layerDirs, rel), lower):
+			changes = append(changes, Change{Path: "/" + rel, Kind: ChangeModify})
+		}
+
+		// 被替换的目录中, 下层有而可写层没有的文件都被删除了
+		if info.IsDir() && lower != nil && lower.IsDir() && isOpaque(p) {
+			names, err := lowerChildren(layerDirs, rel)
+			if err != nil {
+				return err
+			}
+			for _, child := range names {
+				if _, err := os.Lstat(filepath.Join(p, child)); os.IsNotExist(err) {
+					changes = append(changes, Change{Path: "/" + filepath.Join(rel, child), Kind: ChangeDelete})
+				}
+			}
+			opaque[rel] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 和 docker 一样, 有变化的文件的上级目录都算作修改
+	seen := map[string]bool{}
+	for _, c := range changes {
+		seen[c.Path] = true
+	}
+	for _, c := range changes {
+		for dir := filepath.Dir(c.Path); dir != "/"; dir = filepath.Dir(dir) {
+			if !seen[dir] {
+				seen[dir] = true
+				changes = append(changes, Change{Path: dir, Kind: ChangeModify})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func underOpaque(opaque map[string]bool, rel string) bool {
+	for p := filepath.Dir(rel); p != "."; p = filepath.Dir(p) {
+		if opaque[p] {
+			return true
+		}
+	}
+	return false
+}
+
+func isOverlayWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+func isOpaque(dir string) bool {
+	if _, err := os.Lstat(filepath.Join(dir, image.WhiteoutOpaque)); err == nil {
+		return true
+	}
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, overlayOpaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// 在只读层中能看到 rel 的层, 上层在前. 某一层删除了 rel 或者它的上级目录,
+// 或者把上级目录整个替换时, 更下面的层就看不到了
+func visibleLayers(layerDirs []string, rel string) []string {
+	var layers []string
+	for _, layer := range layerDirs {
+		if whitedOut(layer, rel) {
+			break
+		}
+		info, err := os.Lstat(filepath.Join(layer, rel))
+		if err == nil {
+			layers = append(layers, layer)
+			if !info.IsDir() {
+				break
+			}
+		}
+		if hidesLower(layer, rel, err == nil) {
+			break
+		}
+	}
+	return layers
+}
+
+func whitedOut(layer, rel string) bool {
+	for p := rel; p != "."; p = filepath.Dir(p) {
+		wh := filepath.Join(layer, filepath.Dir(p), image.WhiteoutPrefix+filepath.Base(p))
+		if _, err := os.Lstat(wh); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// 这一层中 rel 本身 (存在时) 或它的上级目录是不透明目录
+func hidesLower(layer, rel string, exists bool) bool {
+	p := filepath.Dir(rel)
+	if exists {
+		p = rel
+	}
+	for ; p != "."; p = filepath.Dir(p) {
+		if _, err := os.Lstat(filepath.Join(layer, p, image.WhiteoutOpaque)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerPath(layerDirs []string, rel string) string {
+	layers := visibleLayers(layerDirs, rel)
+	if len(layers) == 0 {
+		return ""
+	}
+	return filepath.Join(layers[0], rel)
+}
+
+func lowerStat(layerDirs []string, rel string) os.FileInfo {
+	p := lowerPath(layerDirs, rel)
+	if p == "" {
+		return nil
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// 只读层合并后目录 rel 中的文件名
+func lowerChildren(layerDirs []string, rel string) ([]string, error) {
+	seen := map[string]bool{}
+	var names []string
+	for _, layer := range visibleLayers(layerDirs, rel) {
+		files, err := ioutil.ReadDir(filepath.Join(layer, rel))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			name := f.Name()
+			if strings.HasPrefix(name, image.WhiteoutMetaPrefix) {
+				continue
+			}
+			if strings.HasPrefix(name, image.WhiteoutPrefix) {
+				seen[strings.TrimPrefix(name, image.WhiteoutPrefix)] = true
+				continue
+			}
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// 和 docker 一样按元数据判断是否修改: 只是被复制到可写层而没有修改的文件保留了原来的修改时间
+func sameFile(upperPath string, upper os.FileInfo, lowerPath string, lower os.FileInfo) bool {
+	us, uok := upper.Sys().(*syscall.Stat_t)
+	ls, lok := lower.Sys().(*syscall.Stat_t)
+	if !uok || !lok {
+		return false
+	}
+	if upper.Mode() != lower.Mode() || us.Uid != ls.Uid || us.Gid != ls.Gid || us.Rdev != ls.Rdev {
+		return false
+	}
+	// 目录中的文件变化会修改目录的时间, 这时目录作为上级目录列出, 这里只比较权限和属主
+	if upper.IsDir() {
+		return true
+	}
+	if upper.Size() != lower.Size() || !upper.ModTime().Equal(lower.ModTime()) {
+		return false
+	}
+	if upper.Mode()&os.ModeSymlink != 0 {
+		ul, _ := os.Readlink(upperPath)
+		ll, _ := os.Readlink(lowerPath)
+		return ul == ll
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(p, content string) {
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Chtimes(p, mtime, mtime)
+	}
+	base := path.Join(dir, "base")
+	top := path.Join(dir, "top")
+	write(path.Join(base, "etc/passwd"), "root")
+	write(path.Join(base, "etc/hosts"), "localhost")
+	write(path.Join(base, "var/log/a.log"), "log")
+	write(path.Join(base, "var/cache/x"), "x")
+	write(path.Join(base, "usr/bin/tool"), "tool")
+	write(path.Join(top, "etc/.wh.hosts"), "")
+	write(path.Join(top, "usr/bin/tool2"), "tool2")
+	layers := []string{top, base}
+
+	// aufs 格式的可写层, usr/bin/tool 只是被复制上来, 没有修改
+	aufs := path.Join(dir, "aufs")
+	write(path.Join(aufs, "etc/passwd"), "root\nnginx")
+	write(path.Join(aufs, "etc/hosts"), "recreated")
+	write(path.Join(aufs, "etc/new"), "new")
+	write(path.Join(aufs, "var/.wh.log"), "")
+	write(path.Join(aufs, "var/cache/.wh..wh..opq"), "")
+	write(path.Join(aufs, "var/cache/y"), "y")
+	write(path.Join(aufs, "usr/bin/tool"), "tool")
+	write(path.Join(aufs, ".wh..wh.aufs"), "")
+	write(path.Join(aufs, ".wh..wh.plnk/1"), "")
+
+	changes, err := Changes(layers, aufs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	expect := []string{"C /etc", "A /etc/hosts", "A /etc/new", "C /etc/passwd", "C /var",
+		"C /var/cache", "D /var/cache/x", "A /var/cache/y", "D /var/log"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("aufs changes:\n%v\nexpect\n%v", got, expect)
+	}
+
+	// overlay 格式需要 root 才能创建 whiteout 设备和 trusted xattr
+	if os.Geteuid() != 0 {
+		return
+	}
+	overlay := path.Join(dir, "overlay")
+	write(path.Join(overlay, "var/cache/z"), "z")
+	if err := os.MkdirAll(path.Join(overlay, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(path.Join(overlay, "etc/passwd"), unix.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(path.Join(overlay, "var/cache"), overlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("trusted xattr not supported: %v", err)
+	}
+	changes, err = Changes(layers, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	expect = []string{"C /etc", "D /etc/passwd", "C /var", "C /var/cache", "D /var/cache/x", "A /var/cache/z"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("overlay changes:\n%v\nexpect\n%v", got, expect)
+	}
+}
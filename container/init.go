@@ -2,36 +2,69 @@ package container
 
 import (
 	"bucket/log"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
+	"runtime"
 	"syscall"
 )
 
+// 父进程通过管道发送给容器 init 进程的参数
+type InitConfig struct {
+	Args       []string `json:"args"`                 //要执行的命令, 已经合并了镜像的 entrypoint 和 cmd
+	WorkingDir string   `json:"workingDir,omitempty"` //工作目录, 不存在时创建
+	User       string   `json:"user,omitempty"`       //user[:group], 可以是名字或者数字
+	ReadOnly   bool     `json:"readOnly,omitempty"`   //根文件系统只读, tmpfs 和卷的挂载不受影响
+}
+
 func RunContainerInitProcess() error {
-	cmdArray := readUserCommand()
-	if cmdArray == nil || len(cmdArray) == 0 {
+	config := readInitConfig()
+	if config == nil || len(config.Args) == 0 {
 		return fmt.Errorf("Run container get user command error, cmdArray is nil")
 	}
 
 	setUpMount()
 
-	path, err := exec.LookPath(cmdArray[0])
+	if config.WorkingDir != "" {
+		if err := os.MkdirAll(config.WorkingDir, 0755); err != nil {
+			return fmt.Errorf("create working dir %s error: %v", config.WorkingDir, err)
+		}
+		if err := os.Chdir(config.WorkingDir); err != nil {
+			return fmt.Errorf("chdir %s error: %v", config.WorkingDir, err)
+		}
+	}
+
+	// 工作目录要在只读之前创建
+	if config.ReadOnly {
+		if err := remountReadOnly(); err != nil {
+			return err
+		}
+	}
+
+	path, err := exec.LookPath(config.Args[0])
 	if err != nil {
 		log.ConsoleLog.Error("Exec loop path error %v", err)
 		return err
 	}
 
-	if err := syscall.Exec(path, cmdArray[0:], os.Environ()); err != nil {
+	if config.User != "" {
+		// setuid 只对当前线程生效, exec 必须在同一个线程上执行
+		runtime.LockOSThread()
+		if err := setUser(config.User); err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Exec(path, config.Args, os.Environ()); err != nil {
 		log.ConsoleLog.Error(err.Error())
 	}
 	return nil
 }
 
-func readUserCommand() []string {
+func readInitConfig() *InitConfig {
 	pipe := os.NewFile(uintptr(3), "pipe")
 	defer pipe.Close()
 	msg, err := ioutil.ReadAll(pipe)
@@ -39,8 +72,12 @@ func readUserCommand() []string {
 		log.ConsoleLog.Error("init read pipe error %v", err)
 		return nil
 	}
-	msgStr := string(msg)
-	return strings.Split(msgStr, " ")
+	config := &InitConfig{}
+	if err := json.Unmarshal(msg, config); err != nil {
+		log.ConsoleLog.Error("init parse config error %v", err)
+		return nil
+	}
+	return config
 }
 
 /**
@@ -62,6 +99,16 @@ func setUpMount() {
 	syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755")
 }
 
+// pivotRoot 时根目录被 bind mount 到了自己, 只重新挂载这一层为只读,
+// 其上的 /proc, /dev, tmpfs 和卷是独立的挂载, 仍然可写
+func remountReadOnly() error {
+	flags := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY
+	if err := syscall.Mount("", "/", "", uintptr(flags), ""); err != nil {
+		return fmt.Errorf("remount rootfs read only error: %v", err)
+	}
+	return nil
+}
+
 func pivotRoot(root string) error {
 	/**
 	  为了使当前root的老 root 和新 root 不在同一个文件系统下，我们把root重新mount了一次
@@ -0,0 +1,487 @@
+package container
+
+import (
+	"bucket/log"
+	"bucket/utils"
+	"bucket/volumes"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	MountTypeBind   = "bind"
+	MountTypeVolume = "volume"
+	MountTypeTmpfs  = "tmpfs"
+)
+
+// 挂载传播方式对应的 mount 标志
+var propagationFlags = map[string]uintptr{
+	"private":  syscall.MS_PRIVATE,
+	"rprivate": syscall.MS_PRIVATE | syscall.MS_REC,
+	"shared":   syscall.MS_SHARED,
+	"rshared":  syscall.MS_SHARED | syscall.MS_REC,
+	"slave":    syscall.MS_SLAVE,
+	"rslave":   syscall.MS_SLAVE | syscall.MS_REC,
+}
+
+// 容器中的一个挂载, 来自 -v 或 --mount
+type Mount struct {
+	Type        string `json:"type"`                  //bind, volume 或 tmpfs
+	Source      string `json:"source,omitempty"`      //宿主机路径或卷名, 匿名卷创建后记录生成的卷名
+	Destination string `json:"destination"`           //容器中的绝对路径
+	ReadOnly    bool   `json:"readOnly,omitempty"`    //只读挂载
+	Propagation string `json:"propagation,omitempty"` //挂载传播方式, 默认 rprivate
+	Relabel     string `json:"relabel,omitempty"`     //z, 开启 SELinux 时把来源标记为容器共享的标签
+	NoCopy      bool   `json:"noCopy,omitempty"`      //卷为空时不复制镜像中的内容
+	TmpfsSize   int64  `json:"tmpfsSize,omitempty"`   //tmpfs 的大小, 单位字节, 0 表示不限制
+	TmpfsMode   uint32 `json:"tmpfsMode,omitempty"`   //tmpfs 根目录的权限
+}
+
+func (m *Mount) String() string {
+	source := m.Source
+	if m.Type == MountTypeTmpfs {
+		source = MountTypeTmpfs
+	}
+	return source + ":" + m.Destination
+}
+
+// 解析 -v 参数: <宿主机路径|卷名>:<容器路径>[:选项], 只有容器路径时创建匿名卷.
+// 选项用逗号分隔: ro, rw, z, Z, nocopy 和挂载传播方式
+func ParseVolumeSpec(spec string) (*Mount, error) {
+	parts := strings.Split(spec, ":")
+	m := &Mount{Type: MountTypeVolume}
+	switch len(parts) {
+	case 1:
+		m.Destination = parts[0]
+	case 2, 3:
+		m.Source, m.Destination = parts[0], parts[1]
+	default:
+		return nil, fmt.Errorf("invalid volume spec %q, should be <source>:<destination>[:<options>]", spec)
+	}
+	if m.Source != "" && !volumes.IsName(m.Source) {
+		if !filepath.IsAbs(m.Source) {
+			return nil, fmt.Errorf("invalid volume spec %q, source should be an absolute path or a volume name", spec)
+		}
+		m.Type = MountTypeBind
+	}
+	if len(parts) == 3 {
+		for _, opt := range strings.Split(parts[2], ",") {
+			switch {
+			case opt == "ro":
+				m.ReadOnly = true
+			case opt == "rw":
+				m.ReadOnly = false
+			case opt == "z":
+				m.Relabel = opt
+			case opt == "Z":
+				// 私有标签需要给每个容器分配 MCS level, 不能当成共享标签处理
+				return nil, fmt.Errorf("private selinux label Z in volume spec %q is not supported, use z for a shared label", spec)
+			case opt == "nocopy" && m.Type == MountTypeVolume:
+				m.NoCopy = true
+			case propagationFlags[opt] != 0 && m.Type == MountTypeBind:
+				m.Propagation = opt
+			default:
+				return nil, fmt.Errorf("invalid option %q in volume spec %q", opt, spec)
+			}
+		}
+	}
+	return m, m.validate()
+}
+
+// 解析 --mount 参数: 逗号分隔的 key=value, 例如 type=bind,src=/data,dst=/data,readonly
+func ParseMountSpec(spec string) (*Mount, error) {
+	m := &Mount{Type: MountTypeVolume}
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		// 只有布尔选项可以省略值
+		boolValue := func() (bool, error) {
+			if len(kv) == 1 {
+				return true, nil
+			}
+			return strconv.ParseBool(value)
+		}
+		var err error
+		switch key {
+		case "type":
+			m.Type = value
+		case "source", "src":
+			m.Source = value
+		case "destination", "dst", "target":
+			m.Destination = value
+		case "readonly", "ro":
+			m.ReadOnly, err = boolValue()
+		case "bind-propagation":
+			m.Propagation = value
+		case "volume-nocopy":
+			m.NoCopy, err = boolValue()
+		case "tmpfs-size":
+			m.TmpfsSize, err = utils.ParseSize(value)
+		case "tmpfs-mode":
+			var mode uint64
+			mode, err = strconv.ParseUint(value, 8, 32)
+			m.TmpfsMode = uint32(mode)
+		default:
+			return nil, fmt.Errorf("unknown key %q in mount spec %q", key, spec)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s in mount spec %q: %v", key, spec, err)
+		}
+	}
+	switch m.Type {
+	case MountTypeBind:
+		if m.Source == "" || !filepath.IsAbs(m.Source) {
+			return nil, fmt.Errorf("bind mount %q needs an absolute source path", spec)
+		}
+		// --mount 和 docker 一样不会自动创建宿主机上的目录
+		if _, err := os.Stat(m.Source); err != nil {
+			return nil, fmt.Errorf("bind source path does not exist: %s", m.Source)
+		}
+	case MountTypeVolume:
+		if m.Source != "" && !volumes.IsName(m.Source) {
+			return nil, fmt.Errorf("invalid volume name %q in mount spec %q", m.Source, spec)
+		}
+	case MountTypeTmpfs:
+		if m.Source != "" {
+			return nil, fmt.Errorf("tmpfs mount %q should not have a source", spec)
+		}
+	default:
+		return nil, fmt.Errorf("invalid mount type %q, should be bind, volume or tmpfs", m.Type)
+	}
+	if m.Propagation != "" && m.Type != MountTypeBind {
+		return nil, fmt.Errorf("bind-propagation is only supported by bind mounts")
+	}
+	if (m.TmpfsSize != 0 || m.TmpfsMode != 0) && m.Type != MountTypeTmpfs {
+		return nil, fmt.Errorf("tmpfs options are only supported by tmpfs mounts")
+	}
+	return m, m.validate()
+}
+
+// 解析 --tmpfs 参数: <容器路径>[:size=64m,mode=1777]
+func ParseTmpfsSpec(spec string) (*Mount, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	m := &Mount{Type: MountTypeTmpfs, Destination: parts[0]}
+	if len(parts) == 2 {
+		for _, opt := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid option %q in tmpfs spec %q, should be size=<size> or mode=<mode>", opt, spec)
+			}
+			var err error
+			switch kv[0] {
+			case "size":
+				m.TmpfsSize, err = utils.ParseSize(kv[1])
+			case "mode":
+				var mode uint64
+				mode, err = strconv.ParseUint(kv[1], 8, 32)
+				m.TmpfsMode = uint32(mode)
+			default:
+				return nil, fmt.Errorf("unknown option %q in tmpfs spec %q", kv[0], spec)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s in tmpfs spec %q: %v", kv[0], spec, err)
+			}
+		}
+	}
+	return m, m.validate()
+}
+
+func (m *Mount) validate() error {
+	if m.Destination == "" || !filepath.IsAbs(m.Destination) {
+		return fmt.Errorf("mount destination %q should be an absolute path", m.Destination)
+	}
+	m.Destination = filepath.Clean(m.Destination)
+	if m.Destination == "/" {
+		return fmt.Errorf("mount destination can not be /")
+	}
+	if _, ok := propagationFlags[m.Propagation]; m.Propagation != "" && !ok {
+		return fmt.Errorf("invalid propagation %q", m.Propagation)
+	}
+	return nil
+}
+
+// 解析全部 -v, --mount 和 --tmpfs, 同一个容器路径只能挂载一次
+func ParseMounts(volumeSpecs, mountSpecs, tmpfsSpecs []string) ([]Mount, error) {
+	var mounts []Mount
+	seen := map[string]bool{}
+	add := func(m *Mount, err error) error {
+		if err != nil {
+			return err
+		}
+		if seen[m.Destination] {
+			return fmt.Errorf("duplicate mount point: %s", m.Destination)
+		}
+		seen[m.Destination] = true
+		mounts = append(mounts, *m)
+		return nil
+	}
+	for _, spec := range volumeSpecs {
+		if err := add(ParseVolumeSpec(spec)); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range mountSpecs {
+		if err := add(ParseMountSpec(spec)); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range tmpfsSpecs {
+		if err := add(ParseTmpfsSpec(spec)); err != nil {
+			return nil, err
+		}
+	}
+	return mounts, nil
+}
+
+// 上级目录的挂载要先挂, 否则会盖住里面的挂载
+func sortMounts(mounts []Mount) {
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return strings.Count(mounts[i].Destination, "/") < strings.Count(mounts[j].Destination, "/")
+	})
+}
+
+// 在容器的根文件系统 rootfs 中挂载 mounts, 匿名卷的名字写回 mounts 中, 用到的卷记录容器 containerID 的引用.
+// containerID 为空时挂载的是已有容器的卷, 容器已经持有引用, 这里不再记录也不释放.
+// populate 为 true 时, 卷为空时先复制镜像中对应目录的内容. 出错时卸载已经挂载的
+func setupMounts(rootfs string, mounts []Mount, containerID string, populate bool) error {
+	sortMounts(mounts)
+	for i := range mounts {
+		if err := setupMount(rootfs, &mounts[i], containerID, populate); err != nil {
+			teardownMounts(rootfs, mounts[:i])
+			if containerID != "" {
+				releaseVolumes(mounts[:i+1], containerID)
+			}
+			return fmt.Errorf("mount %s error: %v", mounts[i].String(), err)
+		}
+	}
+	return nil
+}
+
+func setupMount(rootfs string, m *Mount, containerID string, populate bool) error {
+	// 容器中的符号链接按容器的根解析, 挂载点不会跑到宿主机上
+	target, err := utils.SecureJoin(rootfs, m.Destination)
+	if err != nil {
+		return err
+	}
+
+	if m.Type == MountTypeTmpfs {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		var data []string
+		if m.TmpfsSize > 0 {
+			data = append(data, fmt.Sprintf("size=%d", m.TmpfsSize))
+		}
+		if m.TmpfsMode != 0 {
+			data = append(data, fmt.Sprintf("mode=%o", m.TmpfsMode))
+		}
+		flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV)
+		if m.ReadOnly {
+			flags |= syscall.MS_RDONLY
+		}
+		return syscall.Mount("tmpfs", target, "tmpfs", flags, strings.Join(data, ","))
+	}
+
+	source := m.Source
+	if m.Type == MountTypeVolume {
+		store, err := volumes.NewStore(VolumeStoreUrl)
+		if err != nil {
+			return err
+		}
+		// 创建和记录引用在同一把锁内, 挂载前卷不会被并发的 prune 删除
+		var v *volumes.Volume
+		if containerID == "" {
+			v, err = store.Get(m.Source)
+		} else {
+			v, err = store.Use(m.Source, containerID)
+		}
+		if err != nil {
+			return err
+		}
+		m.Source = v.Name
+		source = v.Mountpoint
+		if populate && !m.NoCopy {
+			if err := populateVolume(v, target); err != nil {
+				return err
+			}
+		}
+	} else if _, err := os.Stat(source); os.IsNotExist(err) {
+		// 和 docker 一样, -v 的宿主机目录不存在时创建
+		if err := os.MkdirAll(source, 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := createMountTarget(source, target); err != nil {
+		return err
+	}
+	if m.Relabel != "" {
+		if err := relabel(source); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	// 只读要在绑定后重新挂载才生效
+	if m.ReadOnly {
+		if err := remountTreeReadOnly(target); err != nil {
+			_ = syscall.Unmount(target, syscall.MNT_DETACH)
+			return err
+		}
+	}
+	propagation := m.Propagation
+	if propagation == "" {
+		propagation = "rprivate"
+	}
+	if err := syscall.Mount("", target, "", propagationFlags[propagation], ""); err != nil {
+		_ = syscall.Unmount(target, syscall.MNT_DETACH)
+		return err
+	}
+	return nil
+}
+
+// 递归绑定会带上来源下的子挂载, 只重新挂载 target 时子挂载仍然可写, 要逐个重新挂载为只读
+func remountTreeReadOnly(target string) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	points, err := parseMountInfo(f, target)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		if err := syscall.Mount("", p.path, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|p.flags, ""); err != nil {
+			return fmt.Errorf("remount %s read only error: %v", p.path, err)
+		}
+	}
+	return nil
+}
+
+// 重新挂载时要保留的挂载选项
+var remountFlags = map[string]uintptr{
+	"nosuid":     syscall.MS_NOSUID,
+	"nodev":      syscall.MS_NODEV,
+	"noexec":     syscall.MS_NOEXEC,
+	"noatime":    syscall.MS_NOATIME,
+	"nodiratime": syscall.MS_NODIRATIME,
+	"relatime":   syscall.MS_RELATIME,
+}
+
+type mountPoint struct {
+	path  string
+	flags uintptr
+}
+
+// 从 mountinfo 中找出 root 和它下面的挂载点, 按挂载的先后顺序
+func parseMountInfo(r io.Reader, root string) ([]mountPoint, error) {
+	root = filepath.Clean(root)
+	var points []mountPoint
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), " ")
+		if len(fields) < 6 {
+			continue
+		}
+		p := unescapeMountPath(fields[4])
+		if p != root && !strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/") {
+			continue
+		}
+		point := mountPoint{path: p}
+		for _, opt := range strings.Split(fields[5], ",") {
+			point.flags |= remountFlags[opt]
+		}
+		points = append(points, point)
+	}
+	return points, scanner.Err()
+}
+
+// mountinfo 中路径的空格、制表符、换行和反斜杠写成 \ooo 的八进制转义
+func unescapeMountPath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' && i+3 < len(p) {
+			if c, err := strconv.ParseUint(p[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(p[i])
+	}
+	return b.String()
+}
+
+// 挂载点和来源的类型一致: 来源是文件时创建空文件, 否则创建目录
+func createMountTarget(source, target string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// 卷中还没有文件时, 把镜像中挂载点目录的内容复制到卷中
+func populateVolume(v *volumes.Volume, target string) error {
+	empty, err := v.IsEmpty()
+	if err != nil || !empty {
+		return err
+	}
+	if info, err := os.Stat(target); err != nil || !info.IsDir() {
+		return nil
+	}
+	r, w := io.Pipe()
+	go func() {
+		_ = w.CloseWithError(utils.Tar(target, w, nil))
+	}()
+	err = utils.Untar(r, v.Mountpoint)
+	_ = r.CloseWithError(err)
+	return err
+}
+
+// 开启 SELinux 时把来源标记为容器可以访问的类型, 没有开启时什么也不做
+func relabel(source string) error {
+	if _, err := os.Stat("/sys/fs/selinux/enforce"); err != nil {
+		return nil
+	}
+	if output, err := exec.Command("chcon", "-R", "-t", "container_file_t", source).CombinedOutput(); err != nil {
+		return fmt.Errorf("relabel %s error: %v, %s", source, err, output)
+	}
+	return nil
+}
+
+// 按挂载的逆序卸载, 挂载点已经不存在时忽略
+func teardownMounts(rootfs string, mounts []Mount) {
+	for i := len(mounts) - 1; i >= 0; i-- {
+		target, err := utils.SecureJoin(rootfs, mounts[i].Destination)
+		if err != nil {
+			continue
+		}
+		if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL && err != syscall.ENOENT {
+			log.ConsoleLog.Error("Unmount %s error %v", target, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		spec   string
+		volume bool
+		expect Mount
+	}{
+		{"/host:/data", true, Mount{Type: MountTypeBind, Source: "/host", Destination: "/data"}},
+		{"/host:/data/:ro,rshared,z", true, Mount{Type: MountTypeBind, Source: "/host", Destination: "/data", ReadOnly: true, Propagation: "rshared", Relabel: "z"}},
+		{"db:/var/lib/db:nocopy", true, Mount{Type: MountTypeVolume, Source: "db", Destination: "/var/lib/db", NoCopy: true}},
+		{"/cache", true, Mount{Type: MountTypeVolume, Destination: "/cache"}},
+		{"type=bind,src=" + dir + ",dst=/data,readonly,bind-propagation=slave", false,
+			Mount{Type: MountTypeBind, Source: dir, Destination: "/data", ReadOnly: true, Propagation: "slave"}},
+		{"source=db,target=/db,volume-nocopy=true", false, Mount{Type: MountTypeVolume, Source: "db", Destination: "/db", NoCopy: true}},
+		{"type=tmpfs,dst=/run,tmpfs-size=64m,tmpfs-mode=1777", false, Mount{Type: MountTypeTmpfs, Destination: "/run", TmpfsSize: 64 << 20, TmpfsMode: 01777}},
+	}
+	for _, c := range cases {
+		parse := ParseMountSpec
+		if c.volume {
+			parse = ParseVolumeSpec
+		}
+		m, err := parse(c.spec)
+		if err != nil || !reflect.DeepEqual(*m, c.expect) {
+			t.Errorf("parse %q = %+v %v", c.spec, m, err)
+		}
+	}
+
+	for _, spec := range []string{"./host:/data", "/host:data", "/host:/data:bad", "db:/data:rshared", "/host:/data:nocopy", "/host:/data:Z", "a:b:c:d", "/host:/"} {
+		if _, err := ParseVolumeSpec(spec); err == nil {
+			t.Errorf("volume spec %q should be invalid", spec)
+		}
+	}
+	for _, spec := range []string{"type=bind,src=/no/such/dir,dst=/data", "type=bind,dst=/data", "type=nfs,dst=/data",
+		"type=tmpfs,src=x,dst=/run", "dst=/data,bind-propagation=shared", "dst=/data,unknown=1", "dst=/data,readonly=maybe"} {
+		if _, err := ParseMountSpec(spec); err == nil {
+			t.Errorf("mount spec %q should be invalid", spec)
+		}
+	}
+	m, err := ParseTmpfsSpec("/run/:size=64m,mode=1777")
+	if err != nil || !reflect.DeepEqual(*m, Mount{Type: MountTypeTmpfs, Destination: "/run", TmpfsSize: 64 << 20, TmpfsMode: 01777}) {
+		t.Errorf("parse tmpfs = %+v %v", m, err)
+	}
+	for _, spec := range []string{"run", "/run:size", "/run:size=big", "/run:mode=999", "/run:noexec=1"} {
+		if _, err := ParseTmpfsSpec(spec); err == nil {
+			t.Errorf("tmpfs spec %q should be invalid", spec)
+		}
+	}
+	if _, err := ParseMounts([]string{"/a:/data"}, nil, []string{"/data:size=1m"}); err == nil {
+		t.Errorf("duplicate destination should be rejected")
+	}
+}
+
+func TestSetupMounts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mount needs root")
+	}
+	dir, err := ioutil.TempDir("", "bucket-mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rootfs := path.Join(dir, "rootfs")
+	host := path.Join(dir, "host")
+	_ = os.MkdirAll(path.Join(rootfs, "etc"), 0755)
+	_ = os.MkdirAll(host, 0755)
+	_ = ioutil.WriteFile(path.Join(host, "file"), []byte("host"), 0644)
+	_ = ioutil.WriteFile(path.Join(host, "hosts"), []byte("127.0.0.1"), 0644)
+	// 只读挂载的来源下还有一个子挂载
+	sub := path.Join(dir, "src", "sub")
+	_ = os.MkdirAll(sub, 0755)
+	if err := syscall.Mount("tmpfs", sub, "tmpfs", 0, ""); err != nil {
+		t.Skipf("mount not permitted here: %v", err)
+	}
+	defer syscall.Unmount(sub, syscall.MNT_DETACH)
+
+	mounts := []Mount{
+		{Type: MountTypeBind, Source: path.Join(host, "hosts"), Destination: "/etc/hosts", ReadOnly: true},
+		{Type: MountTypeBind, Source: host, Destination: "/data"},
+		{Type: MountTypeTmpfs, Destination: "/data/tmp"},
+		{Type: MountTypeBind, Source: path.Join(dir, "src"), Destination: "/src", ReadOnly: true},
+	}
+	if err := setupMounts(rootfs, mounts, "", false); err != nil {
+		t.Skipf("mount not permitted here: %v", err)
+	}
+	defer teardownMounts(rootfs, mounts)
+	if mounts[0].Destination != "/data" && mounts[0].Destination != "/etc/hosts" {
+		t.Errorf("parent mounts should be mounted first: %v", mounts)
+	}
+	if content, err := ioutil.ReadFile(path.Join(rootfs, "data/file")); err != nil || string(content) != "host" {
+		t.Errorf("bind mount not visible %q %v", content, err)
+	}
+	if err := ioutil.WriteFile(path.Join(rootfs, "etc/hosts"), []byte("x"), 0644); err == nil {
+		t.Errorf("read only mount should not be writable")
+	}
+	if err := ioutil.WriteFile(path.Join(rootfs, "src/sub/file"), []byte("x"), 0644); err == nil {
+		t.Errorf("submounts of a read only mount should not be writable")
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path.Join(rootfs, "data/tmp"), &fs); err != nil || fs.Type != 0x01021994 {
+		t.Errorf("tmpfs not mounted: %v", err)
+	}
+
+	teardownMounts(rootfs, mounts)
+	if _, err := os.Stat(path.Join(rootfs, "data/file")); !os.IsNotExist(err) {
+		t.Errorf("bind mount should be removed")
+	}
+}
+
+func TestParseMountInfo(t *testing.T) {
+	mountinfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 22 0:35 / /mnt/c/data rw,nosuid,nodev - ext4 /dev/sdb1 rw
+41 40 0:36 / /mnt/c/data/sub rw,noexec,relatime - tmpfs tmpfs rw
+42 40 0:37 / /mnt/c/data/with\040space rw - tmpfs tmpfs rw
+43 22 0:38 / /mnt/c/database rw - tmpfs tmpfs rw
+`
+	points, err := parseMountInfo(strings.NewReader(mountinfo), "/mnt/c/data/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []mountPoint{
+		{"/mnt/c/data", syscall.MS_NOSUID | syscall.MS_NODEV},
+		{"/mnt/c/data/sub", syscall.MS_NOEXEC | syscall.MS_RELATIME},
+		{"/mnt/c/data/with space", 0},
+	}
+	if !reflect.DeepEqual(points, expect) {
+		t.Errorf("parse mountinfo = %+v, expect %+v", points, expect)
+	}
+}
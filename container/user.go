@@ -0,0 +1,153 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 容器内 /etc/passwd 和 /etc/group 中的一行
+type passwdEntry struct {
+	name string
+	uid  int
+	gid  int
+}
+
+type groupEntry struct {
+	name    string
+	gid     int
+	members []string
+}
+
+// 切换到容器内的用户, spec 为 user[:group]
+func setUser(spec string) error {
+	uid, gid, groups, err := lookupUser(spec, "/etc/passwd", "/etc/group")
+	if err != nil {
+		return err
+	}
+	if err := unix.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups error: %v", err)
+	}
+	if err := unix.Setresgid(gid, gid, gid); err != nil {
+		return fmt.Errorf("setgid %d error: %v", gid, err)
+	}
+	if err := unix.Setresuid(uid, uid, uid); err != nil {
+		return fmt.Errorf("setuid %d error: %v", uid, err)
+	}
+	return nil
+}
+
+// 名字需要在 passwd 和 group 文件中查找, 纯数字的 uid 找不到时 gid 默认和 uid 相同
+func lookupUser(spec, passwdPath, groupPath string) (int, int, []int, error) {
+	userSpec, groupSpec := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		userSpec, groupSpec = spec[:i], spec[i+1:]
+	}
+	users, _ := parsePasswd(passwdPath)
+	groups, _ := parseGroup(groupPath)
+
+	var user *passwdEntry
+	for i := range users {
+		if users[i].name == userSpec || strconv.Itoa(users[i].uid) == userSpec {
+			user = &users[i]
+			break
+		}
+	}
+	if user == nil {
+		uid, err := strconv.Atoi(userSpec)
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("no such user %s in container", userSpec)
+		}
+		user = &passwdEntry{uid: uid, gid: uid}
+	}
+
+	gid := user.gid
+	if groupSpec != "" {
+		found := false
+		for _, g := range groups {
+			if g.name == groupSpec || strconv.Itoa(g.gid) == groupSpec {
+				gid, found = g.gid, true
+				break
+			}
+		}
+		if !found {
+			n, err := strconv.Atoi(groupSpec)
+			if err != nil {
+				return 0, 0, nil, fmt.Errorf("no such group %s in container", groupSpec)
+			}
+			gid = n
+		}
+	}
+
+	// 附加组只在没有指定组时使用
+	supplementary := []int{gid}
+	if groupSpec == "" && user.name != "" {
+		for _, g := range groups {
+			if g.gid == gid {
+				continue
+			}
+			for _, member := range g.members {
+				if member == user.name {
+					supplementary = append(supplementary, g.gid)
+					break
+				}
+			}
+		}
+	}
+	return user.uid, gid, supplementary, nil
+}
+
+func parsePasswd(passwdPath string) ([]passwdEntry, error) {
+	var entries []passwdEntry
+	err := scanColonFile(passwdPath, func(fields []string) {
+		if len(fields) < 4 {
+			return
+		}
+		uid, err1 := strconv.Atoi(fields[2])
+		gid, err2 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil {
+			return
+		}
+		entries = append(entries, passwdEntry{name: fields[0], uid: uid, gid: gid})
+	})
+	return entries, err
+}
+
+func parseGroup(groupPath string) ([]groupEntry, error) {
+	var entries []groupEntry
+	err := scanColonFile(groupPath, func(fields []string) {
+		if len(fields) < 3 {
+			return
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return
+		}
+		entry := groupEntry{name: fields[0], gid: gid}
+		if len(fields) > 3 && fields[3] != "" {
+			entry.members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, entry)
+	})
+	return entries, err
+}
+
+func scanColonFile(filePath string, fn func(fields []string)) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	return scanner.Err()
+}
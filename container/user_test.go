@@ -0,0 +1,45 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestLookupUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwd := path.Join(dir, "passwd")
+	group := path.Join(dir, "group")
+	_ = ioutil.WriteFile(passwd, []byte("root:x:0:0:root:/root:/bin/sh\nnginx:x:101:101:nginx:/var/cache/nginx:/sbin/nologin\n"), 0644)
+	_ = ioutil.WriteFile(group, []byte("root:x:0:\nnginx:x:101:\nwww:x:33:nginx\n"), 0644)
+
+	cases := []struct {
+		spec   string
+		uid    int
+		gid    int
+		groups []int
+	}{
+		{"nginx", 101, 101, []int{101, 33}},
+		{"101", 101, 101, []int{101, 33}},
+		{"nginx:www", 101, 33, []int{33}},
+		{"1000", 1000, 1000, []int{1000}},
+		{"1000:0", 1000, 0, []int{0}},
+	}
+	for _, c := range cases {
+		uid, gid, groups, err := lookupUser(c.spec, passwd, group)
+		if err != nil || uid != c.uid || gid != c.gid || !reflect.DeepEqual(groups, c.groups) {
+			t.Errorf("lookupUser(%q) = %d %d %v %v", c.spec, uid, gid, groups, err)
+		}
+	}
+	for _, spec := range []string{"nobody", "nginx:staff"} {
+		if _, _, _, err := lookupUser(spec, passwd, group); err == nil {
+			t.Errorf("lookupUser(%q) should fail", spec)
+		}
+	}
+}
@@ -1,91 +1,122 @@
 package container
 
 import (
+	"bucket/image"
 	"bucket/log"
 	"bucket/utils"
+	"bucket/volumes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
+	"syscall"
 )
 
 //Create a AUFS filesystem as container root workspace
-func NewWorkSpace(volume, imageName, containerName string) {
-	CreateReadOnlyLayer(imageName)
+func NewWorkSpace(mounts []Mount, imageName, containerID, containerName string) error {
+	layerDirs, err := CreateReadOnlyLayer(imageName)
+	if err != nil {
+		return err
+	}
 	CreateWriteLayer(containerName)
-	CreateMountPoint(containerName, imageName)
-	if volume != "" {
-		volumeURLs := strings.Split(volume, ":")
-		length := len(volumeURLs)
-		if length == 2 && volumeURLs[0] != "" && volumeURLs[1] != "" {
-			MountVolume(volumeURLs, containerName)
-			log.ConsoleLog.Info("NewWorkSpace volume urls %q", volumeURLs)
-		} else {
-			log.ConsoleLog.Info("Volume parameter input is not correct.")
-		}
+	if err := CreateMountPoint(containerName, layerDirs); err != nil {
+		return err
+	}
+	// -v 和 --mount 指定的挂载, 第一次使用的卷先复制镜像中的内容
+	if err := setupMounts(fmt.Sprintf(MntUrl, containerName), mounts, containerID, true); err != nil {
+		DeleteMountPoint(containerName)
+		return err
 	}
+	return nil
+}
+
+// 容器的全部挂载. 旧版本的容器只在 Volume 中记录了一个 host:container 形式的挂载
+func (info *ContainerInfo) AllMounts() []Mount {
+	if len(info.Mounts) > 0 || info.Volume == "" {
+		return info.Mounts
+	}
+	volumeURLs := strings.Split(info.Volume, ":")
+	if len(volumeURLs) != 2 || volumeURLs[0] == "" || volumeURLs[1] == "" {
+		return nil
+	}
+	return []Mount{{Type: MountTypeBind, Source: volumeURLs[0], Destination: volumeURLs[1]}}
+}
+
+// 删除容器时释放对命名卷的引用, 卷中的数据保留
+func ReleaseVolumes(info *ContainerInfo) {
+	releaseVolumes(info.Mounts, info.Id)
 }
 
-//Decompression tar image
-func CreateReadOnlyLayer(imageName string) error {
-	unTarFolderUrl := RootUrl + "/" + imageName + "/"
-	imageUrl := ImageUrl + "/" + imageName + ".tar"
-	exist, err := utils.PathExists(unTarFolderUrl)
+func releaseVolumes(mounts []Mount, containerID string) {
+	store, err := volumes.NewStore(VolumeStoreUrl)
 	if err != nil {
-		log.ConsoleLog.Info("Fail to judge whether dir %s exists. %v", unTarFolderUrl, err)
-		return err
+		log.ConsoleLog.Error("Open volume store error %v", err)
+		return
 	}
-	if !exist {
-		if err := os.MkdirAll(unTarFolderUrl, 0622); err != nil {
-			log.ConsoleLog.Error("Mkdir %s error %v", unTarFolderUrl, err)
-			return err
+	for _, m := range mounts {
+		if m.Type != MountTypeVolume || m.Source == "" {
+			continue
 		}
-
-		if _, err := exec.Command("tar", "-xvf", imageUrl, "-C", unTarFolderUrl).CombinedOutput(); err != nil {
-			log.ConsoleLog.Error("Untar dir %s error %v", unTarFolderUrl, err)
-			return err
+		if err := store.Release(m.Source, containerID); err != nil && !volumes.IsNotFound(err) {
+			log.ConsoleLog.Error("Release volume %s error %v", m.Source, err)
 		}
 	}
-	return nil
 }
 
-func CreateWriteLayer(containerName string) {
-	writeURL := fmt.Sprintf(WriteLayerUrl, containerName)
-	if err := os.MkdirAll(writeURL, 0777); err != nil {
-		log.ConsoleLog.Error("Mkdir write layer dir %s error. %v", writeURL, err)
+//Find image in store, return the read only layer dirs, top layer first
+func CreateReadOnlyLayer(imageName string) ([]string, error) {
+	store, img, err := GetImage(imageName)
+	if err != nil {
+		return nil, err
 	}
+	return store.LayerDirs(img)
 }
 
-func MountVolume(volumeURLs []string, containerName string) error {
-	parentUrl := volumeURLs[0]
-	if err := os.Mkdir(parentUrl, 0777); err != nil {
-		log.ConsoleLog.Info("Mkdir parent dir %s error. %v", parentUrl, err)
+// 在镜像存储中查找镜像, 找不到时把旧版本放在 ImageUrl 下的 <name>.tar 导入到存储中
+func GetImage(imageName string) (*image.Store, *image.Image, error) {
+	store, err := image.NewStore(ImageStoreUrl)
+	if err != nil {
+		return nil, nil, err
 	}
-	containerUrl := volumeURLs[1]
-	mntURL := fmt.Sprintf(MntUrl, containerName)
-	containerVolumeURL := mntURL + "/" + containerUrl
-	if err := os.Mkdir(containerVolumeURL, 0777); err != nil {
-		log.ConsoleLog.Info("Mkdir container dir %s error. %v", containerVolumeURL, err)
+	img, err := store.Lookup(imageName)
+	if err == nil || !image.IsNotFound(err) {
+		return store, img, err
 	}
-	dirs := "dirs=" + parentUrl
-	_, err := exec.Command("mount", "-t", "aufs", "-o", dirs, "none", containerVolumeURL).CombinedOutput()
-	if err != nil {
-		log.ConsoleLog.Error("Mount volume failed. %v", err)
-		return err
+
+	img, importErr := store.ImportLegacy(imageName, ImageUrl)
+	if importErr != nil {
+		if image.IsNotFound(importErr) {
+			return nil, nil, err
+		}
+		log.ConsoleLog.Error("Import legacy image %s error %v", imageName, importErr)
+		return nil, nil, importErr
+	}
+	log.ConsoleLog.Info("Imported legacy image %s", imageName)
+	return store, img, nil
+}
+
+func CreateWriteLayer(containerName string) {
+	writeURL := fmt.Sprintf(WriteLayerUrl, containerName)
+	if err := os.MkdirAll(writeURL, 0777); err != nil {
+		log.ConsoleLog.Error("Mkdir write layer dir %s error. %v", writeURL, err)
 	}
-	return nil
 }
 
-func CreateMountPoint(containerName, imageName string) error {
+func CreateMountPoint(containerName string, layerDirs []string) error {
 	mntUrl := fmt.Sprintf(MntUrl, containerName)
 	if err := os.MkdirAll(mntUrl, 0777); err != nil {
 		log.ConsoleLog.Error("Mkdir mountpoint dir %s error. %v", mntUrl, err)
 		return err
 	}
 	tmpWriteLayer := fmt.Sprintf(WriteLayerUrl, containerName)
-	tmpImageLocation := RootUrl + "/" + imageName
 	mntURL := fmt.Sprintf(MntUrl, containerName)
-	dirs := "dirs=" + tmpWriteLayer + ":" + tmpImageLocation
+	// 镜像层中的 .wh. 文件是下层文件的 whiteout, 需要以 ro+wh 挂载才会生效
+	dirs := "dirs=" + tmpWriteLayer
+	for _, layerDir := range layerDirs {
+		dirs += ":" + layerDir + "=ro+wh"
+	}
 	_, err := exec.Command("mount", "-t", "aufs", "-o", dirs, "none", mntURL).CombinedOutput()
 	if err != nil {
 		log.ConsoleLog.Error("Run command for creating mount point failed %v", err)
@@ -95,18 +126,9 @@ func CreateMountPoint(containerName, imageName string) error {
 }
 
 //Delete the AUFS filesystem while container exit
-func DeleteWorkSpace(volume, containerName string) {
-	if volume != "" {
-		volumeURLs := strings.Split(volume, ":")
-		length := len(volumeURLs)
-		if length == 2 && volumeURLs[0] != "" && volumeURLs[1] != "" {
-			DeleteMountPointWithVolume(volumeURLs, containerName)
-		} else {
-			DeleteMountPoint(containerName)
-		}
-	} else {
-		DeleteMountPoint(containerName)
-	}
+func DeleteWorkSpace(mounts []Mount, containerName string) {
+	teardownMounts(fmt.Sprintf(MntUrl, containerName), mounts)
+	DeleteMountPoint(containerName)
 	DeleteWriteLayer(containerName)
 }
 
@@ -124,24 +146,86 @@ func DeleteMountPoint(containerName string) error {
 	return nil
 }
 
-func DeleteMountPointWithVolume(volumeURLs []string, containerName string) error {
-	mntURL := fmt.Sprintf(MntUrl, containerName)
-	containerUrl := mntURL + "/" + volumeURLs[1]
-	if _, err := exec.Command("umount", containerUrl).CombinedOutput(); err != nil {
-		log.ConsoleLog.Error("Umount volume %s failed. %v", containerUrl, err)
+// aufs 在可写层中使用的内部文件, 不属于容器的修改
+var aufsMetaFiles = []string{".wh..wh.aufs", ".wh..wh.plnk", ".wh..wh.orph"}
+
+// 把容器可写层打包成一个新的镜像层, 删除的文件保留为 .wh. whiteout
+func WriteLayerDiff(containerName, tarPath string) error {
+	writeURL := fmt.Sprintf(WriteLayerUrl, containerName)
+	f, err := os.Create(tarPath)
+	if err != nil {
 		return err
 	}
+	if err := utils.Tar(writeURL, f, &utils.TarOptions{Excludes: aufsMetaFiles}); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("tar write layer %s error: %v", writeURL, err)
+	}
+	return f.Close()
+}
 
-	if _, err := exec.Command("umount", mntURL).CombinedOutput(); err != nil {
-		log.ConsoleLog.Error("Umount mountpoint %s failed. %v", mntURL, err)
+// 把容器合并后的根文件系统打包写到 w, 不包括挂载在其中的数据卷
+func ExportRootfs(info *ContainerInfo, w io.Writer) error {
+	mntURL, unmount, err := MountRootfs(info)
+	if err != nil {
 		return err
 	}
+	defer unmount()
+	return utils.Tar(mntURL, w, &utils.TarOptions{OneFileSystem: true})
+}
 
-	if err := os.RemoveAll(mntURL); err != nil {
-		log.ConsoleLog.Error("Remove mountpoint dir %s error %v", mntURL, err)
+// 返回容器的根文件系统所在目录. 已经停止的容器的挂载点可能已经被卸载,
+// 这时用镜像的层、可写层和容器的挂载临时挂载一次, 用完后调用返回的函数卸载.
+// tmpfs 的内容在容器停止后已经不存在, 不重新挂载
+func MountRootfs(info *ContainerInfo) (string, func(), error) {
+	mntURL := fmt.Sprintf(MntUrl, info.Name)
+	if isMountPoint(mntURL) {
+		return mntURL, func() {}, nil
+	}
+	writeURL := fmt.Sprintf(WriteLayerUrl, info.Name)
+	if exists, _ := utils.PathExists(writeURL); !exists {
+		return "", nil, fmt.Errorf("write layer of container %s does not exist", info.Name)
+	}
+	store, err := image.NewStore(ImageStoreUrl)
+	if err != nil {
+		return "", nil, err
+	}
+	img, err := store.Get(info.Image)
+	if err != nil {
+		return "", nil, err
+	}
+	layerDirs, err := store.LayerDirs(img)
+	if err != nil {
+		return "", nil, err
 	}
+	if err := CreateMountPoint(info.Name, layerDirs); err != nil {
+		return "", nil, err
+	}
+	var mounts []Mount
+	for _, m := range info.AllMounts() {
+		if m.Type != MountTypeTmpfs {
+			mounts = append(mounts, m)
+		}
+	}
+	if err := setupMounts(mntURL, mounts, "", false); err != nil {
+		DeleteMountPoint(info.Name)
+		return "", nil, err
+	}
+	return mntURL, func() {
+		teardownMounts(mntURL, mounts)
+		DeleteMountPoint(info.Name)
+	}, nil
+}
 
-	return nil
+// 目录和上级目录不在同一个设备上说明它是挂载点
+func isMountPoint(dir string) bool {
+	var stat, parentStat syscall.Stat_t
+	if err := syscall.Lstat(dir, &stat); err != nil {
+		return false
+	}
+	if err := syscall.Lstat(path.Dir(dir), &parentStat); err != nil {
+		return false
+	}
+	return stat.Dev != parentStat.Dev
 }
 
 func DeleteWriteLayer(containerName string) {
@@ -3,8 +3,10 @@ module bucket
 go 1.15
 
 require (
+	github.com/google/nftables v0.0.0-20220808154552-2eca00135732
 	github.com/kainhuck/fancylog v0.0.0-20200715075337-6671bba5d412
 	github.com/spf13/cobra v1.1.1
 	github.com/vishvananda/netlink v1.1.0
 	github.com/vishvananda/netns v0.0.0-20200728191858-db3c7e526aae
+	golang.org/x/sys v0.0.0-20211205182925-97ca703d548d
 )
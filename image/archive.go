@@ -0,0 +1,527 @@
+package image
+
+import (
+	"archive/tar"
+	"bucket/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	MediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar"
+
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// index.json 中镜像名的 annotation, 前者是完整的 name:tag, 后者按规范只是 tag
+	annotationImageName = "io.containerd.image.name"
+	annotationRefName   = "org.opencontainers.image.ref.name"
+
+	ociLayoutFile    = "oci-layout"
+	ociIndexFile     = "index.json"
+	dockerManifest   = "manifest.json"
+	ociLayoutVersion = `{"imageLayoutVersion":"1.0.0"}`
+)
+
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// OCI image manifest, 也兼容 docker v2 schema 2 manifest
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// OCI image index, 也兼容 docker manifest list
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// docker save 生成的 manifest.json 中的一项
+type dockerManifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// 导入 OCI image layout 或者 docker save 生成的 tar 包, 返回导入的镜像
+func (s *Store) Load(r io.Reader) ([]*Image, error) {
+	dir, err := ioutil.TempDir("", "bucket-load-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	if err := untarArchive(r, dir); err != nil {
+		return nil, err
+	}
+
+	if archiveFileExists(dir, dockerManifest) {
+		return s.loadDockerArchive(dir)
+	}
+	if archiveFileExists(dir, ociIndexFile) {
+		return s.loadOCILayout(dir)
+	}
+	return nil, fmt.Errorf("neither %s nor %s found, not an image archive", dockerManifest, ociIndexFile)
+}
+
+func (s *Store) loadDockerArchive(dir string) ([]*Image, error) {
+	var entries []dockerManifestEntry
+	if err := readJSONFile(dir, dockerManifest, &entries); err != nil {
+		return nil, err
+	}
+	var images []*Image
+	for _, entry := range entries {
+		configJSON, err := readArchiveFile(dir, entry.Config)
+		if err != nil {
+			return images, err
+		}
+		img, err := s.loadImage(dir, configJSON, entry.Layers, entry.RepoTags)
+		if err != nil {
+			return images, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+func (s *Store) loadOCILayout(dir string) ([]*Image, error) {
+	index := &Index{}
+	if err := readJSONFile(dir, ociIndexFile, index); err != nil {
+		return nil, err
+	}
+	var images []*Image
+	for _, desc := range index.Manifests {
+		var tags []string
+		if name := desc.Annotations[annotationImageName]; name != "" {
+			tags = append(tags, name)
+		} else if name := desc.Annotations[annotationRefName]; strings.Contains(name, ":") {
+			tags = append(tags, name)
+		}
+
+		manifest, err := resolveManifest(dir, desc)
+		if err != nil {
+			return images, err
+		}
+		if err := checkDigest(manifest.Config.Digest); err != nil {
+			return images, err
+		}
+		configJSON, err := readArchiveFile(dir, blobPath(manifest.Config.Digest))
+		if err != nil {
+			return images, err
+		}
+		layerPaths := make([]string, 0, len(manifest.Layers))
+		for _, layer := range manifest.Layers {
+			if err := checkDigest(layer.Digest); err != nil {
+				return images, err
+			}
+			layerPaths = append(layerPaths, blobPath(layer.Digest))
+		}
+		img, err := s.loadImage(dir, configJSON, layerPaths, tags)
+		if err != nil {
+			return images, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// desc 指向 index 时选择当前平台的 manifest
+func resolveManifest(dir string, desc Descriptor) (*Manifest, error) {
+	if err := checkDigest(desc.Digest); err != nil {
+		return nil, err
+	}
+	content, err := readArchiveFile(dir, blobPath(desc.Digest))
+	if err != nil {
+		return nil, err
+	}
+	if !isIndex(desc.MediaType) {
+		manifest := &Manifest{}
+		if err := json.Unmarshal(content, manifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest %s: %v", desc.Digest, err)
+		}
+		return manifest, nil
+	}
+
+	index := &Index{}
+	if err := json.Unmarshal(content, index); err != nil {
+		return nil, fmt.Errorf("invalid index %s: %v", desc.Digest, err)
+	}
+	m, err := selectPlatform(index)
+	if err != nil {
+		return nil, fmt.Errorf("index %s: %v", desc.Digest, err)
+	}
+	return resolveManifest(dir, m)
+}
+
+// 多架构镜像中选择当前平台的 manifest
+func selectPlatform(index *Index) (Descriptor, error) {
+	platform := NewImageConfig()
+	for _, m := range index.Manifests {
+		if m.Platform == nil || (m.Platform.OS == platform.OS && m.Platform.Architecture == platform.Architecture) {
+			return m, nil
+		}
+	}
+	return Descriptor{}, fmt.Errorf("no manifest for %s/%s", platform.OS, platform.Architecture)
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == MediaTypeIndex || mediaType == mediaTypeDockerManifestList
+}
+
+// 注册各层并校验和配置中的 diff_ids 一致, 然后用配置原文创建镜像
+func (s *Store) loadImage(dir string, configJSON []byte, layerPaths []string, tags []string) (*Image, error) {
+	config := NewImageConfig()
+	if err := json.Unmarshal(configJSON, config); err != nil {
+		return nil, fmt.Errorf("invalid image config: %v", err)
+	}
+	if len(layerPaths) != len(config.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("image has %d layers but config has %d diff_ids", len(layerPaths), len(config.RootFS.DiffIDs))
+	}
+	for i, layerPath := range layerPaths {
+		layer, err := s.loadLayer(dir, layerPath)
+		if err != nil {
+			return nil, err
+		}
+		if layer.DiffID != config.RootFS.DiffIDs[i] {
+			return nil, fmt.Errorf("layer %s has diff id %s, expect %s", layerPath, layer.DiffID, config.RootFS.DiffIDs[i])
+		}
+	}
+
+	img, err := s.ImportConfig(configJSON, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		if err := s.addTag(img, tag); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+func (s *Store) loadLayer(dir, layerPath string) (*Layer, error) {
+	f, err := openArchiveFile(dir, layerPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	layer, err := s.registerLayerStream(f)
+	if err != nil {
+		return nil, fmt.Errorf("layer %s: %v", layerPath, err)
+	}
+	return layer, nil
+}
+
+// 层可能是 gzip 或 zstd 压缩的, 解压到临时文件后再注册
+func (s *Store) registerLayerStream(r io.Reader) (*Layer, error) {
+	reader, err := utils.DecompressStream(r)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	tmpFile, err := ioutil.TempFile("", "bucket-layer-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name())
+	}()
+	if _, err := io.Copy(tmpFile, reader); err != nil {
+		_ = tmpFile.Close()
+		return nil, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return nil, err
+	}
+	if err := reader.Close(); err != nil {
+		return nil, err
+	}
+	return s.RegisterLayer(tmpFile.Name())
+}
+
+// 把镜像写成 OCI image layout, 同时写入 docker load 可以识别的 manifest.json
+func (s *Store) Save(w io.Writer, refs []string) error {
+	tw := tar.NewWriter(w)
+	written := map[string]bool{}
+	index := &Index{SchemaVersion: 2, MediaType: MediaTypeIndex, Manifests: []Descriptor{}}
+	var dockerEntries []dockerManifestEntry
+
+	if err := writeTarFile(tw, ociLayoutFile, []byte(ociLayoutVersion)); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		img, err := s.Lookup(ref)
+		if err != nil {
+			return err
+		}
+		manifest, configJSON, err := s.imageManifest(img)
+		if err != nil {
+			return err
+		}
+		entry := dockerManifestEntry{Config: blobPath(img.ID), RepoTags: []string{}}
+		if err := writeBlob(tw, written, img.ID, configJSON); err != nil {
+			return err
+		}
+		for _, layer := range manifest.Layers {
+			if err := writeLayerBlob(tw, written, layer.Digest, s.LayerTarPath(layer.Digest)); err != nil {
+				return err
+			}
+			entry.Layers = append(entry.Layers, blobPath(layer.Digest))
+		}
+
+		manifestJSON, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		manifestDigest := digestOf(manifestJSON)
+		if err := writeBlob(tw, written, manifestDigest, manifestJSON); err != nil {
+			return err
+		}
+
+		// 按镜像名保存时只写这个名字, 按ID保存时写镜像的全部 tag
+		tags := img.Tags
+		if normalized, err := NormalizeReference(ref); err == nil && img.hasTag(normalized) {
+			tags = []string{normalized}
+		}
+		desc := Descriptor{MediaType: MediaTypeManifest, Digest: manifestDigest, Size: int64(len(manifestJSON))}
+		if len(tags) == 0 {
+			index.Manifests = append(index.Manifests, desc)
+		}
+		for _, tag := range tags {
+			_, t := SplitReference(tag)
+			tagged := desc
+			tagged.Annotations = map[string]string{annotationImageName: tag, annotationRefName: t}
+			index.Manifests = append(index.Manifests, tagged)
+			entry.RepoTags = append(entry.RepoTags, tag)
+		}
+		dockerEntries = append(dockerEntries, entry)
+	}
+
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, ociIndexFile, indexJSON); err != nil {
+		return err
+	}
+	dockerJSON, err := json.Marshal(dockerEntries)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, dockerManifest, dockerJSON); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// 镜像的 OCI manifest 和配置原文, 层以未压缩的 tar 包保存, digest 就是 diff id
+func (s *Store) imageManifest(img *Image) (*Manifest, []byte, error) {
+	configJSON, err := s.ConfigJSON(img)
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := s.Config(img)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        Descriptor{MediaType: MediaTypeConfig, Digest: img.ID, Size: int64(len(configJSON))},
+		Layers:        []Descriptor{},
+	}
+	for _, diffID := range config.RootFS.DiffIDs {
+		info, err := os.Stat(s.LayerTarPath(diffID))
+		if err != nil {
+			return nil, nil, err
+		}
+		manifest.Layers = append(manifest.Layers, Descriptor{MediaType: MediaTypeLayer, Digest: diffID, Size: info.Size()})
+	}
+	return manifest, configJSON, nil
+}
+
+func blobPath(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return idPrefix + hex.EncodeToString(sum[:])
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+// 多个镜像共享的 blob 只写一次
+func writeBlob(tw *tar.Writer, written map[string]bool, digest string, content []byte) error {
+	if written[digest] {
+		return nil
+	}
+	written[digest] = true
+	return writeTarFile(tw, blobPath(digest), content)
+}
+
+func writeLayerBlob(tw *tar.Writer, written map[string]bool, diffID, layerTar string) error {
+	if written[diffID] {
+		return nil
+	}
+	written[diffID] = true
+	f, err := os.Open(layerTar)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: blobPath(diffID), Mode: 0644, Size: info.Size(), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// 解开外层的 tar 包, 只接受普通文件、目录和符号链接. 包内的路径都在 dir 中解析已经解开的符号链接,
+// 之后读取包内文件也是这样, 所以链接无论指向哪里都不会读写 dir 之外的文件
+func untarArchive(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read archive error: %v", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			target, err := archivePath(dir, hdr.Name)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			target, err := archivePath(dir, hdr.Name)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				_ = f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			// 只解析父目录, 链接自身不能被跟随
+			parent, err := archivePath(dir, filepath.Dir(hdr.Name))
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(parent, 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, filepath.Join(parent, filepath.Base(hdr.Name))); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// 包内路径对应的本地路径, 路径中的符号链接以 dir 为根解析, 不会跳出 dir
+func archivePath(dir, name string) (string, error) {
+	if strings.HasPrefix(name, "/") || strings.Contains("/"+name+"/", "/../") {
+		return "", fmt.Errorf("invalid path %s in archive", name)
+	}
+	return utils.SecureJoin(dir, name)
+}
+
+func archiveFileExists(dir, name string) bool {
+	p, err := archivePath(dir, name)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(p)
+	return err == nil
+}
+
+func openArchiveFile(dir, name string) (*os.File, error) {
+	p, err := archivePath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("%s not found in archive", name)
+	}
+	return f, nil
+}
+
+func readArchiveFile(dir, name string) ([]byte, error) {
+	f, err := openArchiveFile(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return ioutil.ReadAll(f)
+}
+
+func readJSONFile(dir, name string, v interface{}) error {
+	content, err := readArchiveFile(dir, name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, err := NewStore(path.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := src.ImportTar(makeTar(t, dir, "base", "base"), "base", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := src.RegisterLayer(makeTar(t, dir, "app", "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _ := src.Config(base)
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.DiffID)
+	config.Config.Cmd = []string{"/app"}
+	app, err := src.CreateImage(config, "app:v1", base.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Save(&buf, []string{"base", "app:v1"}); err != nil {
+		t.Fatalf("save error: %v", err)
+	}
+
+	dst, err := NewStore(path.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := dst.Load(bytes.NewReader(buf.Bytes()))
+	if err != nil || len(images) != 2 {
+		t.Fatalf("load error: %v %v", images, err)
+	}
+	loaded, err := dst.Lookup("app:v1")
+	if err != nil || loaded.ID != app.ID {
+		t.Fatalf("unexpected loaded image %+v %v", loaded, err)
+	}
+	loadedConfig, err := dst.Config(loaded)
+	if err != nil || len(loadedConfig.Config.Cmd) != 1 || loadedConfig.Config.Cmd[0] != "/app" {
+		t.Errorf("unexpected loaded config %+v %v", loadedConfig, err)
+	}
+	dirs, err := dst.LayerDirs(loaded)
+	if err != nil || len(dirs) != 2 {
+		t.Fatalf("unexpected layer dirs %v %v", dirs, err)
+	}
+	content, err := ioutil.ReadFile(path.Join(dirs[0], "content"))
+	if err != nil || string(content) != "app" {
+		t.Errorf("unexpected top layer content %q %v", content, err)
+	}
+	if _, err := dst.Lookup("base:latest"); err != nil {
+		t.Errorf("base image not loaded: %v", err)
+	}
+}
+
+// docker save 格式, 层用 gzip 压缩
+func TestLoadDockerArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewStore(path.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layerTar, err := ioutil.ReadFile(makeTar(t, dir, "layer", "hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write(layerTar)
+	_ = zw.Close()
+
+	config := NewImageConfig()
+	config.RootFS.DiffIDs = []string{digestOf(layerTar)}
+	configJSON, _ := json.Marshal(config)
+	manifest, _ := json.Marshal([]dockerManifestEntry{{
+		Config:   "config.json",
+		RepoTags: []string{"hello:1.0"},
+		Layers:   []string{"abc/layer.tar"},
+	}})
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range map[string][]byte{
+		"manifest.json": manifest,
+		"config.json":   configJSON,
+		"abc/layer.tar": gz.Bytes(),
+	} {
+		if err := writeTarFile(tw, name, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = tw.Close()
+
+	images, err := store.Load(&buf)
+	if err != nil || len(images) != 1 {
+		t.Fatalf("load error: %v %v", images, err)
+	}
+	if images[0].ID != digestOf(configJSON) || !images[0].hasTag("hello:1.0") {
+		t.Errorf("unexpected image %+v", images[0])
+	}
+
+	// 跳出目录的路径要拒绝
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	_ = writeTarFile(tw, "../evil", []byte("x"))
+	_ = tw.Close()
+	if _, err := store.Load(&buf); err == nil {
+		t.Errorf("archive with ../ path should be rejected")
+	}
+}
+
+func TestUntarArchiveSymlinkEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := path.Join(dir, "root")
+	_ = os.Mkdir(root, 0755)
+
+	// s1 经过 s2 解析到 root 的父目录, 写入的文件要留在 root 中
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	_ = tw.WriteHeader(&tar.Header{Name: "s2", Linkname: ".", Typeflag: tar.TypeSymlink})
+	_ = tw.WriteHeader(&tar.Header{Name: "s1", Linkname: "s2/..", Typeflag: tar.TypeSymlink})
+	_ = tw.WriteHeader(&tar.Header{Name: "abs", Linkname: dir, Typeflag: tar.TypeSymlink})
+	_ = writeTarFile(tw, "s1/escaped", []byte("x"))
+	_ = writeTarFile(tw, "abs/escaped2", []byte("x"))
+	_ = tw.Close()
+	if err := untarArchive(&buf, root); err != nil {
+		t.Fatalf("untar error: %v", err)
+	}
+	for _, name := range []string{"escaped", "escaped2"} {
+		if _, err := os.Stat(path.Join(dir, name)); err == nil {
+			t.Errorf("%s written outside of the extraction dir", name)
+		}
+	}
+	// 绝对路径的链接以 root 为根解析
+	for _, name := range []string{"escaped", "abs/escaped2", path.Join(dir, "escaped2")} {
+		if content, err := readArchiveFile(root, strings.TrimPrefix(name, "/")); err != nil || string(content) != "x" {
+			t.Errorf("%s should be written inside the extraction dir: %q %v", name, content, err)
+		}
+	}
+	if _, err := readArchiveFile(root, "s1/root/escaped"); err == nil {
+		t.Errorf("reading through a link should not leave the extraction dir")
+	}
+}
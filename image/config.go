@@ -0,0 +1,225 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OCI image config, 保存在镜像目录下的 config.json 中,
+// 见 https://github.com/opencontainers/image-spec/blob/main/config.md
+type ImageConfig struct {
+	Created      *time.Time      `json:"created,omitempty"`
+	Author       string          `json:"author,omitempty"`
+	Container    string          `json:"container,omitempty"` // 由容器提交时, 容器的ID
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       RootFS          `json:"rootfs"`
+	History      []History       `json:"history,omitempty"`
+}
+
+// 运行容器时使用的默认参数
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+}
+
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type History struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	Author     string     `json:"author,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
+
+func NewImageConfig() *ImageConfig {
+	return &ImageConfig{
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		RootFS:       RootFS{Type: "layers", DiffIDs: []string{}},
+	}
+}
+
+// 深拷贝, 基于父镜像生成新配置时使用
+func (c *ImageConfig) Copy() *ImageConfig {
+	content, _ := json.Marshal(c)
+	cp := &ImageConfig{}
+	_ = json.Unmarshal(content, cp)
+	return cp
+}
+
+// 排好序的暴露端口, 例如 80/tcp
+func (c *ContainerConfig) Ports() []string {
+	ports := make([]string, 0, len(c.ExposedPorts))
+	for port := range c.ExposedPorts {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// 容器最终执行的命令: entrypoint 加上 cmd, 用户给出的参数替换 cmd
+func (c *ContainerConfig) Command(args []string) []string {
+	cmd := c.Cmd
+	if len(args) > 0 {
+		cmd = args
+	}
+	command := append([]string{}, c.Entrypoint...)
+	return append(command, cmd...)
+}
+
+// 以镜像的 Env 为默认值, 同名变量被 overrides 覆盖
+func MergeEnv(defaults, overrides []string) []string {
+	var env []string
+	index := map[string]int{}
+	for _, kv := range append(append([]string{}, defaults...), overrides...) {
+		key := strings.SplitN(kv, "=", 2)[0]
+		if i, ok := index[key]; ok {
+			env[i] = kv
+			continue
+		}
+		index[key] = len(env)
+		env = append(env, kv)
+	}
+	return env
+}
+
+// 按 Dockerfile 指令修改配置, 支持 CMD, ENTRYPOINT, ENV, WORKDIR, USER, EXPOSE 和 LABEL
+func ApplyChange(c *ContainerConfig, change string) error {
+	change = strings.TrimSpace(change)
+	fields := strings.SplitN(change, " ", 2)
+	instruction := strings.ToUpper(fields[0])
+	value := ""
+	if len(fields) > 1 {
+		value = strings.TrimSpace(fields[1])
+	}
+	if value == "" {
+		return fmt.Errorf("%s requires at least one argument", instruction)
+	}
+
+	switch instruction {
+	case "CMD":
+		c.Cmd = parseCommand(value)
+	case "ENTRYPOINT":
+		c.Entrypoint = parseCommand(value)
+	case "ENV":
+		pairs, err := parseKeyValues(instruction, value)
+		if err != nil {
+			return err
+		}
+		for _, kv := range pairs {
+			c.Env = MergeEnv(c.Env, []string{kv[0] + "=" + kv[1]})
+		}
+	case "LABEL":
+		pairs, err := parseKeyValues(instruction, value)
+		if err != nil {
+			return err
+		}
+		if c.Labels == nil {
+			c.Labels = map[string]string{}
+		}
+		for _, kv := range pairs {
+			c.Labels[kv[0]] = kv[1]
+		}
+	case "WORKDIR":
+		if !strings.HasPrefix(value, "/") {
+			base := c.WorkingDir
+			if base == "" {
+				base = "/"
+			}
+			value = strings.TrimSuffix(base, "/") + "/" + value
+		}
+		c.WorkingDir = value
+	case "USER":
+		c.User = value
+	case "EXPOSE":
+		if c.ExposedPorts == nil {
+			c.ExposedPorts = map[string]struct{}{}
+		}
+		for _, port := range strings.Fields(value) {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			c.ExposedPorts[port] = struct{}{}
+		}
+	default:
+		return fmt.Errorf("unsupported instruction %s", instruction)
+	}
+	return nil
+}
+
+// JSON 数组形式直接作为参数, 否则按 shell 形式交给 /bin/sh -c
+func parseCommand(value string) []string {
+	if strings.HasPrefix(value, "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(value), &args); err == nil {
+			return args
+		}
+	}
+	return []string{"/bin/sh", "-c", value}
+}
+
+// 解析 key=value key2="value 2" 或者旧的 key value 形式
+func parseKeyValues(instruction, value string) ([][2]string, error) {
+	if !strings.Contains(strings.Fields(value)[0], "=") {
+		fields := strings.SplitN(value, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s %s: missing value", instruction, value)
+		}
+		return [][2]string{{fields[0], strings.TrimSpace(fields[1])}}, nil
+	}
+
+	var pairs [][2]string
+	for _, word := range splitWords(value) {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%s %s: %q should be key=value", instruction, value, word)
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+	return pairs, nil
+}
+
+// 按空白切分, 引号中的空白保留, 引号本身去掉
+func splitWords(value string) []string {
+	var words []string
+	var word strings.Builder
+	var quote rune
+	inWord := false
+	for _, r := range value {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+			inWord = true
+		case quote == 0 && (r == ' ' || r == '\t'):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
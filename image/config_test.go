@@ -0,0 +1,65 @@
+package image
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyChange(t *testing.T) {
+	c := &ContainerConfig{Env: []string{"PATH=/bin"}}
+	changes := []string{
+		`CMD ["nginx", "-g", "daemon off;"]`,
+		`ENTRYPOINT /docker-entrypoint.sh`,
+		`ENV PATH=/usr/local/bin:/bin MODE="production mode"`,
+		`ENV LANG C.UTF-8`,
+		`WORKDIR /app`,
+		`workdir src`,
+		`USER nginx:www`,
+		`EXPOSE 80 53/udp`,
+		`LABEL version=1.0`,
+	}
+	for _, change := range changes {
+		if err := ApplyChange(c, change); err != nil {
+			t.Fatalf("ApplyChange(%q) error: %v", change, err)
+		}
+	}
+	expect := &ContainerConfig{
+		User:         "nginx:www",
+		ExposedPorts: map[string]struct{}{"80/tcp": {}, "53/udp": {}},
+		Env:          []string{"PATH=/usr/local/bin:/bin", "MODE=production mode", "LANG=C.UTF-8"},
+		Entrypoint:   []string{"/bin/sh", "-c", "/docker-entrypoint.sh"},
+		Cmd:          []string{"nginx", "-g", "daemon off;"},
+		WorkingDir:   "/app/src",
+		Labels:       map[string]string{"version": "1.0"},
+	}
+	if !reflect.DeepEqual(c, expect) {
+		t.Errorf("unexpected config\n got %+v\nwant %+v", c, expect)
+	}
+
+	for _, change := range []string{"RUN ls", "CMD", "ENV =x", "ENV KEY"} {
+		if err := ApplyChange(c, change); err == nil {
+			t.Errorf("ApplyChange(%q) should fail", change)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	c := &ContainerConfig{Entrypoint: []string{"/entry"}, Cmd: []string{"serve"}}
+	if got := c.Command(nil); !reflect.DeepEqual(got, []string{"/entry", "serve"}) {
+		t.Errorf("unexpected command %v", got)
+	}
+	if got := c.Command([]string{"sh"}); !reflect.DeepEqual(got, []string{"/entry", "sh"}) {
+		t.Errorf("unexpected command %v", got)
+	}
+	c.Entrypoint = nil
+	if got := c.Command([]string{"sh", "-c", "ls"}); !reflect.DeepEqual(got, []string{"sh", "-c", "ls"}) {
+		t.Errorf("unexpected command %v", got)
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	got := MergeEnv([]string{"A=1", "B=2"}, []string{"B=3", "C=4"})
+	if !reflect.DeepEqual(got, []string{"A=1", "B=3", "C=4"}) {
+		t.Errorf("unexpected env %v", got)
+	}
+}
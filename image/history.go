@@ -0,0 +1,69 @@
+package image
+
+import (
+	"time"
+)
+
+// history 命令中的一行, 对应镜像的一层或者一条只修改配置的指令
+type HistoryEntry struct {
+	ID         string     `json:"id"` // 只有最上面一行是镜像ID, 其他行为空
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"createdBy"`
+	Author     string     `json:"author,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	Size       int64      `json:"size"`
+	EmptyLayer bool       `json:"emptyLayer"`
+	DiffID     string     `json:"diffId,omitempty"`
+}
+
+// 镜像的历史, 新的在前. 配置中没有历史记录的层 (例如导入的镜像) 也会列出
+func (s *Store) History(img *Image) ([]*HistoryEntry, error) {
+	config, err := s.Config(img)
+	if err != nil {
+		return nil, err
+	}
+	diffIDs := config.RootFS.DiffIDs
+	// 历史记录少于层数时, 缺少记录的是下面的层, 例如导入的基础镜像
+	withHistory := 0
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			withHistory++
+		}
+	}
+	var entries []*HistoryEntry
+	layer := 0
+	for ; layer < len(diffIDs)-withHistory; layer++ {
+		entries = append(entries, &HistoryEntry{DiffID: diffIDs[layer]})
+	}
+	for _, h := range config.History {
+		entry := &HistoryEntry{
+			Created:    h.Created,
+			CreatedBy:  h.CreatedBy,
+			Author:     h.Author,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		}
+		if !h.EmptyLayer && layer < len(diffIDs) {
+			entry.DiffID = diffIDs[layer]
+			layer++
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, entry := range entries {
+		if entry.DiffID == "" {
+			continue
+		}
+		if l, err := s.GetLayer(entry.DiffID); err == nil {
+			entry.Size = l.Size
+		}
+	}
+	// 反转成新的在前
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if len(entries) > 0 {
+		entries[0].ID = img.ID
+	}
+	return entries, nil
+}
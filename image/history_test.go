@@ -0,0 +1,56 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewStore(path.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 导入的基础镜像没有历史记录
+	base, err := store.ImportTar(makeTar(t, dir, "base", "base"), "base", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, err := store.RegisterLayer(makeTar(t, dir, "top", "top layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _ := store.Config(base)
+	now := time.Now().UTC()
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, top.DiffID)
+	config.History = []History{
+		{Created: &now, CreatedBy: "/bin/sh -c make", Author: "kain", Comment: "build"},
+		{Created: &now, CreatedBy: "CMD [\"app\"]", EmptyLayer: true},
+	}
+	img, err := store.CreateImage(config, "app", base.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := store.History(img)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("unexpected history %v %v", entries, err)
+	}
+	if entries[0].ID != img.ID || !entries[0].EmptyLayer || entries[0].Size != 0 {
+		t.Errorf("unexpected top entry %+v", entries[0])
+	}
+	if entries[1].DiffID != top.DiffID || entries[1].Size != int64(len("top layer")) || entries[1].Author != "kain" {
+		t.Errorf("unexpected layer entry %+v", entries[1])
+	}
+	if entries[2].DiffID != config.RootFS.DiffIDs[0] || entries[2].CreatedBy != "" || entries[2].ID != "" {
+		t.Errorf("base layer without history should be listed %+v", entries[2])
+	}
+}
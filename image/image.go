@@ -0,0 +1,82 @@
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTag = "latest"
+	idPrefix   = "sha256:"
+	// 列表中显示的短ID长度
+	shortIDLength = 12
+)
+
+// manifest、配置和层的摘要, 会拼到仓库的 URL 和本地路径中
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// 来自仓库或者镜像包的摘要在使用前都要检查
+func checkDigest(digest string) error {
+	if !digestPattern.MatchString(digest) {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	return nil
+}
+
+// 镜像的元数据, 保存在镜像目录下的 metadata.json 中
+type Image struct {
+	ID      string    `json:"id"`               // sha256:<镜像内容的摘要>
+	Tags    []string  `json:"tags"`             // name:tag 形式的引用
+	Size    int64     `json:"size"`             // 解压后的大小, 单位字节
+	Created time.Time `json:"created"`          // 导入或提交的时间
+	Parent  string    `json:"parent,omitempty"` // 由容器提交时, 容器所用镜像的ID
+}
+
+// 去掉 sha256: 前缀的摘要
+func (img *Image) Digest() string {
+	return strings.TrimPrefix(img.ID, idPrefix)
+}
+
+func (img *Image) ShortID() string {
+	digest := img.Digest()
+	if len(digest) > shortIDLength {
+		return digest[:shortIDLength]
+	}
+	return digest
+}
+
+func (img *Image) hasTag(ref string) bool {
+	for _, tag := range img.Tags {
+		if tag == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// 把镜像引用规范成 name:tag 的形式, 没有 tag 时使用 latest
+func NormalizeReference(ref string) (string, error) {
+	if ref == "" {
+		return "", fmt.Errorf("empty image reference")
+	}
+	name, tag := ref, DefaultTag
+	// 冒号出现在最后一个斜杠之后才是 tag, 之前的是仓库地址的端口
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, tag = ref[:i], ref[i+1:]
+	}
+	if name == "" || tag == "" || strings.ContainsAny(name, " \t@") || strings.ContainsAny(tag, " \t/@") {
+		return "", fmt.Errorf("invalid image reference %q", ref)
+	}
+	return name + ":" + tag, nil
+}
+
+// 把 name:tag 拆成两部分
+func SplitReference(ref string) (string, string) {
+	i := strings.LastIndex(ref, ":")
+	if i <= strings.LastIndex(ref, "/") {
+		return ref, DefaultTag
+	}
+	return ref[:i], ref[i+1:]
+}
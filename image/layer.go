@@ -0,0 +1,178 @@
+package image
+
+import (
+	"bucket/utils"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	layersDir     = "layers"
+	layerTarFile  = "layer.tar"
+	layerDiffDir  = "diff"
+	layerMetaFile = "layer.json"
+)
+
+// 层中的 aufs whiteout: 删除的文件用 .wh.<name> 表示, 整个目录被替换时目录下有 .wh..wh..opq,
+// .wh..wh. 开头的其他文件是 aufs 自己的元数据
+const (
+	WhiteoutPrefix     = ".wh."
+	WhiteoutMetaPrefix = ".wh..wh."
+	WhiteoutOpaque     = ".wh..wh..opq"
+)
+
+// 镜像的一层, 内容是相对下层的变化, 删除的文件用 .wh.<name> 表示, 整个目录被替换时目录下有 .wh..wh..opq
+type Layer struct {
+	DiffID string `json:"diffId"` // sha256:<未压缩 tar 包的摘要>
+	Size   int64  `json:"size"`   // 解压后的大小
+}
+
+func (s *Store) layerDir(diffID string) string {
+	return path.Join(s.root, layersDir, strings.TrimPrefix(diffID, idPrefix))
+}
+
+// 层的 tar 包, 导出和推送镜像时使用
+func (s *Store) LayerTarPath(diffID string) string {
+	return path.Join(s.layerDir(diffID), layerTarFile)
+}
+
+func (s *Store) LayerDiffPath(diffID string) string {
+	return path.Join(s.layerDir(diffID), layerDiffDir)
+}
+
+func (s *Store) GetLayer(diffID string) (*Layer, error) {
+	if err := checkDigest(diffID); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path.Join(s.layerDir(diffID), layerMetaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("No such layer: %s", diffID)
+		}
+		return nil, err
+	}
+	layer := &Layer{}
+	if err := json.Unmarshal(content, layer); err != nil {
+		return nil, fmt.Errorf("load layer %s error: %v", diffID, err)
+	}
+	return layer, nil
+}
+
+// 注册一个未压缩的层 tar 包, 已经存在同样内容的层时直接返回
+func (s *Store) RegisterLayer(tarPath string) (*Layer, error) {
+	digest, err := fileDigest(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	diffID := idPrefix + digest
+	if layer, err := s.GetLayer(diffID); err == nil {
+		return layer, nil
+	}
+
+	tmpDir, err := ioutil.TempDir(path.Join(s.root, layersDir), ".import-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	diffDir := path.Join(tmpDir, layerDiffDir)
+	if err := os.MkdirAll(diffDir, 0755); err != nil {
+		return nil, err
+	}
+	// 保留 .wh. 文件, aufs 以 ro+wh 挂载时会把它们当作 whiteout
+	if err := untarFile(tarPath, diffDir); err != nil {
+		return nil, fmt.Errorf("untar %s error: %v", tarPath, err)
+	}
+	if err := copyFile(tarPath, path.Join(tmpDir, layerTarFile)); err != nil {
+		return nil, err
+	}
+	size, err := dirSize(diffDir)
+	if err != nil {
+		return nil, err
+	}
+	layer := &Layer{DiffID: diffID, Size: size}
+	content, err := json.MarshalIndent(layer, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path.Join(tmpDir, layerMetaFile), content, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpDir, s.layerDir(diffID)); err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// 删除没有镜像引用的层, 返回被删除的层
+func (s *Store) gcLayers() ([]string, error) {
+	images, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	for _, img := range images {
+		config, err := s.Config(img)
+		if err != nil {
+			return nil, err
+		}
+		for _, diffID := range config.RootFS.DiffIDs {
+			used[strings.TrimPrefix(diffID, idPrefix)] = true
+		}
+	}
+
+	files, err := ioutil.ReadDir(path.Join(s.root, layersDir))
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, file := range files {
+		if used[file.Name()] || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(s.root, layersDir, file.Name())); err != nil {
+			return removed, err
+		}
+		removed = append(removed, idPrefix+file.Name())
+	}
+	return removed, nil
+}
+
+func untarFile(tarPath, dir string) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return utils.Untar(f, dir)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,642 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	DefaultRegistry = "registry-1.docker.io"
+	downloadsDir    = "downloads"
+
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// 分块上传时每块的大小
+var uploadChunkSize = 8 << 20
+
+// 访问仓库的选项
+type RegistryOptions struct {
+	PlainHTTP bool   // 使用 http 而不是 https
+	Insecure  bool   // 不校验 https 证书
+	Username  string // 用于 basic 认证或者换取 token
+	Password  string
+}
+
+// 远程镜像引用, 例如 localhost:5000/app:v1 或者 busybox@sha256:...
+type RemoteReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// 第一段包含 . 或 : 或者是 localhost 时是仓库地址, 否则是 docker hub 上的镜像
+func ParseRemoteReference(ref string) (*RemoteReference, error) {
+	r := &RemoteReference{}
+	name := ref
+	if i := strings.Index(ref, "@"); i >= 0 {
+		name, r.Digest = ref[:i], ref[i+1:]
+		if checkDigest(r.Digest) != nil {
+			return nil, fmt.Errorf("invalid digest in reference %q", ref)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, r.Tag = name[:i], name[i+1:]
+	} else if r.Digest == "" {
+		r.Tag = DefaultTag
+	}
+	if name == "" || strings.ContainsAny(name, " \t") || strings.ContainsAny(r.Tag, " \t/") {
+		return nil, fmt.Errorf("invalid image reference %q", ref)
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		r.Registry, r.Repository = parts[0], parts[1]
+	} else {
+		r.Registry, r.Repository = DefaultRegistry, name
+	}
+	if r.Registry == "docker.io" {
+		r.Registry = DefaultRegistry
+	}
+	if r.Registry == DefaultRegistry && !strings.Contains(r.Repository, "/") {
+		r.Repository = "library/" + r.Repository
+	}
+	return r, nil
+}
+
+// 拉取 manifest 时使用的引用, 有 digest 时优先使用 digest
+func (r *RemoteReference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+type registryClient struct {
+	ref           *RemoteReference
+	opts          *RegistryOptions
+	client        *http.Client
+	scope         string
+	authorization string
+}
+
+func newRegistryClient(ref *RemoteReference, opts *RegistryOptions, actions string) *registryClient {
+	if opts == nil {
+		opts = &RegistryOptions{}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &registryClient{
+		ref:    ref,
+		opts:   opts,
+		client: &http.Client{Transport: transport},
+		scope:  fmt.Sprintf("repository:%s:%s", ref.Repository, actions),
+	}
+}
+
+func (c *registryClient) url(p string) string {
+	scheme := "https"
+	if c.opts.PlainHTTP {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s%s", scheme, c.ref.Registry, c.ref.Repository, p)
+}
+
+// 发送请求, 返回 401 时按 WWW-Authenticate 认证后重试一次
+func (c *registryClient) do(method, u string, header http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		_ = resp.Body.Close()
+		if err := c.authenticate(challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *registryClient) authenticate(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.opts.Username == "" {
+			return fmt.Errorf("registry %s requires authentication", c.ref.Registry)
+		}
+		c.authorization = "Basic " + basicAuth(c.opts.Username, c.opts.Password)
+	case "bearer":
+		token, err := c.fetchToken(params)
+		if err != nil {
+			return err
+		}
+		c.authorization = "Bearer " + token
+	default:
+		return fmt.Errorf("unsupported auth challenge %q from registry %s", challenge, c.ref.Registry)
+	}
+	return nil
+}
+
+// 向 realm 换取 token, 有用户名时带上 basic 认证, 否则是匿名 token
+func (c *registryClient) fetchToken(params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", c.scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.opts.Username != "" {
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get token from %s: %s", realm.Host, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("invalid token response: %v", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf("empty token from %s", realm.Host)
+	}
+	return token.Token, nil
+}
+
+// 解析 Bearer realm="...",service="...",scope="a,b" 形式的认证要求
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	fields := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(fields) < 2 {
+		return fields[0], params
+	}
+	rest := fields[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return fields[0], params
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// 状态码不符合预期时把仓库返回的错误信息带出来
+func checkResponse(resp *http.Response, expect ...int) error {
+	for _, code := range expect {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	var registryErr struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &registryErr) == nil && len(registryErr.Errors) > 0 {
+		e := registryErr.Errors[0]
+		return fmt.Errorf("%s %s: %s %s", resp.Request.Method, resp.Request.URL.Path, e.Code, e.Message)
+	}
+	return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+}
+
+// 获取 manifest, 多架构镜像选择当前平台
+func (c *registryClient) getManifest(reference string) (*Manifest, error) {
+	header := http.Header{}
+	header.Set("Accept", strings.Join([]string{MediaTypeManifest, MediaTypeIndex, mediaTypeDockerManifest, mediaTypeDockerManifestList}, ", "))
+	resp, err := c.do(http.MethodGet, c.url("/manifests/"+reference), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(reference, idPrefix) && digestOf(content) != reference {
+		return nil, fmt.Errorf("manifest digest mismatch, expect %s got %s", reference, digestOf(content))
+	}
+
+	var probe struct {
+		MediaType string `json:"mediaType"`
+	}
+	_ = json.Unmarshal(content, &probe)
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	if probe.MediaType != "" {
+		mediaType = probe.MediaType
+	}
+	switch {
+	case isIndex(mediaType):
+		index := &Index{}
+		if err := json.Unmarshal(content, index); err != nil {
+			return nil, fmt.Errorf("invalid index: %v", err)
+		}
+		desc, err := selectPlatform(index)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkDigest(desc.Digest); err != nil {
+			return nil, err
+		}
+		return c.getManifest(desc.Digest)
+	case mediaType == MediaTypeManifest || mediaType == mediaTypeDockerManifest:
+		manifest := &Manifest{}
+		if err := json.Unmarshal(content, manifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %v", err)
+		}
+		return manifest, nil
+	}
+	return nil, fmt.Errorf("unsupported manifest media type %q", mediaType)
+}
+
+// 下载小的 blob (配置) 到内存并校验摘要
+func (c *registryClient) getBlob(digest string) ([]byte, error) {
+	if err := checkDigest(digest); err != nil {
+		return nil, err
+	}
+	resp, err := c.do(http.MethodGet, c.url("/blobs/"+digest), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err := checkResponse(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if digestOf(content) != digest {
+		return nil, fmt.Errorf("blob digest mismatch, expect %s got %s", digest, digestOf(content))
+	}
+	return content, nil
+}
+
+// 下载层到 downloads 目录, 中断后再次拉取时从已下载的位置继续
+func (s *Store) downloadBlob(c *registryClient, desc Descriptor) (string, error) {
+	if err := checkDigest(desc.Digest); err != nil {
+		return "", err
+	}
+	dir := path.Join(s.root, downloadsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	filePath := path.Join(dir, strings.TrimPrefix(desc.Digest, idPrefix)+".partial")
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(http.MethodGet, c.url("/blobs/"+desc.Digest), header, nil)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return "", fmt.Errorf("unexpected content range %q", resp.Header.Get("Content-Range"))
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// 之前已经下载完整
+	default:
+		if err := checkResponse(resp, http.StatusOK); err != nil {
+			return "", err
+		}
+		// 仓库不支持 Range, 重新下载
+		if err := f.Truncate(0); err != nil {
+			return "", err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		if _, err := io.Copy(f, resp.Body); err != nil {
+			// 保留已下载的部分
+			return "", fmt.Errorf("download %s: %v", desc.Digest, err)
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	if digest := idPrefix + hex.EncodeToString(hash.Sum(nil)); digest != desc.Digest {
+		_ = os.Remove(filePath)
+		return "", fmt.Errorf("blob digest mismatch, expect %s got %s", desc.Digest, digest)
+	}
+	return filePath, nil
+}
+
+// 从仓库拉取镜像到本地存储, 已有的层不会重复下载. 进度输出到 out
+func (s *Store) Pull(ref string, opts *RegistryOptions, out io.Writer) (*Image, error) {
+	remote, err := ParseRemoteReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	c := newRegistryClient(remote, opts, "pull")
+	manifest, err := c.getManifest(remote.Reference())
+	if err != nil {
+		return nil, err
+	}
+	configJSON, err := c.getBlob(manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	config := NewImageConfig()
+	if err := json.Unmarshal(configJSON, config); err != nil {
+		return nil, fmt.Errorf("invalid image config: %v", err)
+	}
+	if len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("manifest has %d layers but config has %d diff_ids", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+	for _, diffID := range config.RootFS.DiffIDs {
+		if err := checkDigest(diffID); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, desc := range manifest.Layers {
+		diffID := config.RootFS.DiffIDs[i]
+		if _, err := s.GetLayer(diffID); err == nil {
+			fmt.Fprintf(out, "%s: Already exists\n", shortDigest(desc.Digest))
+			continue
+		}
+		fmt.Fprintf(out, "%s: Downloading\n", shortDigest(desc.Digest))
+		blobFile, err := s.downloadBlob(c, desc)
+		if err != nil {
+			return nil, err
+		}
+		layer, err := s.registerBlob(blobFile)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %v", desc.Digest, err)
+		}
+		if layer.DiffID != diffID {
+			return nil, fmt.Errorf("layer %s has diff id %s, expect %s", desc.Digest, layer.DiffID, diffID)
+		}
+		fmt.Fprintf(out, "%s: Pull complete\n", shortDigest(desc.Digest))
+	}
+
+	// 按 digest 拉取时不打 tag
+	tag := ""
+	if remote.Tag != "" {
+		tag = strings.SplitN(ref, "@", 2)[0]
+	}
+	return s.ImportConfig(configJSON, tag)
+}
+
+func (s *Store) registerBlob(blobFile string) (*Layer, error) {
+	f, err := os.Open(blobFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(blobFile)
+	}()
+	return s.registerLayerStream(f)
+}
+
+// 把本地镜像推送到 ref 所指的仓库, 仓库中已有的层会跳过. 返回 manifest 的 digest
+func (s *Store) Push(ref string, opts *RegistryOptions, out io.Writer) (string, error) {
+	remote, err := ParseRemoteReference(ref)
+	if err != nil {
+		return "", err
+	}
+	if remote.Digest != "" {
+		return "", fmt.Errorf("can not push by digest %s", ref)
+	}
+	img, err := s.Lookup(ref)
+	if err != nil {
+		return "", err
+	}
+	manifest, configJSON, err := s.imageManifest(img)
+	if err != nil {
+		return "", err
+	}
+
+	c := newRegistryClient(remote, opts, "pull,push")
+	for _, desc := range manifest.Layers {
+		f, err := os.Open(s.LayerTarPath(desc.Digest))
+		if err != nil {
+			return "", err
+		}
+		pushed, err := c.pushBlob(desc.Digest, f)
+		_ = f.Close()
+		if err != nil {
+			return "", err
+		}
+		if pushed {
+			fmt.Fprintf(out, "%s: Pushed\n", shortDigest(desc.Digest))
+		} else {
+			fmt.Fprintf(out, "%s: Layer already exists\n", shortDigest(desc.Digest))
+		}
+	}
+	if _, err := c.pushBlob(img.ID, bytes.NewReader(configJSON)); err != nil {
+		return "", err
+	}
+
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", MediaTypeManifest)
+	resp, err := c.do(http.MethodPut, c.url("/manifests/"+remote.Tag), header, manifestJSON)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err := checkResponse(resp, http.StatusCreated); err != nil {
+		return "", err
+	}
+	return digestOf(manifestJSON), nil
+}
+
+// 仓库中没有这个 blob 时分块上传, 返回是否上传了
+func (c *registryClient) pushBlob(digest string, r io.Reader) (bool, error) {
+	resp, err := c.do(http.MethodHead, c.url("/blobs/"+digest), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+
+	resp, err = c.do(http.MethodPost, c.url("/blobs/uploads/"), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+	if err := checkResponse(resp, http.StatusAccepted); err != nil {
+		return false, err
+	}
+	location, err := c.location(resp)
+	if err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, uploadChunkSize)
+	var offset int64
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			header := http.Header{}
+			header.Set("Content-Type", "application/octet-stream")
+			header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(n)-1))
+			resp, err := c.do(http.MethodPatch, location, header, buf[:n])
+			if err != nil {
+				return false, err
+			}
+			_ = resp.Body.Close()
+			if err := checkResponse(resp, http.StatusAccepted); err != nil {
+				return false, err
+			}
+			if location, err = c.location(resp); err != nil {
+				return false, err
+			}
+			offset += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return false, readErr
+		}
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return false, err
+	}
+	query := u.Query()
+	query.Set("digest", digest)
+	u.RawQuery = query.Encode()
+	resp, err = c.do(http.MethodPut, u.String(), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+	if err := checkResponse(resp, http.StatusCreated); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 上传地址可能是相对路径
+func (c *registryClient) location(resp *http.Response) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("%s %s: missing Location header", resp.Request.Method, resp.Request.URL.Path)
+	}
+	u, err := resp.Request.URL.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func shortDigest(digest string) string {
+	digest = strings.TrimPrefix(digest, idPrefix)
+	if len(digest) > shortIDLength {
+		return digest[:shortIDLength]
+	}
+	return digest
+}
@@ -0,0 +1,275 @@
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 内存中的 registry v2, 使用 token 认证
+type fakeRegistry struct {
+	sync.Mutex
+	server        *httptest.Server
+	blobs         map[string][]byte
+	manifests     map[string][]byte
+	manifestTypes map[string]string
+	uploads       map[string][]byte
+	rangeRequests int
+	patches       int
+}
+
+var (
+	uploadPath   = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/(.*)$`)
+	blobPathRe   = regexp.MustCompile(`^/v2/(.+)/blobs/(sha256:[0-9a-f]+)$`)
+	manifestPath = regexp.MustCompile(`^/v2/(.+)/manifests/(.+)$`)
+)
+
+func newFakeRegistry() *fakeRegistry {
+	r := &fakeRegistry{
+		blobs:         map[string][]byte{},
+		manifests:     map[string][]byte{},
+		manifestTypes: map[string]string{},
+		uploads:       map[string][]byte{},
+	}
+	r.server = httptest.NewServer(r)
+	return r
+}
+
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *fakeRegistry) putManifest(ref, mediaType string, content []byte) string {
+	digest := digestOf(content)
+	for _, key := range []string{ref, digest} {
+		r.manifests[key] = content
+		r.manifestTypes[key] = mediaType
+	}
+	return digest
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+
+	if req.URL.Path == "/token" {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "secret"})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer secret" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:app:pull"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch m := uploadPath.FindStringSubmatch(req.URL.Path); {
+	case m != nil && req.Method == http.MethodPost:
+		id := fmt.Sprintf("upload-%d", len(r.uploads))
+		r.uploads[id] = []byte{}
+		w.Header().Set("Location", "/v2/"+m[1]+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case m != nil && req.Method == http.MethodPatch:
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get("Content-Range") != fmt.Sprintf("%d-%d", len(r.uploads[m[2]]), len(r.uploads[m[2]])+len(body)-1) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		r.uploads[m[2]] = append(r.uploads[m[2]], body...)
+		r.patches++
+		w.Header().Set("Location", req.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case m != nil && req.Method == http.MethodPut:
+		content := r.uploads[m[2]]
+		if digestOf(content) != req.URL.Query().Get("digest") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[digestOf(content)] = content
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	if m := blobPathRe.FindStringSubmatch(req.URL.Path); m != nil {
+		content, ok := r.blobs[m[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Header.Get("Range") != "" {
+			r.rangeRequests++
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+		return
+	}
+
+	if m := manifestPath.FindStringSubmatch(req.URL.Path); m != nil {
+		if req.Method == http.MethodPut {
+			body, _ := ioutil.ReadAll(req.Body)
+			r.putManifest(m[2], req.Header.Get("Content-Type"), body)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		content, ok := r.manifests[m[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+			return
+		}
+		w.Header().Set("Content-Type", r.manifestTypes[m[2]])
+		_, _ = w.Write(content)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func TestParseRemoteReference(t *testing.T) {
+	cases := map[string]RemoteReference{
+		"busybox":             {DefaultRegistry, "library/busybox", "latest", ""},
+		"kain/app:v1":         {DefaultRegistry, "kain/app", "v1", ""},
+		"localhost:5000/app":  {"localhost:5000", "app", "latest", ""},
+		"example.com/a/b:1.0": {"example.com", "a/b", "1.0", ""},
+		"localhost/app@" + idPrefix + strings.Repeat("a", 64): {"localhost", "app", "", idPrefix + strings.Repeat("a", 64)},
+	}
+	for ref, expect := range cases {
+		got, err := ParseRemoteReference(ref)
+		if err != nil || *got != expect {
+			t.Errorf("ParseRemoteReference(%q) = %+v, %v, expect %+v", ref, got, err, expect)
+		}
+	}
+	for _, ref := range []string{"app@sha256:bad", "app@sha256:" + strings.Repeat("A", 64)} {
+		if _, err := ParseRemoteReference(ref); err == nil {
+			t.Errorf("invalid digest in %s should fail", ref)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.io/token",service="registry",scope="repository:a:pull,push"`)
+	if scheme != "Bearer" || params["realm"] != "https://auth.io/token" || params["service"] != "registry" ||
+		params["scope"] != "repository:a:pull,push" {
+		t.Errorf("unexpected challenge %s %v", scheme, params)
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry := newFakeRegistry()
+	defer registry.server.Close()
+	oldChunkSize := uploadChunkSize
+	uploadChunkSize = 1024
+	defer func() {
+		uploadChunkSize = oldChunkSize
+	}()
+	opts := &RegistryOptions{PlainHTTP: true, Username: "user", Password: "pass"}
+	ref := registry.host() + "/app:v1"
+
+	src, err := NewStore(path.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := src.ImportTar(makeTar(t, dir, "app", strings.Repeat("x", 4096)), ref, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := src.Push(ref, opts, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("push error: %v", err)
+	}
+	if registry.patches < 2 {
+		t.Errorf("layer should be uploaded in chunks, got %d patches", registry.patches)
+	}
+	// 再次推送时层已经存在
+	var out bytes.Buffer
+	if _, err := src.Push(ref, opts, &out); err != nil || !strings.Contains(out.String(), "already exists") {
+		t.Errorf("unexpected second push %q %v", out.String(), err)
+	}
+
+	// 多架构 index, 当前平台的 manifest 放在后面
+	index, _ := json.Marshal(Index{SchemaVersion: 2, MediaType: MediaTypeIndex, Manifests: []Descriptor{
+		{MediaType: MediaTypeManifest, Digest: idPrefix + strings.Repeat("0", 64), Platform: &Platform{Architecture: "other", OS: "linux"}},
+		{MediaType: MediaTypeManifest, Digest: digest, Platform: &Platform{Architecture: runtime.GOARCH, OS: "linux"}},
+	}})
+	registry.putManifest("multi", MediaTypeIndex, index)
+
+	// 模拟中断的下载, 只留下一部分
+	dst, err := NewStore(path.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _ := src.Config(img)
+	layerDigest := config.RootFS.DiffIDs[0]
+	partial := path.Join(dir, "dst", downloadsDir, strings.TrimPrefix(layerDigest, idPrefix)+".partial")
+	_ = os.MkdirAll(path.Dir(partial), 0755)
+	if err := ioutil.WriteFile(partial, registry.blobs[layerDigest][:100], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pulled, err := dst.Pull(registry.host()+"/app:multi", opts, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("pull error: %v", err)
+	}
+	if pulled.ID != img.ID || !pulled.hasTag(registry.host()+"/app:multi") {
+		t.Errorf("unexpected pulled image %+v", pulled)
+	}
+	if registry.rangeRequests != 1 {
+		t.Errorf("download should resume with a range request, got %d", registry.rangeRequests)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("partial download should be removed")
+	}
+	dirs, err := dst.LayerDirs(pulled)
+	if err != nil || len(dirs) != 1 {
+		t.Fatalf("unexpected layer dirs %v %v", dirs, err)
+	}
+
+	// 按 digest 拉取不打 tag
+	byDigest, err := dst.Pull(registry.host()+"/app@"+digest, opts, ioutil.Discard)
+	if err != nil || byDigest.ID != img.ID {
+		t.Errorf("pull by digest error %+v %v", byDigest, err)
+	}
+	if _, err := dst.Pull(registry.host()+"/app:missing", opts, ioutil.Discard); err == nil ||
+		!strings.Contains(err.Error(), "MANIFEST_UNKNOWN") {
+		t.Errorf("unexpected error for missing tag: %v", err)
+	}
+	if _, err := dst.Pull(ref, &RegistryOptions{PlainHTTP: true}, ioutil.Discard); err == nil {
+		t.Errorf("pull without credentials should fail")
+	}
+
+	// manifest 中的摘要会拼到下载路径中, 不合法的要拒绝
+	evil, _ := json.Marshal(Manifest{SchemaVersion: 2, MediaType: MediaTypeManifest,
+		Config: Descriptor{MediaType: MediaTypeConfig, Digest: img.ID},
+		Layers: []Descriptor{{MediaType: MediaTypeLayer, Digest: idPrefix + "../../evil"}}})
+	registry.putManifest("evil", MediaTypeManifest, evil)
+	fresh, err := NewStore(path.Join(dir, "fresh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fresh.Pull(registry.host()+"/app:evil", opts, ioutil.Discard); err == nil ||
+		!strings.Contains(err.Error(), "invalid digest") {
+		t.Errorf("manifest with invalid layer digest should be rejected: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "evil.partial")); !os.IsNotExist(err) {
+		t.Errorf("download should not be written outside of the store")
+	}
+}
@@ -0,0 +1,467 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	repositoriesFile = "repositories.json"
+	metadataFile     = "metadata.json"
+	configFile       = "config.json"
+	imagesDir        = "images"
+	buildCacheDir    = "buildcache"
+)
+
+// 本地镜像存储, 镜像由按 sha256 寻址的层叠加而成, 相同的层只保存一份. 目录结构:
+//
+//	<root>/repositories.json               name:tag -> 镜像ID
+//	<root>/images/<digest>/metadata.json
+//	<root>/images/<digest>/config.json      OCI image config, digest 即是它的 sha256
+//	<root>/layers/<diffid>/layer.tar        未压缩的层, diffid 即是它的 sha256
+//	<root>/layers/<diffid>/diff/            解压后的层, 作为容器的 aufs 只读分支
+//	<root>/layers/<diffid>/layer.json
+type Store struct {
+	root         string
+	repositories map[string]string
+}
+
+type NotFoundError struct {
+	Ref string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("No such image: %s", e.Ref)
+}
+
+func IsNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
+func NewStore(root string) (*Store, error) {
+	for _, dir := range []string{imagesDir, layersDir} {
+		if err := os.MkdirAll(path.Join(root, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	s := &Store{
+		root:         root,
+		repositories: map[string]string{},
+	}
+	content, err := ioutil.ReadFile(path.Join(root, repositoriesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &s.repositories); err != nil {
+		return nil, fmt.Errorf("load %s error: %v", repositoriesFile, err)
+	}
+	return s, nil
+}
+
+func (s *Store) imageDir(id string) string {
+	return path.Join(s.root, imagesDir, strings.TrimPrefix(id, idPrefix))
+}
+
+// 镜像各层解压后的目录, 上层在前, 按这个顺序作为 aufs 的只读分支
+func (s *Store) LayerDirs(img *Image) ([]string, error) {
+	config, err := s.Config(img)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := s.DiffLayerDirs(config.RootFS.DiffIDs)
+	if err != nil {
+		return nil, fmt.Errorf("image %s: %v", img.ShortID(), err)
+	}
+	return dirs, nil
+}
+
+// 按 diff id 顺序给出的各层对应的目录, 上层在前
+func (s *Store) DiffLayerDirs(diffIDs []string) ([]string, error) {
+	dirs := make([]string, 0, len(diffIDs))
+	for i := len(diffIDs) - 1; i >= 0; i-- {
+		if _, err := s.GetLayer(diffIDs[i]); err != nil {
+			return nil, fmt.Errorf("layer %s: %v", diffIDs[i], err)
+		}
+		dirs = append(dirs, s.LayerDiffPath(diffIDs[i]))
+	}
+	return dirs, nil
+}
+
+func (s *Store) Get(id string) (*Image, error) {
+	content, err := ioutil.ReadFile(path.Join(s.imageDir(id), metadataFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &NotFoundError{Ref: id}
+		}
+		return nil, err
+	}
+	img := &Image{}
+	if err := json.Unmarshal(content, img); err != nil {
+		return nil, fmt.Errorf("load metadata of %s error: %v", id, err)
+	}
+	return img, nil
+}
+
+// 按 name[:tag]、完整ID或者ID前缀查找镜像
+func (s *Store) Lookup(ref string) (*Image, error) {
+	if normalized, err := NormalizeReference(ref); err == nil {
+		if id, ok := s.repositories[normalized]; ok {
+			return s.Get(id)
+		}
+	}
+
+	prefix := strings.TrimPrefix(ref, idPrefix)
+	if prefix == "" || strings.Trim(prefix, "0123456789abcdef") != "" {
+		return nil, &NotFoundError{Ref: ref}
+	}
+	files, err := ioutil.ReadDir(path.Join(s.root, imagesDir))
+	if err != nil {
+		return nil, err
+	}
+	var matched []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), prefix) {
+			matched = append(matched, file.Name())
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return nil, &NotFoundError{Ref: ref}
+	case 1:
+		return s.Get(idPrefix + matched[0])
+	default:
+		return nil, fmt.Errorf("image id prefix %s is ambiguous", ref)
+	}
+}
+
+// 按创建时间从新到旧返回全部镜像
+func (s *Store) List() ([]*Image, error) {
+	files, err := ioutil.ReadDir(path.Join(s.root, imagesDir))
+	if err != nil {
+		return nil, err
+	}
+	var images []*Image
+	for _, file := range files {
+		// 导入中的临时目录以 . 开头
+		if !file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		img, err := s.Get(idPrefix + file.Name())
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Created.After(images[j].Created)
+	})
+	return images, nil
+}
+
+// 镜像的 OCI 配置, 旧版本导入的镜像没有配置时返回空配置
+func (s *Store) Config(img *Image) (*ImageConfig, error) {
+	content, err := ioutil.ReadFile(path.Join(s.imageDir(img.ID), configFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NewImageConfig(), nil
+		}
+		return nil, err
+	}
+	config := NewImageConfig()
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("load config of %s error: %v", img.ShortID(), err)
+	}
+	return config, nil
+}
+
+// 把旧版本放在 dir 下的 <name>.tar 作为单层镜像导入, 只支持 latest tag, 没有时返回 NotFoundError
+func (s *Store) ImportLegacy(ref, dir string) (*Image, error) {
+	normalized, err := NormalizeReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	name, tag := SplitReference(normalized)
+	tarPath := path.Join(dir, name+".tar")
+	if _, err := os.Stat(tarPath); tag != DefaultTag || dir == "" || err != nil {
+		return nil, &NotFoundError{Ref: ref}
+	}
+	return s.ImportTar(tarPath, normalized, "", nil)
+}
+
+// 构建缓存所在的目录
+func (s *Store) BuildCacheDir() string {
+	return path.Join(s.root, buildCacheDir)
+}
+
+// 镜像配置的原文, 它的 sha256 就是镜像ID
+func (s *Store) ConfigJSON(img *Image) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(s.imageDir(img.ID), configFile))
+}
+
+// 把 tar 包作为单层镜像导入, 配置为空时使用空配置
+func (s *Store) ImportTar(tarPath, ref, parent string, config *ImageConfig) (*Image, error) {
+	layer, err := s.RegisterLayer(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = NewImageConfig()
+	}
+	config.RootFS = RootFS{Type: "layers", DiffIDs: []string{layer.DiffID}}
+	return s.CreateImage(config, ref, parent)
+}
+
+// 把 tar 流作为单层镜像导入, tar 流可以是 gzip 或 zstd 压缩的
+func (s *Store) ImportStream(r io.Reader, ref string, config *ImageConfig) (*Image, error) {
+	layer, err := s.registerLayerStream(r)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = NewImageConfig()
+	}
+	config.RootFS = RootFS{Type: "layers", DiffIDs: []string{layer.DiffID}}
+	return s.CreateImage(config, ref, "")
+}
+
+// 根据配置创建镜像, 配置中的层必须已经注册. 和 OCI 一样, 镜像ID是配置的 sha256.
+// 同样的镜像已经存在时只添加 tag, ref 为空时不打 tag
+func (s *Store) CreateImage(config *ImageConfig, ref, parent string) (*Image, error) {
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return s.createImage(configJSON, config, ref, parent)
+}
+
+// 使用其他工具生成的配置原文创建镜像, 保证镜像ID和来源一致
+func (s *Store) ImportConfig(configJSON []byte, ref string) (*Image, error) {
+	config := NewImageConfig()
+	if err := json.Unmarshal(configJSON, config); err != nil {
+		return nil, fmt.Errorf("invalid image config: %v", err)
+	}
+	return s.createImage(configJSON, config, ref, "")
+}
+
+func (s *Store) createImage(configJSON []byte, config *ImageConfig, ref, parent string) (*Image, error) {
+	var size int64
+	for _, diffID := range config.RootFS.DiffIDs {
+		layer, err := s.GetLayer(diffID)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %v", diffID, err)
+		}
+		size += layer.Size
+	}
+	sum := sha256.Sum256(configJSON)
+	id := idPrefix + hex.EncodeToString(sum[:])
+
+	img, err := s.Get(id)
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+	if img == nil {
+		created := time.Now()
+		if config.Created != nil {
+			created = *config.Created
+		}
+		img = &Image{
+			ID:      id,
+			Tags:    []string{},
+			Size:    size,
+			Created: created,
+			Parent:  parent,
+		}
+		if err := s.writeImage(img, configJSON); err != nil {
+			return nil, err
+		}
+	}
+	if ref == "" {
+		return img, nil
+	}
+	if err := s.addTag(img, ref); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// 先写到临时目录, 完成后再改名, 中途失败不会留下不完整的镜像
+func (s *Store) writeImage(img *Image, configJSON []byte) error {
+	tmpDir, err := ioutil.TempDir(path.Join(s.root, imagesDir), ".import-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	if err := writeMetadata(tmpDir, img); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(tmpDir, configFile), configJSON, 0644); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, s.imageDir(img.ID))
+}
+
+// 给已有镜像添加新的引用, 引用原来指向其他镜像时从那个镜像上移除
+func (s *Store) Tag(source, target string) error {
+	img, err := s.Lookup(source)
+	if err != nil {
+		return err
+	}
+	return s.addTag(img, target)
+}
+
+func (s *Store) addTag(img *Image, ref string) error {
+	normalized, err := NormalizeReference(ref)
+	if err != nil {
+		return err
+	}
+	if oldID, ok := s.repositories[normalized]; ok && oldID != img.ID {
+		if old, err := s.Get(oldID); err == nil {
+			old.Tags = removeString(old.Tags, normalized)
+			if err := writeMetadata(s.imageDir(oldID), old); err != nil {
+				return err
+			}
+		}
+	}
+	if !img.hasTag(normalized) {
+		img.Tags = append(img.Tags, normalized)
+		if err := writeMetadata(s.imageDir(img.ID), img); err != nil {
+			return err
+		}
+	}
+	s.repositories[normalized] = img.ID
+	return s.saveRepositories()
+}
+
+// 删除镜像引用. ref 是 tag 且镜像还有其他 tag 时只删除这个 tag,
+// 否则删除镜像本身; 按ID删除有多个 tag 的镜像需要 force.
+// 返回 Untagged/Deleted 记录
+func (s *Store) Remove(ref string, force bool) ([]string, error) {
+	img, err := s.Lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	normalized, _ := NormalizeReference(ref)
+	if img.hasTag(normalized) && len(img.Tags) > 1 {
+		img.Tags = removeString(img.Tags, normalized)
+		delete(s.repositories, normalized)
+		if err := writeMetadata(s.imageDir(img.ID), img); err != nil {
+			return nil, err
+		}
+		return []string{"Untagged: " + normalized}, s.saveRepositories()
+	}
+	if !img.hasTag(normalized) && len(img.Tags) > 1 && !force {
+		return nil, fmt.Errorf("image %s is referenced by multiple tags %s, use force to remove", img.ShortID(), strings.Join(img.Tags, ", "))
+	}
+
+	for _, tag := range img.Tags {
+		delete(s.repositories, tag)
+		result = append(result, "Untagged: "+tag)
+	}
+	if err := s.saveRepositories(); err != nil {
+		return result, err
+	}
+	if err := os.RemoveAll(s.imageDir(img.ID)); err != nil {
+		return result, err
+	}
+	result = append(result, "Deleted: "+img.ID)
+
+	// 其他镜像不再使用的层一起删除
+	removed, err := s.gcLayers()
+	for _, diffID := range removed {
+		result = append(result, "Deleted layer: "+diffID)
+	}
+	return result, err
+}
+
+// 删除镜像的全部 tag, 镜像本身和它的层保留下来
+func (s *Store) Untag(ref string) ([]string, error) {
+	img, err := s.Lookup(ref)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, tag := range img.Tags {
+		delete(s.repositories, tag)
+		result = append(result, "Untagged: "+tag)
+	}
+	img.Tags = []string{}
+	if err := writeMetadata(s.imageDir(img.ID), img); err != nil {
+		return nil, err
+	}
+	return result, s.saveRepositories()
+}
+
+func (s *Store) saveRepositories() error {
+	content, err := json.MarshalIndent(s.repositories, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(s.root, repositoriesFile), content, 0644)
+}
+
+func writeMetadata(dir string, img *Image) error {
+	content, err := json.MarshalIndent(img, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, metadataFile), content, 0644)
+}
+
+func fileDigest(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func removeString(list []string, s string) []string {
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,198 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+// 在临时目录中打一个只包含 content 文件的 tar 包
+func makeTar(t *testing.T, dir, name, content string) string {
+	src := path.Join(dir, name+"-src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(src, "content"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tarPath := path.Join(dir, name+".tar")
+	if output, err := exec.Command("tar", "-cf", tarPath, "-C", src, ".").CombinedOutput(); err != nil {
+		t.Fatalf("tar error: %v, %s", err, output)
+	}
+	return tarPath
+}
+
+func TestNormalizeReference(t *testing.T) {
+	cases := map[string]string{
+		"busybox":                  "busybox:latest",
+		"busybox:1.0":              "busybox:1.0",
+		"localhost:5000/app":       "localhost:5000/app:latest",
+		"localhost:5000/app:v2":    "localhost:5000/app:v2",
+		"library/busybox:musl-1.0": "library/busybox:musl-1.0",
+	}
+	for ref, expect := range cases {
+		got, err := NormalizeReference(ref)
+		if err != nil || got != expect {
+			t.Errorf("NormalizeReference(%q) = %q, %v, expect %q", ref, got, err, expect)
+		}
+	}
+	for _, ref := range []string{"", "busybox:", ":tag", "bad name"} {
+		if _, err := NormalizeReference(ref); err == nil {
+			t.Errorf("NormalizeReference(%q) should fail", ref)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewStore(path.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	busybox, err := store.ImportTar(makeTar(t, dir, "busybox", "hello"), "busybox", "", nil)
+	if err != nil {
+		t.Fatalf("import error: %v", err)
+	}
+	dirs, err := store.LayerDirs(busybox)
+	if err != nil || len(dirs) != 1 {
+		t.Fatalf("unexpected layer dirs %v %v", dirs, err)
+	}
+	content, err := ioutil.ReadFile(path.Join(dirs[0], "content"))
+	if err != nil || string(content) != "hello" {
+		t.Fatalf("unexpected rootfs content %q %v", content, err)
+	}
+	if busybox.Size != 5 {
+		t.Errorf("unexpected size %d", busybox.Size)
+	}
+
+	// 同样内容再次导入得到同一个镜像
+	again, err := store.ImportTar(makeTar(t, dir, "busybox", "hello"), "busybox:1.0", "", nil)
+	if err != nil || again.ID != busybox.ID || len(again.Tags) != 2 {
+		t.Fatalf("unexpected reimport %+v %v", again, err)
+	}
+
+	app, err := store.ImportTar(makeTar(t, dir, "app", "world"), "app:v1", busybox.ID, nil)
+	if err != nil || app.Parent != busybox.ID {
+		t.Fatalf("unexpected import %+v %v", app, err)
+	}
+
+	// 重新打开存储, 按 tag、ID 和 ID 前缀查找
+	store, err = NewStore(path.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"busybox", "busybox:latest", "busybox:1.0", busybox.ID, busybox.ShortID()} {
+		img, err := store.Lookup(ref)
+		if err != nil || img.ID != busybox.ID {
+			t.Errorf("Lookup(%q) = %v, %v", ref, img, err)
+		}
+	}
+	if _, err := store.Lookup("nginx"); !IsNotFound(err) {
+		t.Errorf("expect not found, got %v", err)
+	}
+
+	// tag 从原来的镜像移到新镜像上
+	if err := store.Tag("app:v1", "busybox:1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if img, _ := store.Lookup("busybox:1.0"); img.ID != app.ID {
+		t.Errorf("busybox:1.0 should point to app, got %s", img.ID)
+	}
+	if img, _ := store.Lookup("busybox"); len(img.Tags) != 1 {
+		t.Errorf("unexpected tags %v", img.Tags)
+	}
+
+	// app 有两个 tag, 按 tag 删除只去掉 tag, 按 ID 删除需要 force
+	if result, err := store.Remove("busybox:1.0", false); err != nil || len(result) != 1 {
+		t.Fatalf("unexpected untag result %v %v", result, err)
+	}
+	if err := store.Tag("app:v1", "app:v2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Remove(app.ShortID(), false); err == nil {
+		t.Fatal("expect remove image with multiple tags by id to fail")
+	}
+	// 两个 tag, 镜像本身和它独有的层
+	result, err := store.Remove(app.ShortID(), true)
+	if err != nil || len(result) != 4 {
+		t.Fatalf("unexpected remove result %v %v", result, err)
+	}
+	if _, err := os.Stat(path.Join(dir, "store", "images", app.Digest())); !os.IsNotExist(err) {
+		t.Errorf("image should be removed, %v", err)
+	}
+
+	images, err := store.List()
+	if err != nil || len(images) != 1 || images[0].ID != busybox.ID {
+		t.Errorf("unexpected images %v %v", images, err)
+	}
+}
+
+func TestLayeredImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewStore(path.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := store.ImportTar(makeTar(t, dir, "base", "base"), "base", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseConfig, _ := store.Config(base)
+	top, err := store.RegisterLayer(makeTar(t, dir, "top", "top layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个镜像共享 base 的层
+	var images []*Image
+	for _, cmd := range []string{"a", "b"} {
+		config := baseConfig.Copy()
+		config.Config.Cmd = []string{cmd}
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, top.DiffID)
+		img, err := store.CreateImage(config, "app:"+cmd, base.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, img)
+	}
+	if images[0].ID == images[1].ID || images[0].Size != int64(len("base")+len("top layer")) {
+		t.Fatalf("unexpected images %+v %+v", images[0], images[1])
+	}
+	dirs, err := store.LayerDirs(images[0])
+	if err != nil || len(dirs) != 2 || dirs[0] != store.LayerDiffPath(top.DiffID) {
+		t.Fatalf("unexpected layer dirs %v %v", dirs, err)
+	}
+	if layers, _ := ioutil.ReadDir(path.Join(dir, "store", "layers")); len(layers) != 2 {
+		t.Errorf("layers should be shared, got %d", len(layers))
+	}
+
+	// 还有镜像使用的层不会被删除
+	if _, err := store.Remove("app:a", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetLayer(top.DiffID); err != nil {
+		t.Errorf("top layer should be kept: %v", err)
+	}
+	result, err := store.Remove("app:b", false)
+	if err != nil || len(result) != 3 {
+		t.Fatalf("unexpected remove result %v %v", result, err)
+	}
+	if _, err := store.GetLayer(top.DiffID); err == nil {
+		t.Error("top layer should be removed")
+	}
+	if _, err := os.Stat(store.LayerTarPath(baseConfig.RootFS.DiffIDs[0])); err != nil {
+		t.Errorf("base layer should be kept: %v", err)
+	}
+}
@@ -4,12 +4,20 @@ import (
 	"bucket/log"
 	"fmt"
 	"github.com/vishvananda/netlink"
+	"io/ioutil"
 	"net"
-	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// bridge 驱动的选项
+const (
+	bridgeOptionMTU        = "mtu"                  // 网桥和 veth 的 MTU
+	bridgeOptionName       = "bridge_name"          // 网桥名, 默认为网络名
+	bridgeOptionMasquerade = "enable_ip_masquerade" // 为 false 时不对出口流量做 MASQUERADE
+)
+
 type BridgeNetworkDriver struct {
 }
 
@@ -17,13 +25,18 @@ func (d *BridgeNetworkDriver) Name() string {
 	return "bridge"
 }
 
-func (d *BridgeNetworkDriver) Create(subnet string, name string) (*Network, error) {
+func (d *BridgeNetworkDriver) Create(subnet string, name string, internal bool, options map[string]string) (*Network, error) {
 	ip, ipRange, _ := net.ParseCIDR(subnet)
 	ipRange.IP = ip
 	n := &Network {
 		Name: name,
 		IpRange: ipRange,
 		Driver: d.Name(),
+		Internal: internal,
+		Options: options,
+	}
+	if err := validateBridgeOptions(n); err != nil {
+		return nil, err
 	}
 	err := d.initBridge(n)
 	if err != nil {
@@ -34,7 +47,10 @@ func (d *BridgeNetworkDriver) Create(subnet string, name string) (*Network, erro
 }
 
 func (d *BridgeNetworkDriver) Delete(network Network) error {
-	bridgeName := network.Name
+	bridgeName := network.bridgeName()
+	if err := currentFirewall().TeardownNetwork(&network); err != nil {
+		log.ConsoleLog.Error("error teardown %s rules for %s: %v", currentFirewall().Name(), bridgeName, err)
+	}
 	br, err := netlink.LinkByName(bridgeName)
 	if err != nil {
 		return err
@@ -43,7 +59,15 @@ func (d *BridgeNetworkDriver) Delete(network Network) error {
 }
 
 func (d *BridgeNetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
-	bridgeName := network.Name
+	mtu, err := bridgeMTU(network)
+	if err != nil {
+		return err
+	}
+	return connectVeth(network.bridgeName(), endpoint, mtu)
+}
+
+// 创建 veth 并把宿主机一端挂到网桥上, mtu 为0时使用默认值
+func connectVeth(bridgeName string, endpoint *Endpoint, mtu int) error {
 	br, err := netlink.LinkByName(bridgeName)
 	if err != nil {
 		return err
@@ -52,6 +76,9 @@ func (d *BridgeNetworkDriver) Connect(network *Network, endpoint *Endpoint) erro
 	la := netlink.NewLinkAttrs()
 	la.Name = endpoint.ID[:5]
 	la.MasterIndex = br.Attrs().Index
+	if mtu > 0 {
+		la.MTU = mtu
+	}
 
 	endpoint.Device = netlink.Veth{
 		LinkAttrs: la,
@@ -65,21 +92,49 @@ func (d *BridgeNetworkDriver) Connect(network *Network, endpoint *Endpoint) erro
 	if err = netlink.LinkSetUp(&endpoint.Device); err != nil {
 		return fmt.Errorf("Error Add Endpoint Device: %v", err)
 	}
+
+	// 允许容器通过宿主机映射的端口访问自己, 数据包需要从同一个网桥端口发回
+	if err = netlink.LinkSetHairpin(&endpoint.Device, true); err != nil {
+		return fmt.Errorf("Error Set Endpoint Device Hairpin: %v", err)
+	}
 	return nil
 }
 
 func (d *BridgeNetworkDriver) Disconnect(network Network, endpoint *Endpoint) error {
+	// 容器退出后 veth 会随 namespace 一起销毁, 这里只清理还残留的宿主机一端
+	vethName := endpoint.ID[:5]
+	veth, err := netlink.LinkByName(vethName)
+	if err != nil {
+		return nil
+	}
+	if err := netlink.LinkDel(veth); err != nil {
+		return fmt.Errorf("Error Remove Endpoint Device %s: %v", vethName, err)
+	}
 	return nil
 }
 
 
 func (d *BridgeNetworkDriver) initBridge(n *Network) error {
 	// try to get bridge by name, if it already exists then just exit
-	bridgeName := n.Name
+	bridgeName := n.bridgeName()
 	if err := createBridgeInterface(bridgeName); err != nil {
 		return fmt.Errorf("Error add bridge： %s, Error: %v", bridgeName, err)
 	}
 
+	mtu, err := bridgeMTU(n)
+	if err != nil {
+		return err
+	}
+	if mtu > 0 {
+		br, err := netlink.LinkByName(bridgeName)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetMTU(br, mtu); err != nil {
+			return fmt.Errorf("Error set mtu of bridge %s: %v", bridgeName, err)
+		}
+	}
+
 	// Set bridge IP
 	gatewayIP := *n.IpRange
 	gatewayIP.IP = n.IpRange.IP
@@ -92,9 +147,20 @@ func (d *BridgeNetworkDriver) initBridge(n *Network) error {
 		return fmt.Errorf("Error set bridge up: %s, Error: %v", bridgeName, err)
 	}
 
-	// Setup iptables
-	if err := setupIPTables(bridgeName, n.IpRange); err != nil {
-		return fmt.Errorf("Error setting iptables for %s: %v", bridgeName, err)
+	// Setup firewall rules
+	if err := currentFirewall().SetupNetwork(n); err != nil {
+		return fmt.Errorf("Error setting %s rules for %s: %v", currentFirewall().Name(), bridgeName, err)
+	}
+
+	if err := setupLocalhostForwarding(bridgeName); err != nil {
+		return err
+	}
+
+	// 同一网桥上的流量默认不经过 iptables, 需要 br_netfilter 才能限制容器互访
+	if n.iccDisabled() {
+		if err := ioutil.WriteFile("/proc/sys/net/bridge/bridge-nf-call-iptables", []byte("1"), 0644); err != nil {
+			return fmt.Errorf("Error enable bridge-nf-call-iptables, is br_netfilter loaded? %v", err)
+		}
 	}
 
 	return nil
@@ -102,7 +168,7 @@ func (d *BridgeNetworkDriver) initBridge(n *Network) error {
 
 // deleteBridge deletes the bridge
 func (d *BridgeNetworkDriver) deleteBridge(n *Network) error {
-	bridgeName := n.Name
+	bridgeName := n.bridgeName()
 
 	// get the link
 	l, err := netlink.LinkByName(bridgeName)
@@ -118,6 +184,41 @@ func (d *BridgeNetworkDriver) deleteBridge(n *Network) error {
 	return nil
 }
 
+// 创建前检查选项, 网桥名不能和其他网络的网桥重复
+func validateBridgeOptions(n *Network) error {
+	if _, err := bridgeMTU(n); err != nil {
+		return err
+	}
+	if raw, ok := n.Options[bridgeOptionMasquerade]; ok {
+		if _, err := strconv.ParseBool(raw); err != nil {
+			return fmt.Errorf("invalid %s %s", bridgeOptionMasquerade, raw)
+		}
+	}
+	bridgeName := n.bridgeName()
+	if len(bridgeName) > 15 {
+		return fmt.Errorf("bridge name %s is longer than 15 characters", bridgeName)
+	}
+	for _, nw := range networks {
+		if nw.Name != n.Name && (nw.Driver == "bridge" || nw.Driver == "overlay") && nw.bridgeName() == bridgeName {
+			return fmt.Errorf("bridge %s is already used by network %s", bridgeName, nw.Name)
+		}
+	}
+	return nil
+}
+
+// 没有指定 mtu 时返回0, 使用内核默认值
+func bridgeMTU(n *Network) (int, error) {
+	raw, ok := n.Options[bridgeOptionMTU]
+	if !ok {
+		return 0, nil
+	}
+	mtu, err := strconv.Atoi(raw)
+	if err != nil || mtu < 68 || mtu > 65535 {
+		return 0, fmt.Errorf("invalid bridge mtu %s", raw)
+	}
+	return mtu, nil
+}
+
 func createBridgeInterface(bridgeName string) error {
 	_, err := net.InterfaceByName(bridgeName)
 	if err == nil || !strings.Contains(err.Error(), "no such network interface") {
@@ -176,13 +277,12 @@ func setInterfaceIP(name string, rawIP string) error {
 	return netlink.AddrAdd(iface, addr)
 }
 
-func setupIPTables(bridgeName string, subnet *net.IPNet) error {
-	iptablesCmd := fmt.Sprintf("-t nat -A POSTROUTING -s %s ! -o %s -j MASQUERADE", subnet.String(), bridgeName)
-	cmd := exec.Command("iptables", strings.Split(iptablesCmd, " ")...)
-	//err := cmd.Run()
-	output, err := cmd.Output()
-	if err != nil {
-		log.ConsoleLog.Error("iptables Output, %v", output)
+// 宿主机通过 localhost 访问映射端口时, 源地址为 127.0.0.1 的包会被 DNAT 到网桥上,
+// 需要打开 route_localnet, 否则会被当作 martian 包丢弃
+func setupLocalhostForwarding(bridgeName string) error {
+	routeLocalnet := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/route_localnet", bridgeName)
+	if err := ioutil.WriteFile(routeLocalnet, []byte("1"), 0644); err != nil {
+		return fmt.Errorf("enable route_localnet on %s: %v", bridgeName, err)
 	}
-	return err
-}
\ No newline at end of file
+	return nil
+}
@@ -0,0 +1,386 @@
+package network
+
+import (
+	"bucket/container"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// cni 驱动的选项
+const (
+	cniOptionConfDir = "cni_conf_dir" // 配置目录, 默认 /etc/cni/net.d
+	cniOptionBinDir  = "cni_bin_dir"  // 插件目录, 多个目录用冒号分隔, 默认 /opt/cni/bin
+	cniOptionNetwork = "cni_network"  // 配置中的网络名, 默认与 bucket 网络同名
+)
+
+var (
+	defaultCNIConfDir  = "/etc/cni/net.d"
+	defaultCNIBinDir   = "/opt/cni/bin"
+	defaultCNICacheDir = "/var/run/bucket/network/cni/"
+	cniIfName          = "eth0"
+)
+
+// 把容器网络交给标准 CNI 插件配置, 地址分配、路由和端口映射都由插件完成,
+// bucket 只负责按 conflist 依次调用插件并保存结果
+type CNINetworkDriver struct {
+}
+
+// conflist 配置, plugins 中每一项原样传给插件
+type cniConfList struct {
+	CNIVersion string                   `json:"cniVersion"`
+	Name       string                   `json:"name"`
+	Plugins    []map[string]interface{} `json:"plugins"`
+}
+
+type CNIInterface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+type CNIIPConfig struct {
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+	Interface *int   `json:"interface,omitempty"`
+}
+
+type CNIRoute struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+type CNIDNS struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+	Domain      string   `json:"domain,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// 插件 ADD 返回的结果
+type CNIResult struct {
+	CNIVersion string          `json:"cniVersion"`
+	Interfaces []*CNIInterface `json:"interfaces,omitempty"`
+	IPs        []*CNIIPConfig  `json:"ips,omitempty"`
+	Routes     []*CNIRoute     `json:"routes,omitempty"`
+	DNS        CNIDNS          `json:"dns,omitempty"`
+}
+
+type cniError struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details,omitempty"`
+}
+
+// portmap 插件通过 runtimeConfig 接收端口映射
+type cniPortMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
+// 一次插件调用的运行时参数
+type cniRuntime struct {
+	ContainerID string
+	NetNS       string
+	IfName      string
+	BinDirs     []string
+	PortMapping []container.PortBinding
+}
+
+func (d *CNINetworkDriver) Name() string {
+	return "cni"
+}
+
+func (d *CNINetworkDriver) Create(subnet string, name string, internal bool, options map[string]string) (*Network, error) {
+	n := &Network{
+		Name:     name,
+		Driver:   d.Name(),
+		Internal: internal,
+		Options:  options,
+	}
+	// 创建时就检查配置, 避免连接容器时才发现找不到
+	if _, err := loadCNIConfList(n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (d *CNINetworkDriver) Delete(network Network) error {
+	return nil
+}
+
+func (d *CNINetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
+	return fmt.Errorf("cni network %s can only be connected with a container", network.Name)
+}
+
+func (d *CNINetworkDriver) Disconnect(network Network, endpoint *Endpoint) error {
+	return nil
+}
+
+// 调用插件 ADD, 把第一个地址作为容器在网络中的地址
+func (d *CNINetworkDriver) ConnectContainer(network *Network, endpoint *Endpoint, cinfo *container.ContainerInfo) error {
+	confList, err := loadCNIConfList(network)
+	if err != nil {
+		return err
+	}
+	rt := d.runtime(network, endpoint, cinfo)
+	result, raw, err := cniAdd(confList, rt)
+	if err != nil {
+		return err
+	}
+	endpoint.CNIResult = result
+	for _, ipc := range result.IPs {
+		if ip, _, err := net.ParseCIDR(ipc.Address); err == nil && ip.To4() != nil {
+			endpoint.IPAddress = ip
+			break
+		}
+	}
+	for _, iface := range result.Interfaces {
+		if iface.Sandbox != "" && iface.Mac != "" {
+			endpoint.MacAddress, _ = net.ParseMAC(iface.Mac)
+		}
+	}
+	// 没有保存结果以后就无法 DEL, 现在就释放插件分配的资源
+	if err := saveCNIResult(endpoint.ID, raw); err != nil {
+		_ = cniDel(confList, rt, raw)
+		return fmt.Errorf("save cni result error: %v", err)
+	}
+	return nil
+}
+
+// 调用插件 DEL, 容器的 namespace 已经不存在时插件也应该能释放资源
+func (d *CNINetworkDriver) DisconnectContainer(network *Network, endpoint *Endpoint, cinfo *container.ContainerInfo) error {
+	confList, err := loadCNIConfList(network)
+	if err != nil {
+		return err
+	}
+	prevResult, _ := loadCNIResult(endpoint.ID)
+	if err := cniDel(confList, d.runtime(network, endpoint, cinfo), prevResult); err != nil {
+		return err
+	}
+	return os.RemoveAll(path.Join(defaultCNICacheDir, endpoint.ID))
+}
+
+// 调用插件 CHECK 检查容器网络是否和 ADD 的结果一致
+func (d *CNINetworkDriver) CheckContainer(network *Network, endpoint *Endpoint, cinfo *container.ContainerInfo) error {
+	confList, err := loadCNIConfList(network)
+	if err != nil {
+		return err
+	}
+	prevResult, err := loadCNIResult(endpoint.ID)
+	if err != nil {
+		return fmt.Errorf("no cached result for %s: %v", endpoint.ID, err)
+	}
+	return cniCheck(confList, d.runtime(network, endpoint, cinfo), prevResult)
+}
+
+func (d *CNINetworkDriver) runtime(network *Network, endpoint *Endpoint, cinfo *container.ContainerInfo) *cniRuntime {
+	binDir := network.Options[cniOptionBinDir]
+	if binDir == "" {
+		binDir = defaultCNIBinDir
+	}
+	return &cniRuntime{
+		ContainerID: cinfo.Id,
+		NetNS:       fmt.Sprintf("/proc/%s/ns/net", strings.TrimSpace(cinfo.Pid)),
+		IfName:      cniIfName,
+		BinDirs:     strings.Split(binDir, ":"),
+		PortMapping: endpoint.PortMapping,
+	}
+}
+
+// 在配置目录中查找与网络同名的 conflist, 单个插件的 .conf 文件会被当作只有一个插件的 conflist
+func loadCNIConfList(network *Network) (*cniConfList, error) {
+	confDir := network.Options[cniOptionConfDir]
+	if confDir == "" {
+		confDir = defaultCNIConfDir
+	}
+	name := network.Options[cniOptionNetwork]
+	if name == "" {
+		name = network.Name
+	}
+
+	files, err := ioutil.ReadDir(confDir)
+	if err != nil {
+		return nil, fmt.Errorf("read cni config dir %s: %v", confDir, err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+
+	for _, fileName := range names {
+		ext := filepath.Ext(fileName)
+		if ext != ".conflist" && ext != ".conf" && ext != ".json" {
+			continue
+		}
+		content, err := ioutil.ReadFile(path.Join(confDir, fileName))
+		if err != nil {
+			return nil, err
+		}
+		confList := &cniConfList{}
+		if ext == ".conflist" {
+			if err := json.Unmarshal(content, confList); err != nil {
+				return nil, fmt.Errorf("parse %s: %v", fileName, err)
+			}
+		} else {
+			plugin := map[string]interface{}{}
+			if err := json.Unmarshal(content, &plugin); err != nil {
+				return nil, fmt.Errorf("parse %s: %v", fileName, err)
+			}
+			confList.Name, _ = plugin["name"].(string)
+			confList.CNIVersion, _ = plugin["cniVersion"].(string)
+			confList.Plugins = []map[string]interface{}{plugin}
+		}
+		if confList.Name != name {
+			continue
+		}
+		if len(confList.Plugins) == 0 {
+			return nil, fmt.Errorf("cni network %s in %s has no plugins", name, fileName)
+		}
+		for _, plugin := range confList.Plugins {
+			if t, _ := plugin["type"].(string); t == "" {
+				return nil, fmt.Errorf("cni network %s in %s has a plugin without type", name, fileName)
+			}
+		}
+		return confList, nil
+	}
+	return nil, fmt.Errorf("no cni network named %s in %s", name, confDir)
+}
+
+// 返回解析后的结果和插件输出的原文, 原文作为之后 DEL 和 CHECK 的 prevResult
+func cniAdd(confList *cniConfList, rt *cniRuntime) (*CNIResult, json.RawMessage, error) {
+	var prevResult json.RawMessage
+	for _, plugin := range confList.Plugins {
+		output, err := execCNIPlugin("ADD", confList, plugin, rt, prevResult)
+		if err != nil {
+			// 失败时回滚已经执行的插件
+			_ = cniDel(confList, rt, prevResult)
+			return nil, nil, err
+		}
+		prevResult = output
+	}
+	result := &CNIResult{}
+	if err := json.Unmarshal(prevResult, result); err != nil {
+		_ = cniDel(confList, rt, prevResult)
+		return nil, nil, fmt.Errorf("parse cni result: %v", err)
+	}
+	return result, prevResult, nil
+}
+
+func cniDel(confList *cniConfList, rt *cniRuntime, prevResult json.RawMessage) error {
+	var lastErr error
+	for i := len(confList.Plugins) - 1; i >= 0; i-- {
+		if _, err := execCNIPlugin("DEL", confList, confList.Plugins[i], rt, prevResult); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func cniCheck(confList *cniConfList, rt *cniRuntime, prevResult json.RawMessage) error {
+	for _, plugin := range confList.Plugins {
+		if _, err := execCNIPlugin("CHECK", confList, plugin, rt, prevResult); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按 CNI 规范调用插件: 参数通过环境变量传递, 网络配置写入 stdin, 结果或错误从 stdout 读取
+func execCNIPlugin(command string, confList *cniConfList, plugin map[string]interface{}, rt *cniRuntime, prevResult json.RawMessage) (json.RawMessage, error) {
+	pluginType, _ := plugin["type"].(string)
+	pluginPath, err := findCNIPlugin(pluginType, rt.BinDirs)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := map[string]interface{}{}
+	for k, v := range plugin {
+		conf[k] = v
+	}
+	conf["name"] = confList.Name
+	conf["cniVersion"] = confList.CNIVersion
+	if prevResult != nil {
+		conf["prevResult"] = prevResult
+	}
+	if capabilities, ok := plugin["capabilities"].(map[string]interface{}); ok {
+		if enabled, _ := capabilities["portMappings"].(bool); enabled {
+			var portMappings []cniPortMapping
+			for _, pb := range rt.PortMapping {
+				portMappings = append(portMappings, cniPortMapping{
+					HostPort:      pb.HostPort,
+					ContainerPort: pb.ContainerPort,
+					Protocol:      pb.Protocol,
+					HostIP:        pb.HostIP,
+				})
+			}
+			conf["runtimeConfig"] = map[string]interface{}{"portMappings": portMappings}
+		}
+	}
+	stdin, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(pluginPath)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+rt.ContainerID,
+		"CNI_NETNS="+rt.NetNS,
+		"CNI_IFNAME="+rt.IfName,
+		"CNI_PATH="+strings.Join(rt.BinDirs, ":"),
+	)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		pluginErr := &cniError{}
+		if json.Unmarshal(stdout.Bytes(), pluginErr) == nil && pluginErr.Msg != "" {
+			return nil, fmt.Errorf("cni plugin %s %s failed: %s (code %d) %s", pluginType, command, pluginErr.Msg, pluginErr.Code, pluginErr.Details)
+		}
+		return nil, fmt.Errorf("cni plugin %s %s failed: %v, %s", pluginType, command, err, strings.TrimSpace(stderr.String()))
+	}
+	if command != "ADD" {
+		return nil, nil
+	}
+	return json.RawMessage(stdout.Bytes()), nil
+}
+
+func findCNIPlugin(pluginType string, binDirs []string) (string, error) {
+	for _, dir := range binDirs {
+		pluginPath := path.Join(dir, pluginType)
+		if info, err := os.Stat(pluginPath); err == nil && !info.IsDir() {
+			return pluginPath, nil
+		}
+	}
+	return "", fmt.Errorf("cni plugin %s not found in %s", pluginType, strings.Join(binDirs, ":"))
+}
+
+// DEL 和 CHECK 需要 ADD 的结果作为 prevResult, 按端点原样保存到缓存目录,
+// CNIResult 中没有的字段也要传回给插件
+func saveCNIResult(endpointID string, result json.RawMessage) error {
+	if err := os.MkdirAll(defaultCNICacheDir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(defaultCNICacheDir, endpointID), result, 0644)
+}
+
+func loadCNIResult(endpointID string) (json.RawMessage, error) {
+	content, err := ioutil.ReadFile(path.Join(defaultCNICacheDir, endpointID))
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(content), nil
+}
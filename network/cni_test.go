@@ -0,0 +1,114 @@
+package network
+
+import (
+	"bucket/container"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// 假插件把调用的命令和 stdin 记录到文件中, ADD 时返回固定的结果
+const fakeCNIPlugin = `#!/bin/sh
+input=$(cat)
+echo "$CNI_COMMAND $CNI_CONTAINERID $CNI_NETNS $CNI_IFNAME" >> "$(dirname "$0")/calls"
+echo "$input" >> "$(dirname "$0")/stdin"
+if [ "$CNI_COMMAND" = "ADD" ]; then
+	echo '{"cniVersion":"0.4.0","interfaces":[{"name":"eth0","mac":"02:42:0a:16:00:05","sandbox":"'$CNI_NETNS'","mtu":1400}],"ips":[{"address":"10.22.0.5/16","gateway":"10.22.0.1","interface":0}],"dns":{"nameservers":["10.22.0.1"]}}'
+fi
+`
+
+// 在临时目录中准备假插件和名为 testnet 的配置, 返回临时目录和网络选项
+func setupFakeCNI(t *testing.T) (string, map[string]string) {
+	dir, err := ioutil.TempDir("", "bucket-cni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binDir := path.Join(dir, "bin")
+	confDir := path.Join(dir, "net.d")
+	_ = os.MkdirAll(binDir, 0755)
+	_ = os.MkdirAll(confDir, 0755)
+	if err := ioutil.WriteFile(path.Join(binDir, "fake"), []byte(fakeCNIPlugin), 0755); err != nil {
+		t.Fatal(err)
+	}
+	conf := `{"cniVersion":"0.4.0","name":"testnet","plugins":[{"type":"fake"},{"type":"fake","capabilities":{"portMappings":true}}]}`
+	if err := ioutil.WriteFile(path.Join(confDir, "10-test.conflist"), []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defaultCNICacheDir = path.Join(dir, "cache")
+	return dir, map[string]string{cniOptionConfDir: confDir, cniOptionBinDir: binDir}
+}
+
+func TestCNIDriver(t *testing.T) {
+	dir, options := setupFakeCNI(t)
+	defer os.RemoveAll(dir)
+	binDir := options[cniOptionBinDir]
+
+	d := &CNINetworkDriver{}
+	nw, err := d.Create("", "testnet", false, options)
+	if err != nil {
+		t.Fatalf("create cni network error: %v", err)
+	}
+	cinfo := &container.ContainerInfo{Id: "1234567890", Pid: "1"}
+	ep := &Endpoint{
+		ID:          "1234567890-testnet",
+		Network:     nw,
+		PortMapping: []container.PortBinding{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+	}
+	if err := d.ConnectContainer(nw, ep, cinfo); err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	if ep.IPAddress.String() != "10.22.0.5" || ep.CNIResult.DNS.Nameservers[0] != "10.22.0.1" {
+		t.Errorf("unexpected endpoint %v %v", ep.IPAddress, ep.CNIResult)
+	}
+	// 保存的是插件输出的原文, 不在 CNIResult 中的字段也会作为 prevResult 传回
+	if cached, err := ioutil.ReadFile(path.Join(defaultCNICacheDir, ep.ID)); err != nil || !strings.Contains(string(cached), `"mtu":1400`) {
+		t.Errorf("unexpected cached result %s %v", cached, err)
+	}
+	if err := d.CheckContainer(nw, ep, cinfo); err != nil {
+		t.Fatalf("check error: %v", err)
+	}
+	if err := d.DisconnectContainer(nw, ep, cinfo); err != nil {
+		t.Fatalf("disconnect error: %v", err)
+	}
+
+	calls, _ := ioutil.ReadFile(path.Join(binDir, "calls"))
+	lines := strings.Split(strings.TrimSpace(string(calls)), "\n")
+	expect := []string{"ADD", "ADD", "CHECK", "CHECK", "DEL", "DEL"}
+	if len(lines) != len(expect) {
+		t.Fatalf("unexpected calls %q", lines)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, expect[i]+" 1234567890 /proc/1/ns/net eth0") {
+			t.Errorf("unexpected call %q", line)
+		}
+	}
+
+	// 第二个插件声明了 portMappings, 应该收到 runtimeConfig 和第一个插件的结果
+	stdin, _ := ioutil.ReadFile(path.Join(binDir, "stdin"))
+	second := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(strings.Split(string(stdin), "\n")[1]), &second); err != nil {
+		t.Fatal(err)
+	}
+	if second["prevResult"] == nil || second["runtimeConfig"] == nil || second["name"] != "testnet" {
+		t.Errorf("unexpected plugin config %v", second)
+	}
+
+	// 结果保存失败时要 DEL, 插件分配的资源不会泄漏
+	_ = os.Remove(path.Join(binDir, "calls"))
+	_ = ioutil.WriteFile(path.Join(dir, "file"), nil, 0644)
+	defaultCNICacheDir = path.Join(dir, "file", "cache")
+	if err := d.ConnectContainer(nw, ep, cinfo); err == nil {
+		t.Fatalf("connect should fail when the result can not be saved")
+	}
+	calls, _ = ioutil.ReadFile(path.Join(binDir, "calls"))
+	var commands []string
+	for _, line := range strings.Split(strings.TrimSpace(string(calls)), "\n") {
+		commands = append(commands, strings.Fields(line)[0])
+	}
+	if strings.Join(commands, " ") != "ADD ADD DEL DEL" {
+		t.Errorf("unexpected calls after save failure %q", commands)
+	}
+}
@@ -0,0 +1,52 @@
+package network
+
+import (
+	"bucket/container"
+	"bucket/log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// 防火墙后端, 负责网络的 NAT 规则和端口映射
+type Firewall interface {
+	Name() string
+	SetupNetwork(nw *Network) error
+	TeardownNetwork(nw *Network) error
+	AddPortMapping(containerIP net.IP, pb container.PortBinding) error
+	RemovePortMapping(containerIP net.IP, pb container.PortBinding) error
+	// 清空 bucket 管理的全部规则, 之后由调用方重新添加
+	Reset() error
+}
+
+var firewallBackend Firewall
+
+func currentFirewall() Firewall {
+	if firewallBackend == nil {
+		firewallBackend = detectFirewall()
+		log.ConsoleLog.Debug("use %s firewall backend", firewallBackend.Name())
+	}
+	return firewallBackend
+}
+
+// 可以通过 BUCKET_FIREWALL 环境变量指定后端, 否则没有 iptables 命令
+// 或者 iptables 只是 nf_tables 的兼容层时直接使用 nftables
+func detectFirewall() Firewall {
+	switch os.Getenv("BUCKET_FIREWALL") {
+	case "iptables":
+		return &IptablesFirewall{}
+	case "nftables":
+		return &NftablesFirewall{}
+	}
+
+	iptablesPath, err := exec.LookPath("iptables")
+	if err != nil {
+		return &NftablesFirewall{}
+	}
+	output, err := exec.Command(iptablesPath, "-V").CombinedOutput()
+	if err == nil && strings.Contains(string(output), "nf_tables") {
+		return &NftablesFirewall{}
+	}
+	return &IptablesFirewall{}
+}
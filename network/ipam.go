@@ -2,6 +2,9 @@ package network
 
 import (
 	"bucket/log"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"path"
@@ -28,20 +31,13 @@ func (ipam *IPAM) load() error {
 			return err
 		}
 	}
-	subnetConfigFile, err := os.Open(ipam.SubnetAllocatorPath)
-	defer func() {
-		_ = subnetConfigFile.Close()
-	}()
-	if err != nil {
-		return err
-	}
-	subnetJson := make([]byte, 2000)
-	n, err := subnetConfigFile.Read(subnetJson)
+	// 大网段的位图超过几千字节, 需要完整读取
+	subnetJson, err := ioutil.ReadFile(ipam.SubnetAllocatorPath)
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(subnetJson[:n], ipam.Subnets)
+	err = json.Unmarshal(subnetJson, ipam.Subnets)
 	if err != nil {
 		log.ConsoleLog.Error("Error dump allocation info, %v", err)
 		return err
@@ -80,6 +76,11 @@ func (ipam *IPAM) dump() error {
 }
 
 func (ipam *IPAM) Allocate(subnet *net.IPNet) (ip net.IP, err error) {
+	return ipam.AllocateInRange(subnet, nil)
+}
+
+// 从 pool 中分配地址, pool 为 nil 时使用整个网段
+func (ipam *IPAM) AllocateInRange(subnet *net.IPNet, pool *net.IPNet) (ip net.IP, err error) {
 	// 存放网段中地址分配信息的数组
 	ipam.Subnets = &map[string]string{}
 
@@ -90,31 +91,85 @@ func (ipam *IPAM) Allocate(subnet *net.IPNet) (ip net.IP, err error) {
 	}
 
 	_, subnet, _ = net.ParseCIDR(subnet.String())
+	ipam.initSubnet(subnet)
+	ipalloc := []byte((*ipam.Subnets)[subnet.String()])
 
-	one, size := subnet.Mask.Size()
-
-	if _, exist := (*ipam.Subnets)[subnet.String()]; !exist {
-		(*ipam.Subnets)[subnet.String()] = strings.Repeat("0", 1 << uint8(size - one))
+	// 位图下标 c 对应的地址是网段地址 + c + 1, 最后两个下标是广播地址和下一个网段, 不分配
+	first, last := 0, len(ipalloc)-3
+	if pool != nil {
+		_, pool, _ = net.ParseCIDR(pool.String())
+		ones, bits := pool.Mask.Size()
+		poolFirst := ipIndex(subnet, pool.IP)
+		poolLast := poolFirst + 1<<uint(bits-ones) - 1
+		if poolFirst > first {
+			first = poolFirst
+		}
+		if poolLast < last {
+			last = poolLast
+		}
 	}
 
-	for c := range (*ipam.Subnets)[subnet.String()] {
-		if (*ipam.Subnets)[subnet.String()][c] == '0' {
-			ipalloc := []byte((*ipam.Subnets)[subnet.String()])
+	for c := first; c <= last; c++ {
+		if ipalloc[c] == '0' {
 			ipalloc[c] = '1'
 			(*ipam.Subnets)[subnet.String()] = string(ipalloc)
-			ip = subnet.IP
-			for t := uint(4); t > 0; t-=1 {
-				[]byte(ip)[4-t] += uint8(c >> ((t - 1) * 8))
-			}
-			ip[3]+=1
+			ip = uint32ToIP(ipToUint32(subnet.IP) + uint32(c) + 1)
 			break
 		}
 	}
+	if ip == nil {
+		return nil, fmt.Errorf("no available ip in %s", subnet.String())
+	}
 
 	err = ipam.dump()
 	return
 }
 
+// 分配指定的地址, 例如用户指定的网关
+func (ipam *IPAM) Reserve(subnet *net.IPNet, ip net.IP) error {
+	ipam.Subnets = &map[string]string{}
+	if err := ipam.load(); err != nil {
+		log.ConsoleLog.Error("Error dump allocation info, %v", err)
+	}
+
+	_, subnet, _ = net.ParseCIDR(subnet.String())
+	ipam.initSubnet(subnet)
+	ipalloc := []byte((*ipam.Subnets)[subnet.String()])
+
+	c := ipIndex(subnet, ip)
+	if !subnet.Contains(ip) || c < 0 || c > len(ipalloc)-3 {
+		return fmt.Errorf("ip %s is not a host address of %s", ip, subnet.String())
+	}
+	if ipalloc[c] == '1' {
+		return fmt.Errorf("ip %s is already in use", ip)
+	}
+	ipalloc[c] = '1'
+	(*ipam.Subnets)[subnet.String()] = string(ipalloc)
+	return ipam.dump()
+}
+
+func (ipam *IPAM) initSubnet(subnet *net.IPNet) {
+	one, size := subnet.Mask.Size()
+	if _, exist := (*ipam.Subnets)[subnet.String()]; !exist {
+		(*ipam.Subnets)[subnet.String()] = strings.Repeat("0", 1 << uint8(size - one))
+	}
+}
+
+// 地址在网段位图中的下标, 网段地址本身不参与分配
+func ipIndex(subnet *net.IPNet, ip net.IP) int {
+	return int(ipToUint32(ip)) - int(ipToUint32(subnet.IP)) - 1
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
 func (ipam *IPAM) Release(subnet *net.IPNet, ipaddr *net.IP) error {
 	ipam.Subnets = &map[string]string{}
 
@@ -125,14 +180,11 @@ func (ipam *IPAM) Release(subnet *net.IPNet, ipaddr *net.IP) error {
 		log.ConsoleLog.Error("Error dump allocation info, %v", err)
 	}
 
-	c := 0
-	releaseIP := ipaddr.To4()
-	releaseIP[3]-=1
-	for t := uint(4); t > 0; t-=1 {
-		c += int(releaseIP[t-1] - subnet.IP[t-1]) << ((4-t) * 8)
-	}
-
+	c := ipIndex(subnet, *ipaddr)
 	ipalloc := []byte((*ipam.Subnets)[subnet.String()])
+	if c < 0 || c >= len(ipalloc) {
+		return fmt.Errorf("ip %s is not in %s", ipaddr.String(), subnet.String())
+	}
 	ipalloc[c] = '0'
 	(*ipam.Subnets)[subnet.String()] = string(ipalloc)
 
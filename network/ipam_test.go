@@ -1,17 +1,109 @@
 package network
 
 import (
+	"io/ioutil"
 	"net"
+	"os"
+	"path"
 	"testing"
 )
 
 func TestIPAM_Allocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ipam := &IPAM{SubnetAllocatorPath: path.Join(dir, "subnet.json")}
+
 	_, ipnet, _ := net.ParseCIDR("192.168.0.0/24")
-	ip, _ := ipAllocator.Allocate(ipnet)
-	t.Logf("alloc ip: %v", ip)
+	for _, expect := range []string{"192.168.0.1", "192.168.0.2"} {
+		ip, err := ipam.Allocate(ipnet)
+		if err != nil || ip.String() != expect {
+			t.Errorf("alloc ip: %v %v, expect %s", ip, err, expect)
+		}
+	}
+	// 分配结果持久化, 新的 IPAM 从文件中接着分配
+	again := &IPAM{SubnetAllocatorPath: ipam.SubnetAllocatorPath}
+	if ip, err := again.Allocate(ipnet); err != nil || ip.String() != "192.168.0.3" {
+		t.Errorf("alloc ip after reload: %v %v", ip, err)
+	}
 }
 
 func TestIPAM_Release(t *testing.T) {
-	ip, ipnet, _ := net.ParseCIDR("192.168.0.1/24")
-	ipAllocator.Release(ipnet, &ip)
+	dir, err := ioutil.TempDir("", "bucket-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ipam := &IPAM{SubnetAllocatorPath: path.Join(dir, "subnet.json")}
+
+	_, ipnet, _ := net.ParseCIDR("192.168.0.0/24")
+	first, _ := ipam.Allocate(ipnet)
+	_, _ = ipam.Allocate(ipnet)
+	if err := ipam.Release(ipnet, &first); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := ipam.Allocate(ipnet); err != nil || !ip.Equal(first) {
+		t.Errorf("released ip should be allocated again: %v %v", ip, err)
+	}
+	outside := net.ParseIP("192.168.1.1")
+	if err := ipam.Release(ipnet, &outside); err == nil {
+		t.Error("expect release ip out of subnet to fail")
+	}
+}
+
+func TestIPAMAllocateInRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ipam := &IPAM{SubnetAllocatorPath: path.Join(dir, "subnet.json")}
+
+	_, subnet, _ := net.ParseCIDR("172.30.0.0/16")
+	_, pool, _ := net.ParseCIDR("172.30.5.0/30")
+
+	if err := ipam.Reserve(subnet, net.ParseIP("172.30.5.1")); err != nil {
+		t.Fatalf("reserve error: %v", err)
+	}
+	if err := ipam.Reserve(subnet, net.ParseIP("172.30.5.1")); err == nil {
+		t.Error("expect reserve used ip to fail")
+	}
+	if err := ipam.Reserve(subnet, net.ParseIP("172.31.0.1")); err == nil {
+		t.Error("expect reserve ip out of subnet to fail")
+	}
+
+	// 池中网关已被占用, 只剩 .0 .2 .3 三个地址
+	var got []string
+	for i := 0; i < 3; i++ {
+		ip, err := ipam.AllocateInRange(subnet, pool)
+		if err != nil {
+			t.Fatalf("allocate error: %v", err)
+		}
+		got = append(got, ip.String())
+	}
+	if got[0] != "172.30.5.0" || got[1] != "172.30.5.2" || got[2] != "172.30.5.3" {
+		t.Errorf("unexpected ips %v", got)
+	}
+	if _, err := ipam.AllocateInRange(subnet, pool); err == nil {
+		t.Error("expect exhausted pool to fail")
+	}
+
+	released := net.ParseIP("172.30.5.2")
+	if err := ipam.Release(subnet, &released); err != nil {
+		t.Fatal(err)
+	}
+	if released.String() != "172.30.5.2" {
+		t.Errorf("release should not modify ip, got %s", released)
+	}
+	if ip, err := ipam.AllocateInRange(subnet, pool); err != nil || ip.String() != "172.30.5.2" {
+		t.Errorf("unexpected reallocate result %v %v", ip, err)
+	}
+
+	// 跨过 .255 时需要进位
+	_, bigPool, _ := net.ParseCIDR("172.30.6.255/32")
+	if ip, err := ipam.AllocateInRange(subnet, bigPool); err != nil || ip.String() != "172.30.6.255" {
+		t.Errorf("unexpected allocate result %v %v", ip, err)
+	}
 }
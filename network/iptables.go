@@ -0,0 +1,244 @@
+package network
+
+import (
+	"bucket/container"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// bucket 的规则都放在自己的链里, 内置链只保留跳转规则
+const (
+	// nat 表, 端口映射的 DNAT 规则, 由 PREROUTING 和 OUTPUT 中目的地址为本机的流量跳入
+	chainBucket = "BUCKET"
+	// filter 表, 网络之间的隔离规则, 由 FORWARD 跳入
+	chainIsolation = "BUCKET-ISOLATION"
+	// filter 表, 从一个 bucket 网桥出来要进入其他 bucket 网桥的流量在这里丢弃
+	chainIsolationStage2 = "BUCKET-ISOLATION-STAGE-2"
+	// nat 表, 网络的 MASQUERADE 和 hairpin 规则, 由 POSTROUTING 跳入
+	chainPostrouting = "BUCKET-POSTROUTING"
+)
+
+type iptablesRule struct {
+	table string
+	chain string
+	args  []string
+}
+
+func (r iptablesRule) String() string {
+	return fmt.Sprintf("-t %s %s %s", r.table, r.chain, strings.Join(r.args, " "))
+}
+
+// 内置链到 bucket 链的跳转规则
+var jumpRules = []iptablesRule{
+	{table: "nat", chain: "PREROUTING", args: []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", chainBucket}},
+	{table: "nat", chain: "OUTPUT", args: []string{"-m", "addrtype", "--dst-type", "LOCAL", "-j", chainBucket}},
+	{table: "nat", chain: "POSTROUTING", args: []string{"-j", chainPostrouting}},
+	{table: "filter", chain: "FORWARD", args: []string{"-j", chainIsolation}},
+}
+
+func iptables(args ...string) error {
+	output, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %v, %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func chainExists(table, chain string) bool {
+	return exec.Command("iptables", "-t", table, "-n", "-L", chain).Run() == nil
+}
+
+func ruleExists(rule iptablesRule) bool {
+	args := append([]string{"-t", rule.table, "-C", rule.chain}, rule.args...)
+	return exec.Command("iptables", args...).Run() == nil
+}
+
+func ensureChain(table, chain string) error {
+	if chainExists(table, chain) {
+		return nil
+	}
+	return iptables("-t", table, "-N", chain)
+}
+
+// 规则不存在时才追加, 重复执行不会产生重复规则
+func appendRule(rule iptablesRule) error {
+	if ruleExists(rule) {
+		return nil
+	}
+	return iptables(append([]string{"-t", rule.table, "-A", rule.chain}, rule.args...)...)
+}
+
+// 规则不存在时插入到链的最前面
+func insertRule(rule iptablesRule) error {
+	if ruleExists(rule) {
+		return nil
+	}
+	return iptables(append([]string{"-t", rule.table, "-I", rule.chain, "1"}, rule.args...)...)
+}
+
+// 按规则内容删除, 规则不存在时直接返回
+func deleteRule(rule iptablesRule) error {
+	if !ruleExists(rule) {
+		return nil
+	}
+	return iptables(append([]string{"-t", rule.table, "-D", rule.chain}, rule.args...)...)
+}
+
+var bucketChains = []iptablesRule{
+	{table: "nat", chain: chainBucket},
+	{table: "nat", chain: chainPostrouting},
+	{table: "filter", chain: chainIsolation},
+	{table: "filter", chain: chainIsolationStage2},
+}
+
+// 创建 bucket 的链并挂到内置链上
+func setupChains() error {
+	for _, c := range bucketChains {
+		if err := ensureChain(c.table, c.chain); err != nil {
+			return err
+		}
+	}
+	for _, rule := range jumpRules {
+		if err := insertRule(rule); err != nil {
+			return err
+		}
+	}
+	for _, chain := range []string{chainIsolation, chainIsolationStage2} {
+		if err := appendRule(iptablesRule{table: "filter", chain: chain, args: []string{"-j", "RETURN"}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filter 表中的链以 RETURN 结尾, 规则需要插入到最前面
+func addRule(rule iptablesRule) error {
+	if rule.table == "filter" {
+		return insertRule(rule)
+	}
+	return appendRule(rule)
+}
+
+// 清空 bucket 的链, 用于根据持久化的网络重建规则
+func flushChains() error {
+	for _, c := range bucketChains {
+		if !chainExists(c.table, c.chain) {
+			continue
+		}
+		if err := iptables("-t", c.table, "-F", c.chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 通过 iptables 命令管理规则的防火墙后端
+type IptablesFirewall struct {
+}
+
+func (f *IptablesFirewall) Name() string {
+	return "iptables"
+}
+
+func (f *IptablesFirewall) SetupNetwork(nw *Network) error {
+	if err := setupChains(); err != nil {
+		return err
+	}
+	for _, rule := range networkRules(nw) {
+		if err := addRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *IptablesFirewall) TeardownNetwork(nw *Network) error {
+	for _, rule := range networkRules(nw) {
+		if err := deleteRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *IptablesFirewall) AddPortMapping(containerIP net.IP, pb container.PortBinding) error {
+	if err := setupChains(); err != nil {
+		return err
+	}
+	var added []iptablesRule
+	for _, rule := range portMappingRules(containerIP, pb) {
+		if err := appendRule(rule); err != nil {
+			// 回滚已经添加的规则
+			for _, r := range added {
+				_ = deleteRule(r)
+			}
+			return err
+		}
+		added = append(added, rule)
+	}
+	return nil
+}
+
+func (f *IptablesFirewall) RemovePortMapping(containerIP net.IP, pb container.PortBinding) error {
+	var lastErr error
+	for _, rule := range portMappingRules(containerIP, pb) {
+		if err := deleteRule(rule); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (f *IptablesFirewall) Reset() error {
+	if err := flushChains(); err != nil {
+		return err
+	}
+	return setupChains()
+}
+
+// 网络需要的规则:
+// 隔离: 从本网桥出去进入其他 bucket 网桥的流量跳到 STAGE-2 丢弃
+// 出口: 普通网络做 MASQUERADE(enable_ip_masquerade=false 时不做), 内部网络丢弃所有进出网桥的转发流量
+// icc=false 时丢弃网桥内部容器之间的流量
+// localhost: 宿主机通过 localhost 访问映射端口时需要的源地址伪装
+func networkRules(nw *Network) []iptablesRule {
+	bridgeName := nw.bridgeName()
+	rules := []iptablesRule{
+		{table: "filter", chain: chainIsolation, args: []string{"-i", bridgeName, "!", "-o", bridgeName, "-j", chainIsolationStage2}},
+		{table: "filter", chain: chainIsolationStage2, args: []string{"-o", bridgeName, "-j", "DROP"}},
+		{table: "nat", chain: chainPostrouting, args: []string{"-s", "127.0.0.0/8", "-o", bridgeName, "-j", "MASQUERADE"}},
+	}
+	if nw.Internal {
+		rules = append(rules,
+			iptablesRule{table: "filter", chain: chainIsolation, args: []string{"-i", bridgeName, "!", "-o", bridgeName, "-j", "DROP"}},
+			iptablesRule{table: "filter", chain: chainIsolation, args: []string{"!", "-i", bridgeName, "-o", bridgeName, "-j", "DROP"}},
+		)
+	} else if !nw.masqueradeDisabled() {
+		rules = append(rules, iptablesRule{table: "nat", chain: chainPostrouting,
+			args: []string{"-s", nw.IpRange.String(), "!", "-o", bridgeName, "-j", "MASQUERADE"}})
+	}
+	if nw.iccDisabled() {
+		rules = append(rules, iptablesRule{table: "filter", chain: chainIsolation,
+			args: []string{"-i", bridgeName, "-o", bridgeName, "-j", "DROP"}})
+	}
+	return rules
+}
+
+// 每个端口映射需要两条 nat 规则:
+// BUCKET 中的 DNAT 处理外部、其他容器和宿主机自身(包括 localhost)访问宿主机端口的流量,
+// BUCKET-POSTROUTING 中的 MASQUERADE 让容器通过宿主机端口访问自己(hairpin)时回包能经过宿主机
+func portMappingRules(containerIP net.IP, pb container.PortBinding) []iptablesRule {
+	dnat := fmt.Sprintf("-p %s -m %s", pb.Protocol, pb.Protocol)
+	if pb.HostIP != "" {
+		dnat += " -d " + pb.HostIP
+	}
+	dnat += fmt.Sprintf(" --dport %d -j DNAT --to-destination %s:%d", pb.HostPort, containerIP.String(), pb.ContainerPort)
+	hairpin := fmt.Sprintf("-s %s -d %s -p %s -m %s --dport %d -j MASQUERADE",
+		containerIP.String(), containerIP.String(), pb.Protocol, pb.Protocol, pb.ContainerPort)
+	return []iptablesRule{
+		{table: "nat", chain: chainBucket, args: strings.Split(dnat, " ")},
+		{table: "nat", chain: chainPostrouting, args: strings.Split(hairpin, " ")},
+	}
+}
@@ -7,9 +7,9 @@ import (
 	"fmt"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
+	"io/ioutil"
 	"net"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
@@ -29,7 +29,8 @@ type Endpoint struct {
 	IPAddress net.IP `json:"ip"`
 	MacAddress net.HardwareAddr `json:"mac"`
 	Network    *Network
-	PortMapping []string
+	PortMapping []container.PortBinding
+	CNIResult *CNIResult `json:"cniResult,omitempty"`
 }
 
 
@@ -38,16 +39,70 @@ type Network struct {
 	Name string
 	IpRange *net.IPNet
 	Driver string
+	Internal bool // 内部网络, 没有出口 NAT 和默认路由
+	IPPool *net.IPNet // 容器地址的分配范围, 为空时使用整个网段
+	Options map[string]string // 驱动选项, 例如 com.bucket.icc=false
+	Endpoints map[string]*NetworkEndpoint // 已连接的容器, 以容器ID为key
+}
+
+// 持久化在网络中的容器端点
+type NetworkEndpoint struct {
+	EndpointID    string                  `json:"endpointId"`
+	ContainerID   string                  `json:"containerId"`
+	ContainerName string                  `json:"containerName"`
+	IPAddress     net.IP                  `json:"ip"`
+	MacAddress    string                  `json:"mac"`
+	PortMapping   []container.PortBinding `json:"ports,omitempty"`
+	CNIResult     *CNIResult              `json:"cniResult,omitempty"`
+}
+
+// network inspect 的输出
+type NetworkInspect struct {
+	Name       string                      `json:"name"`
+	Driver     string                      `json:"driver"`
+	Subnet     string                      `json:"subnet,omitempty"`
+	Gateway    string                      `json:"gateway,omitempty"`
+	IPRange    string                      `json:"ipRange,omitempty"`
+	Internal   bool                        `json:"internal"`
+	Options    map[string]string           `json:"options"`
+	Containers map[string]*NetworkEndpoint `json:"containers"`
+}
+
+// 为 false 时禁止同一网络内的容器互相访问
+const optionICC = "com.bucket.icc"
+
+func (nw *Network) iccDisabled() bool {
+	return nw.Options[optionICC] == "false"
+}
+
+// 网桥名默认和网络名相同, 可以通过 bridge_name 选项指定
+func (nw *Network) bridgeName() string {
+	if name := nw.Options[bridgeOptionName]; name != "" {
+		return name
+	}
+	return nw.Name
+}
+
+func (nw *Network) masqueradeDisabled() bool {
+	return nw.Options[bridgeOptionMasquerade] == "false"
 }
 
 type NetworkDriver interface {
 	Name() string
-	Create(subnet string, name string) (*Network, error)
+	Create(subnet string, name string, internal bool, options map[string]string) (*Network, error)
 	Delete(network Network) error
 	Connect(network *Network, endpoint *Endpoint) error
 	Disconnect(network Network, endpoint *Endpoint) error
 }
 
+// 自己负责地址分配和容器内网卡配置的驱动, 例如调用 CNI 插件的驱动,
+// 连接时不经过 bucket 的 IPAM 和端口映射
+type containerNetworkDriver interface {
+	ConnectContainer(network *Network, endpoint *Endpoint, cinfo *container.ContainerInfo) error
+	DisconnectContainer(network *Network, endpoint *Endpoint, cinfo *container.ContainerInfo) error
+	CheckContainer(network *Network, endpoint *Endpoint, cinfo *container.ContainerInfo) error
+}
+
 func (nw *Network) dump(dumpPath string) error {
 	if _, err := os.Stat(dumpPath); err != nil {
 		if os.IsNotExist(err) {
@@ -94,20 +149,13 @@ func (nw *Network) remove(dumpPath string) error {
 }
 
 func (nw *Network) load(dumpPath string) error {
-	nwConfigFile, err := os.Open(dumpPath)
-	defer func() {
-		_ = nwConfigFile.Close()
-	}()
-	if err != nil {
-		return err
-	}
-	nwJson := make([]byte, 2000)
-	n, err := nwConfigFile.Read(nwJson)
+	// 端点列表会让配置文件变大, 需要完整读取
+	nwJson, err := ioutil.ReadFile(dumpPath)
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(nwJson[:n], nw)
+	err = json.Unmarshal(nwJson, nw)
 	if err != nil {
 		log.ConsoleLog.Error("Error load nw info", err)
 		return err
@@ -115,9 +163,38 @@ func (nw *Network) load(dumpPath string) error {
 	return nil
 }
 
+// 记录连接到网络的容器并写回配置文件
+func (nw *Network) addEndpoint(ep *Endpoint, cinfo *container.ContainerInfo) error {
+	if nw.Endpoints == nil {
+		nw.Endpoints = map[string]*NetworkEndpoint{}
+	}
+	nw.Endpoints[cinfo.Id] = &NetworkEndpoint{
+		EndpointID:    ep.ID,
+		ContainerID:   cinfo.Id,
+		ContainerName: cinfo.Name,
+		IPAddress:     ep.IPAddress,
+		MacAddress:    ep.MacAddress.String(),
+		PortMapping:   ep.PortMapping,
+		CNIResult:     ep.CNIResult,
+	}
+	return nw.dump(defaultNetworkPath)
+}
+
+func (nw *Network) removeEndpoint(containerID string) error {
+	if _, ok := nw.Endpoints[containerID]; !ok {
+		return nil
+	}
+	delete(nw.Endpoints, containerID)
+	return nw.dump(defaultNetworkPath)
+}
+
 func Init() error {
 	var bridgeDriver = BridgeNetworkDriver{}
 	drivers[bridgeDriver.Name()] = &bridgeDriver
+	var overlayDriver = OverlayNetworkDriver{}
+	drivers[overlayDriver.Name()] = &overlayDriver
+	var cniDriver = CNINetworkDriver{}
+	drivers[cniDriver.Name()] = &cniDriver
 
 	if _, err := os.Stat(defaultNetworkPath); err != nil {
 		if os.IsNotExist(err) {
@@ -149,29 +226,88 @@ func Init() error {
 	return nil
 }
 
-func CreateNetwork(driver, subnet, name string) error {
-	_, cidr, _ := net.ParseCIDR(subnet)
-	ip, err := ipAllocator.Allocate(cidr)
+// gateway 为空时使用网段的第一个地址, ipRange 为空时容器地址从整个网段中分配
+func CreateNetwork(driver, subnet, gateway, ipRange, name string, internal bool, options map[string]string) error {
+	d, ok := drivers[driver]
+	if !ok {
+		return fmt.Errorf("No Such Driver: %s", driver)
+	}
+	// 地址由驱动自己管理时不分配网关地址
+	if _, ok := d.(containerNetworkDriver); ok {
+		nw, err := d.Create(subnet, name, internal, options)
+		if err != nil {
+			return err
+		}
+		return nw.dump(defaultNetworkPath)
+	}
+
+	_, cidr, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return err
+	}
+	var pool *net.IPNet
+	if ipRange != "" {
+		if _, pool, err = net.ParseCIDR(ipRange); err != nil {
+			return err
+		}
+		poolOnes, _ := pool.Mask.Size()
+		subnetOnes, _ := cidr.Mask.Size()
+		if !cidr.Contains(pool.IP) || poolOnes < subnetOnes {
+			return fmt.Errorf("ip range %s is not in subnet %s", ipRange, cidr.String())
+		}
+	}
+	// overlay 网络的容器地址由每台主机各自分配, 分配网关前先检查本机的地址范围
+	if driver == "overlay" {
+		if err := checkOverlayRange(&Network{Name: name, IPPool: pool, Options: options}); err != nil {
+			return err
+		}
+	}
+
+	var ip net.IP
+	if gateway != "" {
+		if ip = net.ParseIP(gateway).To4(); ip == nil {
+			return fmt.Errorf("invalid gateway %s", gateway)
+		}
+		err = ipAllocator.Reserve(cidr, ip)
+	} else {
+		ip, err = ipAllocator.Allocate(cidr)
+	}
 	if err != nil {
 		return err
 	}
 	cidr.IP = ip
 
-	nw, err := drivers[driver].Create(cidr.String(), name)
+	// 驱动校验选项失败或者持久化失败时归还网关地址, 同样的 --gateway 可以重试.
+	// 驱动创建到一半失败时会同时返回网络, 已经创建的网桥、地址和防火墙规则要删除
+	nw, err := d.Create(cidr.String(), name, internal, options)
 	if err != nil {
+		if nw != nil {
+			_ = d.Delete(*nw)
+		}
+		_ = ipAllocator.Release(cidr, &ip)
 		return err
 	}
+	nw.IPPool = pool
 
-	return nw.dump(defaultNetworkPath)
+	if err := nw.dump(defaultNetworkPath); err != nil {
+		_ = d.Delete(*nw)
+		_ = ipAllocator.Release(cidr, &ip)
+		return err
+	}
+	return nil
 }
 
 func ListNetwork() {
 	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
 	_, _ = fmt.Fprint(w, "NAME\tIpRange\tDriver\n")
 	for _, nw := range networks {
+		ipRange := "-"
+		if nw.IpRange != nil {
+			ipRange = nw.IpRange.String()
+		}
 		_, _  = fmt.Fprintf(w, "%s\t%s\t%s\n",
 			nw.Name,
-			nw.IpRange.String(),
+			ipRange,
 			nw.Driver,
 		)
 	}
@@ -181,23 +317,103 @@ func ListNetwork() {
 	}
 }
 
-func DeleteNetwork(networkName string) error {
+func InspectNetwork(networkName string) (*NetworkInspect, error) {
+	nw, ok := networks[networkName]
+	if !ok {
+		return nil, fmt.Errorf("No Such Network: %s", networkName)
+	}
+	inspect := &NetworkInspect{
+		Name:       nw.Name,
+		Driver:     nw.Driver,
+		Internal:   nw.Internal,
+		Options:    nw.Options,
+		Containers: nw.Endpoints,
+	}
+	if inspect.Options == nil {
+		inspect.Options = map[string]string{}
+	}
+	if inspect.Containers == nil {
+		inspect.Containers = map[string]*NetworkEndpoint{}
+	}
+	if nw.IpRange != nil {
+		subnet := net.IPNet{IP: nw.IpRange.IP.Mask(nw.IpRange.Mask), Mask: nw.IpRange.Mask}
+		inspect.Subnet = subnet.String()
+		inspect.Gateway = nw.IpRange.IP.String()
+	}
+	if nw.IPPool != nil {
+		inspect.IPRange = nw.IPPool.String()
+	}
+	return inspect, nil
+}
+
+// 删除没有容器连接的网络, 返回被删除的网络名
+func PruneNetworks() ([]string, error) {
+	var pruned []string
+	for name, nw := range networks {
+		if len(nw.Endpoints) > 0 {
+			continue
+		}
+		if err := DeleteNetwork(name, false); err != nil {
+			return pruned, fmt.Errorf("prune network %s: %v", name, err)
+		}
+		pruned = append(pruned, name)
+	}
+	return pruned, nil
+}
+
+// 还有容器连接时拒绝删除, force 为 true 时先释放这些容器的地址和端口映射
+func DeleteNetwork(networkName string, force bool) error {
 	nw, ok := networks[networkName]
 	if !ok {
 		return fmt.Errorf("No Such Network: %s", networkName)
 	}
 
-	if err := ipAllocator.Release(nw.IpRange, &nw.IpRange.IP); err != nil {
-		return fmt.Errorf("Error Remove Network gateway ip: %s", err)
+	if len(nw.Endpoints) > 0 {
+		if !force {
+			names := make([]string, 0, len(nw.Endpoints))
+			for _, ne := range nw.Endpoints {
+				names = append(names, ne.ContainerName)
+			}
+			return fmt.Errorf("network %s has active endpoints: %s", networkName, strings.Join(names, ", "))
+		}
+		for _, ne := range nw.Endpoints {
+			releaseNetworkEndpoint(nw, ne)
+		}
+	}
+
+	if nw.IpRange != nil {
+		if err := ipAllocator.Release(nw.IpRange, &nw.IpRange.IP); err != nil {
+			return fmt.Errorf("Error Remove Network gateway ip: %s", err)
+		}
 	}
 
 	if err := drivers[nw.Driver].Delete(*nw); err != nil {
 		return fmt.Errorf("Error Remove Network DriverError: %s", err)
 	}
 
+	delete(networks, networkName)
 	return nw.remove(defaultNetworkPath)
 }
 
+// 强制删除网络时释放 bucket 为端点分配的资源, CNI 网络的资源由插件在删除配置时自行处理
+func releaseNetworkEndpoint(nw *Network, ne *NetworkEndpoint) {
+	if _, ok := drivers[nw.Driver].(containerNetworkDriver); ok || ne.IPAddress == nil {
+		return
+	}
+	ep := &Endpoint{
+		ID:          ne.EndpointID,
+		IPAddress:   ne.IPAddress,
+		Network:     nw,
+		PortMapping: ne.PortMapping,
+	}
+	if err := removePortMapping(ep); err != nil {
+		log.ConsoleLog.Error("remove port mapping of %s error: %v", ne.ContainerName, err)
+	}
+	if err := ipAllocator.Release(nw.IpRange, &ep.IPAddress); err != nil {
+		log.ConsoleLog.Error("release ip of %s error: %v", ne.ContainerName, err)
+	}
+}
+
 func enterContainerNetns(enLink *netlink.Link, cinfo *container.ContainerInfo) func() {
 	f, err := os.OpenFile(fmt.Sprintf("/proc/%s/ns/net", cinfo.Pid), os.O_RDONLY, 0)
 	if err != nil {
@@ -207,9 +423,11 @@ func enterContainerNetns(enLink *netlink.Link, cinfo *container.ContainerInfo) f
 	nsFD := f.Fd()
 	runtime.LockOSThread()
 
-	// 修改veth peer 另外一端移到容器的namespace中
-	if err = netlink.LinkSetNsFd(*enLink, int(nsFD)); err != nil {
-		log.ConsoleLog.Error("error set link netns , %v", err)
+	// 修改veth peer 另外一端移到容器的namespace中, 为nil时只进入namespace
+	if enLink != nil {
+		if err = netlink.LinkSetNsFd(*enLink, int(nsFD)); err != nil {
+			log.ConsoleLog.Error("error set link netns , %v", err)
+		}
 	}
 
 	// 获取当前的网络namespace
@@ -236,6 +454,7 @@ func configEndpointIpAddressAndRoute(ep *Endpoint, cinfo *container.ContainerInf
 		return fmt.Errorf("fail config endpoint: %v", err)
 	}
 
+	ep.MacAddress = peerLink.Attrs().HardwareAddr
 	defer enterContainerNetns(&peerLink, cinfo)()
 
 	interfaceIP := *ep.Network.IpRange
@@ -253,6 +472,11 @@ func configEndpointIpAddressAndRoute(ep *Endpoint, cinfo *container.ContainerInf
 		return err
 	}
 
+	// 内部网络没有出口, 不设置默认路由
+	if ep.Network.Internal {
+		return nil
+	}
+
 	_, cidr, _ := net.ParseCIDR("0.0.0.0/0")
 
 	defaultRoute := &netlink.Route{
@@ -268,24 +492,17 @@ func configEndpointIpAddressAndRoute(ep *Endpoint, cinfo *container.ContainerInf
 	return nil
 }
 
-func configPortMapping(ep *Endpoint, cinfo *container.ContainerInfo) error {
-	for _, pm := range ep.PortMapping {
-		portMapping :=strings.Split(pm, ":")
-		if len(portMapping) != 2 {
-			log.ConsoleLog.Error("port mapping format error, %v", pm)
-			continue
-		}
-		iptablesCmd := fmt.Sprintf("-t nat -A PREROUTING -p tcp -m tcp --dport %s -j DNAT --to-destination %s:%s",
-			portMapping[0], ep.IPAddress.String(), portMapping[1])
-		cmd := exec.Command("iptables", strings.Split(iptablesCmd, " ")...)
-		//err := cmd.Run()
-		output, err := cmd.Output()
-		if err != nil {
-			log.ConsoleLog.Error("iptables Output, %v", output)
-			continue
-		}
-	}
-	return nil
+// 在容器的net namespace中执行fn, 用于启动共享其他容器网络的进程
+func RunInContainerNetns(cinfo *container.ContainerInfo, fn func() error) error {
+	defer enterContainerNetns(nil, cinfo)()
+	return fn()
+}
+
+// none 模式下容器只有回环网卡, 需要手动启用
+func SetupLoopback(cinfo *container.ContainerInfo) error {
+	return RunInContainerNetns(cinfo, func() error {
+		return setInterfaceUP("lo")
+	})
 }
 
 func Connect(networkName string, cinfo *container.ContainerInfo) error {
@@ -294,8 +511,31 @@ func Connect(networkName string, cinfo *container.ContainerInfo) error {
 		return fmt.Errorf("No Such Network: %s", networkName)
 	}
 
+	if d, ok := drivers[network.Driver].(containerNetworkDriver); ok {
+		ep := &Endpoint{
+			ID: fmt.Sprintf("%s-%s", cinfo.Id, networkName),
+			Network: network,
+			PortMapping: cinfo.Ports,
+		}
+		if err := allocateHostPorts(cinfo.Ports); err != nil {
+			return err
+		}
+		if err := d.ConnectContainer(network, ep, cinfo); err != nil {
+			return err
+		}
+		if ep.IPAddress != nil {
+			cinfo.IPAddress = ep.IPAddress.String()
+		}
+		if err := network.addEndpoint(ep, cinfo); err != nil {
+			_ = d.DisconnectContainer(network, ep, cinfo)
+			cinfo.IPAddress = ""
+			return err
+		}
+		return nil
+	}
+
 	// 分配容器IP地址
-	ip, err := ipAllocator.Allocate(network.IpRange)
+	ip, err := ipAllocator.AllocateInRange(network.IpRange, network.IPPool)
 	if err != nil {
 		return err
 	}
@@ -305,20 +545,135 @@ func Connect(networkName string, cinfo *container.ContainerInfo) error {
 		ID: fmt.Sprintf("%s-%s", cinfo.Id, networkName),
 		IPAddress: ip,
 		Network: network,
-		PortMapping: cinfo.PortMapping,
+		PortMapping: cinfo.Ports,
+	}
+	if err = connectEndpoint(network, ep, cinfo); err != nil {
+		// 分配地址之后的任何一步失败都要归还地址并删除已经创建的 veth,
+		// 否则 cinfo 中没有地址, 容器退出时也不会再释放
+		if derr := drivers[network.Driver].Disconnect(*network, ep); derr != nil {
+			log.ConsoleLog.Error("disconnect endpoint of %s error: %v", cinfo.Name, derr)
+		}
+		_ = ipAllocator.Release(network.IpRange, &ip)
+		cinfo.IPAddress = ""
+		return err
+	}
+	return nil
+}
+
+// 已经分配好地址的端点挂到网络上, 端口映射失败时回滚已经添加的规则
+func connectEndpoint(network *Network, ep *Endpoint, cinfo *container.ContainerInfo) error {
+	// 为没有指定宿主机端口的映射分配随机端口
+	if err := allocateHostPorts(cinfo.Ports); err != nil {
+		return err
 	}
 	// 调用网络驱动挂载和配置网络端点
-	if err = drivers[network.Driver].Connect(network, ep); err != nil {
+	if err := drivers[network.Driver].Connect(network, ep); err != nil {
 		return err
 	}
 	// 到容器的namespace配置容器网络设备IP地址
-	if err = configEndpointIpAddressAndRoute(ep, cinfo); err != nil {
+	if err := configEndpointIpAddressAndRoute(ep, cinfo); err != nil {
 		return err
 	}
+	cinfo.IPAddress = ep.IPAddress.String()
 
-	return configPortMapping(ep, cinfo)
+	if err := configPortMapping(ep); err != nil {
+		return err
+	}
+	if err := network.addEndpoint(ep, cinfo); err != nil {
+		_ = removePortMapping(ep)
+		return err
+	}
+	return nil
 }
 
 func Disconnect(networkName string, cinfo *container.ContainerInfo) error {
+	network, ok := networks[networkName]
+	if !ok {
+		return fmt.Errorf("No Such Network: %s", networkName)
+	}
+
+	ep := &Endpoint{
+		ID: fmt.Sprintf("%s-%s", cinfo.Id, networkName),
+		IPAddress: net.ParseIP(cinfo.IPAddress),
+		Network: network,
+		PortMapping: cinfo.Ports,
+	}
+	if d, ok := drivers[network.Driver].(containerNetworkDriver); ok {
+		if err := d.DisconnectContainer(network, ep, cinfo); err != nil {
+			return err
+		}
+		return network.removeEndpoint(cinfo.Id)
+	}
+	// 连接失败时 Connect 已经回滚, 没有地址说明没有需要释放的资源
+	if ep.IPAddress == nil {
+		return nil
+	}
+
+	if err := removePortMapping(ep); err != nil {
+		log.ConsoleLog.Error("remove port mapping error: %v", err)
+	}
+
+	if err := drivers[network.Driver].Disconnect(*network, ep); err != nil {
+		return err
+	}
+	if err := network.removeEndpoint(cinfo.Id); err != nil {
+		log.ConsoleLog.Error("remove endpoint of %s error: %v", cinfo.Name, err)
+	}
+
+	// 释放容器IP地址
+	return ipAllocator.Release(network.IpRange, &ep.IPAddress)
+}
+
+// 检查容器的网络配置是否还和连接时一致, 只有 CNI 这类驱动支持
+func CheckNetwork(networkName string, cinfo *container.ContainerInfo) error {
+	network, ok := networks[networkName]
+	if !ok {
+		return fmt.Errorf("No Such Network: %s", networkName)
+	}
+	d, ok := drivers[network.Driver].(containerNetworkDriver)
+	if !ok {
+		return fmt.Errorf("network driver %s does not support check", network.Driver)
+	}
+	ep := &Endpoint{
+		ID: fmt.Sprintf("%s-%s", cinfo.Id, networkName),
+		IPAddress: net.ParseIP(cinfo.IPAddress),
+		Network: network,
+		PortMapping: cinfo.Ports,
+	}
+	return d.CheckContainer(network, ep, cinfo)
+}
+
+// 根据持久化的网络和容器信息重建 bucket 的全部防火墙规则
+func Reconcile(containers []*container.ContainerInfo) error {
+	if err := currentFirewall().Reset(); err != nil {
+		return err
+	}
+
+	for _, nw := range networks {
+		if nw.Driver != "bridge" && nw.Driver != "overlay" {
+			continue
+		}
+		if err := currentFirewall().SetupNetwork(nw); err != nil {
+			log.ConsoleLog.Error("reconcile network %s error: %v", nw.Name, err)
+		}
+	}
+	for _, cinfo := range containers {
+		if cinfo.Status != container.RUNNING || cinfo.IPAddress == "" {
+			continue
+		}
+		nw, ok := networks[cinfo.NetworkMode]
+		if !ok {
+			continue
+		}
+		ep := &Endpoint{
+			ID:          fmt.Sprintf("%s-%s", cinfo.Id, nw.Name),
+			IPAddress:   net.ParseIP(cinfo.IPAddress),
+			Network:     nw,
+			PortMapping: cinfo.Ports,
+		}
+		if err := configPortMapping(ep); err != nil {
+			log.ConsoleLog.Error("reconcile port mapping of %s error: %v", cinfo.Name, err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,110 @@
+package network
+
+import (
+	"bucket/container"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestNetworkEndpoints(t *testing.T) {
+	dir, options := setupFakeCNI(t)
+	defer os.RemoveAll(dir)
+	// 测试结束后恢复全局的网络目录和已加载的网络, 不影响后面的测试
+	oldNetworkPath, oldNetworks := defaultNetworkPath, networks
+	defer func() {
+		defaultNetworkPath, networks = oldNetworkPath, oldNetworks
+	}()
+	defaultNetworkPath = path.Join(dir, "network") + "/"
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateNetwork("cni", "", "", "", "testnet", false, options); err != nil {
+		t.Fatalf("create network error: %v", err)
+	}
+	// 重新加载, 确认网络是从配置文件中读出的
+	networks = map[string]*Network{}
+	_ = Init()
+
+	cinfo := &container.ContainerInfo{Id: "1234567890", Name: "web", Pid: "1"}
+	if err := Connect("testnet", cinfo); err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	networks = map[string]*Network{}
+	_ = Init()
+
+	inspect, err := InspectNetwork("testnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ne, ok := inspect.Containers[cinfo.Id]
+	if !ok || ne.ContainerName != "web" || ne.IPAddress.String() != "10.22.0.5" || ne.MacAddress != "02:42:0a:16:00:05" {
+		t.Fatalf("unexpected endpoints %+v", inspect.Containers)
+	}
+
+	if err := DeleteNetwork("testnet", false); err == nil {
+		t.Fatal("expect delete network with endpoints to fail")
+	}
+	if pruned, err := PruneNetworks(); err != nil || len(pruned) != 0 {
+		t.Fatalf("unexpected prune result %v %v", pruned, err)
+	}
+
+	if err := Disconnect("testnet", cinfo); err != nil {
+		t.Fatalf("disconnect error: %v", err)
+	}
+	pruned, err := PruneNetworks()
+	if err != nil || len(pruned) != 1 || pruned[0] != "testnet" {
+		t.Fatalf("unexpected prune result %v %v", pruned, err)
+	}
+	if _, err := os.Stat(path.Join(defaultNetworkPath, "testnet")); !os.IsNotExist(err) {
+		t.Errorf("network config should be removed, %v", err)
+	}
+}
+
+// 创建到一半失败的驱动, 记录被删除的网络
+type failingDriver struct {
+	deleted []string
+}
+
+func (d *failingDriver) Name() string { return "failing" }
+func (d *failingDriver) Create(subnet string, name string, internal bool, options map[string]string) (*Network, error) {
+	return &Network{Name: name, Driver: d.Name()}, fmt.Errorf("init failed")
+}
+func (d *failingDriver) Delete(network Network) error {
+	d.deleted = append(d.deleted, network.Name)
+	return nil
+}
+func (d *failingDriver) Connect(network *Network, endpoint *Endpoint) error   { return nil }
+func (d *failingDriver) Disconnect(network Network, endpoint *Endpoint) error { return nil }
+
+func TestCreateNetworkCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldNetworkPath, oldAllocator := defaultNetworkPath, ipAllocator
+	defer func() {
+		defaultNetworkPath, ipAllocator = oldNetworkPath, oldAllocator
+		delete(drivers, "failing")
+	}()
+	defaultNetworkPath = path.Join(dir, "network") + "/"
+	ipAllocator = &IPAM{SubnetAllocatorPath: path.Join(dir, "subnet.json")}
+	d := &failingDriver{}
+	drivers["failing"] = d
+
+	if err := CreateNetwork("failing", "10.88.0.0/24", "10.88.0.1", "", "half", false, nil); err == nil {
+		t.Fatal("create should fail")
+	}
+	if len(d.deleted) != 1 || d.deleted[0] != "half" {
+		t.Errorf("half created network should be deleted, got %v", d.deleted)
+	}
+	// 网关地址已经归还, 可以再次使用
+	_, cidr, _ := net.ParseCIDR("10.88.0.0/24")
+	if err := ipAllocator.Reserve(cidr, net.ParseIP("10.88.0.1").To4()); err != nil {
+		t.Errorf("gateway should be released: %v", err)
+	}
+}
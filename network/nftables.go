@@ -0,0 +1,409 @@
+package network
+
+import (
+	"bucket/container"
+	"bytes"
+	"fmt"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	"net"
+	"strings"
+)
+
+// bucket 在 nftables 中使用的表, 所有规则都放在这张表里, 不会影响其他表
+const nftTableName = "bucket"
+
+var nftProtocols = map[string]byte{
+	"tcp":  unix.IPPROTO_TCP,
+	"udp":  unix.IPPROTO_UDP,
+	"sctp": unix.IPPROTO_SCTP,
+}
+
+// 通过 netlink 直接操作 nftables 的防火墙后端, 不依赖 iptables 和 nft 命令
+//
+// 表结构:
+//
+//	prerouting/output  nat 基础链, 目的地址为本机且端口在 published_<proto> 集合中时跳到 portmap
+//	portmap            端口映射的 DNAT 规则
+//	postrouting        网络的 masquerade 和 hairpin 规则
+//	forward            网络之间的隔离、内部网络和 icc 规则, bridges 集合中是所有 bucket 网桥
+//
+// 每条规则都带有 comment 作为标识, 按标识查找和删除规则
+type NftablesFirewall struct {
+}
+
+type nftObjects struct {
+	table       *nftables.Table
+	prerouting  *nftables.Chain
+	output      *nftables.Chain
+	postrouting *nftables.Chain
+	forward     *nftables.Chain
+	portmap     *nftables.Chain
+	sets        map[string]*nftables.Set
+	bridges     *nftables.Set
+}
+
+func (f *NftablesFirewall) Name() string {
+	return "nftables"
+}
+
+func (f *NftablesFirewall) SetupNetwork(nw *Network) error {
+	c, o, err := f.open()
+	if err != nil {
+		return err
+	}
+	if err := c.SetAddElements(o.bridges, []nftables.SetElement{{Key: nftIfname(nw.bridgeName())}}); err != nil {
+		return err
+	}
+	for _, r := range nftNetworkRules(nw, o) {
+		if err := nftAddRuleOnce(c, o.table, r.chain, r.tag, r.exprs); err != nil {
+			return err
+		}
+	}
+	return c.Flush()
+}
+
+func (f *NftablesFirewall) TeardownNetwork(nw *Network) error {
+	c, o, err := f.open()
+	if err != nil {
+		return err
+	}
+	tag := "network:" + nw.Name + ":"
+	if err := nftDelRules(c, o.table, o.postrouting, tag); err != nil {
+		return err
+	}
+	if err := nftDelRules(c, o.table, o.forward, tag); err != nil {
+		return err
+	}
+	if err := c.SetDeleteElements(o.bridges, []nftables.SetElement{{Key: nftIfname(nw.bridgeName())}}); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+func (f *NftablesFirewall) AddPortMapping(containerIP net.IP, pb container.PortBinding) error {
+	c, o, err := f.open()
+	if err != nil {
+		return err
+	}
+	proto, ok := nftProtocols[pb.Protocol]
+	if !ok {
+		return fmt.Errorf("unsupported protocol %s", pb.Protocol)
+	}
+	for _, r := range nftPortMappingRules(containerIP, pb, proto, o) {
+		if err := nftAddRuleOnce(c, o.table, r.chain, r.tag, r.exprs); err != nil {
+			return err
+		}
+	}
+
+	if err := c.SetAddElements(o.sets[pb.Protocol], []nftables.SetElement{
+		{Key: binaryutil.BigEndian.PutUint16(uint16(pb.HostPort))},
+	}); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+func (f *NftablesFirewall) RemovePortMapping(containerIP net.IP, pb container.PortBinding) error {
+	c, o, err := f.open()
+	if err != nil {
+		return err
+	}
+	tag := nftPortMappingTag(containerIP, pb)
+	if err := nftDelRules(c, o.table, o.portmap, tag); err != nil {
+		return err
+	}
+	if err := nftDelRules(c, o.table, o.postrouting, "hairpin:"+tag); err != nil {
+		return err
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	// 同一个宿主机端口可能还绑定在其他地址上, 没有规则使用时才从集合中删除
+	rules, err := c.GetRules(o.table, o.portmap)
+	if err != nil {
+		return err
+	}
+	if len(nftMatchRules(rules, fmt.Sprintf("port:%s:%d:", pb.Protocol, pb.HostPort))) > 0 {
+		return nil
+	}
+	if err := c.SetDeleteElements(o.sets[pb.Protocol], []nftables.SetElement{
+		{Key: binaryutil.BigEndian.PutUint16(uint16(pb.HostPort))},
+	}); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+func (f *NftablesFirewall) Reset() error {
+	c, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	tables, err := c.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if t.Name == nftTableName {
+			c.DelTable(t)
+			if err := c.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	_, _, err = f.open()
+	return err
+}
+
+// 打开 netlink 连接并确保表、链、集合以及跳转规则存在
+func (f *NftablesFirewall) open() (*nftables.Conn, *nftObjects, error) {
+	c, err := nftables.New()
+	if err != nil {
+		return nil, nil, err
+	}
+	table := c.AddTable(&nftables.Table{Name: nftTableName, Family: nftables.TableFamilyIPv4})
+	o := &nftObjects{
+		table:   table,
+		portmap: c.AddChain(&nftables.Chain{Name: "portmap", Table: table}),
+		prerouting: c.AddChain(&nftables.Chain{Name: "prerouting", Table: table, Type: nftables.ChainTypeNAT,
+			Hooknum: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityNATDest}),
+		output: c.AddChain(&nftables.Chain{Name: "output", Table: table, Type: nftables.ChainTypeNAT,
+			Hooknum: nftables.ChainHookOutput, Priority: nftables.ChainPriorityNATDest}),
+		postrouting: c.AddChain(&nftables.Chain{Name: "postrouting", Table: table, Type: nftables.ChainTypeNAT,
+			Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource}),
+		forward: c.AddChain(&nftables.Chain{Name: "forward", Table: table, Type: nftables.ChainTypeFilter,
+			Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter}),
+		sets: map[string]*nftables.Set{},
+	}
+	for proto := range nftProtocols {
+		set := &nftables.Set{Table: table, Name: "published_" + proto, KeyType: nftables.TypeInetService}
+		if err := c.AddSet(set, nil); err != nil {
+			return nil, nil, err
+		}
+		o.sets[proto] = set
+	}
+	o.bridges = &nftables.Set{Table: table, Name: "bridges", KeyType: nftables.TypeIFName}
+	if err := c.AddSet(o.bridges, nil); err != nil {
+		return nil, nil, err
+	}
+	if err := c.Flush(); err != nil {
+		return nil, nil, fmt.Errorf("setup nftables table %s: %v", nftTableName, err)
+	}
+
+	// fib daddr type local meta l4proto <proto> th dport @published_<proto> jump portmap
+	for _, chain := range []*nftables.Chain{o.prerouting, o.output} {
+		for proto, set := range o.sets {
+			if err := nftAddRuleOnce(c, table, chain, "jump:"+proto, nftExprs(
+				[]expr.Any{
+					&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+				},
+				nftMatchL4Proto(nftProtocols[proto]),
+				[]expr.Any{
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+					&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+					&expr.Verdict{Kind: expr.VerdictJump, Chain: o.portmap.Name},
+				},
+			)); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return nil, nil, err
+	}
+	return c, o, nil
+}
+
+// 带标识的一条规则, 标识相同的规则只添加一次
+type nftRule struct {
+	chain *nftables.Chain
+	tag   string
+	exprs []expr.Any
+}
+
+// 网络的隔离、内部网络、masquerade、icc 和 localhost 规则, 标识都以 network:<name>: 开头
+func nftNetworkRules(nw *Network, o *nftObjects) []nftRule {
+	bridgeName := nw.bridgeName()
+	tag := "network:" + nw.Name
+	drop := []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}}
+
+	// 从本网桥出去进入其他 bucket 网桥的流量直接丢弃
+	rules := []nftRule{{o.forward, tag + ":isolation", nftExprs(
+		nftMatchIfname(expr.MetaKeyIIFNAME, expr.CmpOpEq, bridgeName),
+		nftMatchIfname(expr.MetaKeyOIFNAME, expr.CmpOpNeq, bridgeName),
+		[]expr.Any{&expr.Lookup{SourceRegister: 1, SetName: o.bridges.Name, SetID: o.bridges.ID}},
+		drop,
+	)}}
+
+	if nw.Internal {
+		rules = append(rules, nftRule{o.forward, tag + ":internal-out", nftExprs(
+			nftMatchIfname(expr.MetaKeyIIFNAME, expr.CmpOpEq, bridgeName),
+			nftMatchIfname(expr.MetaKeyOIFNAME, expr.CmpOpNeq, bridgeName),
+			drop,
+		)}, nftRule{o.forward, tag + ":internal-in", nftExprs(
+			nftMatchIfname(expr.MetaKeyOIFNAME, expr.CmpOpEq, bridgeName),
+			nftMatchIfname(expr.MetaKeyIIFNAME, expr.CmpOpNeq, bridgeName),
+			drop,
+		)})
+	} else if !nw.masqueradeDisabled() {
+		_, subnet, _ := net.ParseCIDR(nw.IpRange.String())
+		rules = append(rules, nftRule{o.postrouting, tag + ":masquerade", nftExprs(
+			nftMatchIPv4(12, subnet),
+			nftMatchIfname(expr.MetaKeyOIFNAME, expr.CmpOpNeq, bridgeName),
+			[]expr.Any{&expr.Masq{}},
+		)})
+	}
+
+	if nw.iccDisabled() {
+		rules = append(rules, nftRule{o.forward, tag + ":icc", nftExprs(
+			nftMatchIfname(expr.MetaKeyIIFNAME, expr.CmpOpEq, bridgeName),
+			nftMatchIfname(expr.MetaKeyOIFNAME, expr.CmpOpEq, bridgeName),
+			drop,
+		)})
+	}
+
+	_, localnet, _ := net.ParseCIDR("127.0.0.0/8")
+	return append(rules, nftRule{o.postrouting, tag + ":localhost", nftExprs(
+		nftMatchIPv4(12, localnet),
+		nftMatchIfname(expr.MetaKeyOIFNAME, expr.CmpOpEq, bridgeName),
+		[]expr.Any{&expr.Masq{}},
+	)})
+}
+
+// 端口映射的 DNAT 规则和容器访问自己发布端口时的 hairpin 规则
+func nftPortMappingRules(containerIP net.IP, pb container.PortBinding, proto byte, o *nftObjects) []nftRule {
+	tag := nftPortMappingTag(containerIP, pb)
+	dnat := nftMatchL4Proto(proto)
+	if pb.HostIP != "" {
+		hostIP := &net.IPNet{IP: net.ParseIP(pb.HostIP).To4(), Mask: net.CIDRMask(32, 32)}
+		dnat = append(dnat, nftMatchIPv4(16, hostIP)...)
+	}
+	dnat = append(dnat, nftMatchDport(pb.HostPort)...)
+	dnat = append(dnat,
+		&expr.Immediate{Register: 1, Data: containerIP.To4()},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(pb.ContainerPort))},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 2},
+	)
+
+	self := &net.IPNet{IP: containerIP.To4(), Mask: net.CIDRMask(32, 32)}
+	return []nftRule{{o.portmap, tag, dnat}, {o.postrouting, "hairpin:" + tag, nftExprs(
+		nftMatchIPv4(12, self),
+		nftMatchIPv4(16, self),
+		nftMatchL4Proto(proto),
+		nftMatchDport(pb.ContainerPort),
+		[]expr.Any{&expr.Masq{}},
+	)}}
+}
+
+func nftPortMappingTag(containerIP net.IP, pb container.PortBinding) string {
+	return fmt.Sprintf("port:%s:%d:%s->%s:%d", pb.Protocol, pb.HostPort, pb.HostIP, containerIP.String(), pb.ContainerPort)
+}
+
+// 规则的标识以 comment 的格式保存在 userdata 中, nft list ruleset 可以直接看到
+func nftComment(tag string) []byte {
+	data := append([]byte(tag), 0)
+	return append([]byte{0, byte(len(data))}, data...)
+}
+
+func nftRuleTag(r *nftables.Rule) string {
+	if len(r.UserData) < 2 || r.UserData[0] != 0 {
+		return ""
+	}
+	return string(bytes.TrimRight(r.UserData[2:], "\x00"))
+}
+
+func nftAddRuleOnce(c *nftables.Conn, table *nftables.Table, chain *nftables.Chain, tag string, exprs []expr.Any) error {
+	rules, err := c.GetRules(table, chain)
+	if err != nil {
+		return err
+	}
+	if len(nftMatchRules(rules, tag)) > 0 {
+		return nil
+	}
+	c.AddRule(&nftables.Rule{
+		Table:    table,
+		Chain:    chain,
+		Exprs:    exprs,
+		UserData: nftComment(tag),
+	})
+	return nil
+}
+
+// 删除标识匹配 pattern 的规则
+func nftDelRules(c *nftables.Conn, table *nftables.Table, chain *nftables.Chain, pattern string) error {
+	rules, err := c.GetRules(table, chain)
+	if err != nil {
+		return err
+	}
+	for _, r := range nftMatchRules(rules, pattern) {
+		r.Table = table
+		r.Chain = chain
+		if err := c.DelRule(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pattern 以 : 结尾时按前缀匹配标识, 否则要求标识完全相同.
+// 端口映射的标识之间可能互为前缀, 例如 ->10.0.0.2:80 和 ->10.0.0.2:8080, 所以不能都按前缀删除
+func nftMatchRules(rules []*nftables.Rule, pattern string) []*nftables.Rule {
+	var matched []*nftables.Rule
+	for _, r := range rules {
+		tag := nftRuleTag(r)
+		if tag == pattern || (strings.HasSuffix(pattern, ":") && strings.HasPrefix(tag, pattern)) {
+			matched = append(matched, r)
+		}
+	}
+	return matched
+}
+
+func nftExprs(groups ...[]expr.Any) []expr.Any {
+	var exprs []expr.Any
+	for _, g := range groups {
+		exprs = append(exprs, g...)
+	}
+	return exprs
+}
+
+func nftMatchL4Proto(proto byte) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+}
+
+func nftMatchDport(port int) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(port))},
+	}
+}
+
+// offset 12 为源地址, 16 为目的地址
+func nftMatchIPv4(offset uint32, ipNet *net.IPNet) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: 4},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte(ipNet.Mask), Xor: []byte{0, 0, 0, 0}},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ipNet.IP.Mask(ipNet.Mask).To4()},
+	}
+}
+
+func nftIfname(name string) []byte {
+	ifname := make([]byte, unix.IFNAMSIZ)
+	copy(ifname, name)
+	return ifname
+}
+
+// 网卡名匹配, 之后的 Lookup 可以直接使用寄存器中的网卡名
+func nftMatchIfname(key expr.MetaKey, op expr.CmpOp, name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: nftIfname(name)},
+	}
+}
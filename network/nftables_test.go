@@ -0,0 +1,187 @@
+package network
+
+import (
+	"bucket/container"
+	"bytes"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"net"
+	"strings"
+	"testing"
+)
+
+func testNftObjects() *nftObjects {
+	table := &nftables.Table{Name: nftTableName, Family: nftables.TableFamilyIPv4}
+	return &nftObjects{
+		table:       table,
+		postrouting: &nftables.Chain{Name: "postrouting", Table: table},
+		forward:     &nftables.Chain{Name: "forward", Table: table},
+		portmap:     &nftables.Chain{Name: "portmap", Table: table},
+		bridges:     &nftables.Set{Table: table, Name: "bridges", KeyType: nftables.TypeIFName},
+	}
+}
+
+func TestNftRuleTag(t *testing.T) {
+	for _, tag := range []string{"network:br0:isolation", "port:tcp:8080:->10.0.0.2:80", ""} {
+		if got := nftRuleTag(&nftables.Rule{UserData: nftComment(tag)}); got != tag {
+			t.Errorf("tag %q decoded as %q", tag, got)
+		}
+	}
+	// 不是 comment 的 userdata 没有标识
+	for _, data := range [][]byte{nil, {0}, {1, 2, 'a', 0}} {
+		if got := nftRuleTag(&nftables.Rule{UserData: data}); got != "" {
+			t.Errorf("userdata %v should have no tag, got %q", data, got)
+		}
+	}
+}
+
+func TestNftMatchRules(t *testing.T) {
+	var rules []*nftables.Rule
+	for _, tag := range []string{"network:br0:isolation", "network:br0:icc", "network:br01:isolation",
+		"port:tcp:80:->10.0.0.2:80", "port:tcp:80:->10.0.0.2:8080", "port:tcp:8080:->10.0.0.3:80"} {
+		rules = append(rules, &nftables.Rule{UserData: nftComment(tag)})
+	}
+	tags := func(pattern string) string {
+		var matched []string
+		for _, r := range nftMatchRules(rules, pattern) {
+			matched = append(matched, nftRuleTag(r))
+		}
+		return strings.Join(matched, ",")
+	}
+
+	cases := map[string]string{
+		// 以 : 结尾时按前缀匹配, 不会匹配到名字以它开头的其他网络
+		"network:br0:": "network:br0:isolation,network:br0:icc",
+		"port:tcp:80:": "port:tcp:80:->10.0.0.2:80,port:tcp:80:->10.0.0.2:8080",
+		// 完整标识只匹配自己, 添加时据此跳过已有规则, 删除时不会删掉前缀相同的映射
+		"network:br0:icc":           "network:br0:icc",
+		"port:tcp:80:->10.0.0.2:80": "port:tcp:80:->10.0.0.2:80",
+		"network:br0":               "",
+	}
+	for pattern, expect := range cases {
+		if got := tags(pattern); got != expect {
+			t.Errorf("match %q = %q, expect %q", pattern, got, expect)
+		}
+	}
+}
+
+func TestNftNetworkRules(t *testing.T) {
+	o := testNftObjects()
+	_, ipRange, _ := net.ParseCIDR("172.18.0.1/24")
+	ruleTags := func(nw *Network) map[string]*nftRule {
+		tags := map[string]*nftRule{}
+		rs := nftNetworkRules(nw, o)
+		for i, r := range rs {
+			if !strings.HasPrefix(r.tag, "network:"+nw.Name+":") {
+				t.Errorf("rule tag %q should start with the network prefix", r.tag)
+			}
+			if tags[r.tag] != nil {
+				t.Errorf("duplicate rule tag %q", r.tag)
+			}
+			tags[r.tag] = &rs[i]
+		}
+		return tags
+	}
+
+	rules := ruleTags(&Network{Name: "br0", IpRange: ipRange, Options: map[string]string{}})
+	for tag, chain := range map[string]*nftables.Chain{
+		"network:br0:isolation": o.forward, "network:br0:masquerade": o.postrouting, "network:br0:localhost": o.postrouting,
+	} {
+		if rules[tag] == nil || rules[tag].chain != chain {
+			t.Errorf("expect rule %s in chain %s, got %v", tag, chain.Name, rules[tag])
+		}
+	}
+	if len(rules) != 3 {
+		t.Errorf("unexpected rules for default network: %v", rules)
+	}
+	// masquerade 只匹配网络的网段, 并且排除本网桥
+	masq := rules["network:br0:masquerade"].exprs
+	if cmp, ok := masq[2].(*expr.Cmp); !ok || !bytes.Equal(cmp.Data, net.IPv4(172, 18, 0, 0).To4()) {
+		t.Errorf("masquerade should match the subnet, got %#v", masq[2])
+	}
+	if cmp, ok := masq[4].(*expr.Cmp); !ok || cmp.Op != expr.CmpOpNeq || !bytes.Equal(cmp.Data, nftIfname("br0")) {
+		t.Errorf("masquerade should exclude the bridge, got %#v", masq[4])
+	}
+	if _, ok := masq[len(masq)-1].(*expr.Masq); !ok {
+		t.Errorf("masquerade rule should end with masq")
+	}
+
+	// 使用 bridge_name 选项时按网桥名匹配, 标识仍然用网络名
+	rules = ruleTags(&Network{Name: "br0", IpRange: ipRange, Internal: true,
+		Options: map[string]string{bridgeOptionName: "bucket0", optionICC: "false"}})
+	for _, tag := range []string{"network:br0:isolation", "network:br0:internal-out", "network:br0:internal-in",
+		"network:br0:icc", "network:br0:localhost"} {
+		if rules[tag] == nil {
+			t.Errorf("expect rule %s for internal network", tag)
+		}
+	}
+	if rules["network:br0:masquerade"] != nil {
+		t.Errorf("internal network should not masquerade")
+	}
+	isolation := rules["network:br0:isolation"].exprs
+	if cmp, ok := isolation[1].(*expr.Cmp); !ok || !bytes.Equal(cmp.Data, nftIfname("bucket0")) {
+		t.Errorf("rules should match the bridge name, got %#v", isolation[1])
+	}
+	if lookup, ok := isolation[4].(*expr.Lookup); !ok || lookup.SetName != o.bridges.Name {
+		t.Errorf("isolation rule should lookup the bridges set, got %#v", isolation[4])
+	}
+	if v, ok := isolation[len(isolation)-1].(*expr.Verdict); !ok || v.Kind != expr.VerdictDrop {
+		t.Errorf("isolation rule should drop")
+	}
+
+	rules = ruleTags(&Network{Name: "br0", IpRange: ipRange, Options: map[string]string{bridgeOptionMasquerade: "false"}})
+	if rules["network:br0:masquerade"] != nil {
+		t.Errorf("masquerade should be disabled by option")
+	}
+}
+
+func TestNftPortMappingRules(t *testing.T) {
+	o := testNftObjects()
+	containerIP := net.ParseIP("172.18.0.2")
+	pb := container.PortBinding{HostIP: "192.168.1.10", HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}
+	rules := nftPortMappingRules(containerIP, pb, nftProtocols["tcp"], o)
+	if len(rules) != 2 {
+		t.Fatalf("expect dnat and hairpin rules, got %d", len(rules))
+	}
+
+	dnat := rules[0]
+	if dnat.chain != o.portmap || dnat.tag != "port:tcp:8080:192.168.1.10->172.18.0.2:80" {
+		t.Errorf("unexpected dnat rule %s in %s", dnat.tag, dnat.chain.Name)
+	}
+	var hostIP, containerAddr []byte
+	var nat *expr.NAT
+	for _, e := range dnat.exprs {
+		switch e := e.(type) {
+		case *expr.Cmp:
+			if len(e.Data) == 4 {
+				hostIP = e.Data
+			}
+		case *expr.Immediate:
+			if e.Register == 1 {
+				containerAddr = e.Data
+			}
+		case *expr.NAT:
+			nat = e
+		}
+	}
+	if !bytes.Equal(hostIP, net.ParseIP("192.168.1.10").To4()) {
+		t.Errorf("dnat should match the host ip, got %v", hostIP)
+	}
+	if !bytes.Equal(containerAddr, containerIP.To4()) || nat == nil || nat.Type != expr.NATTypeDestNAT {
+		t.Errorf("dnat should translate to the container ip, got %v %#v", containerAddr, nat)
+	}
+
+	hairpin := rules[1]
+	if hairpin.chain != o.postrouting || hairpin.tag != "hairpin:"+dnat.tag {
+		t.Errorf("unexpected hairpin rule %s in %s", hairpin.tag, hairpin.chain.Name)
+	}
+
+	// 没有指定宿主机地址时不匹配目的地址
+	pb.HostIP = ""
+	rules = nftPortMappingRules(containerIP, pb, nftProtocols["tcp"], o)
+	for _, e := range rules[0].exprs {
+		if p, ok := e.(*expr.Payload); ok && p.Base == expr.PayloadBaseNetworkHeader {
+			t.Errorf("dnat without host ip should not match the destination address")
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package network
+
+import (
+	"bucket/log"
+	"bufio"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// overlay 驱动的选项
+const (
+	overlayOptionVNI       = "vni"        // VXLAN ID, 默认由网络名计算, 各主机上同名网络一致
+	overlayOptionPort      = "vxlan_port" // VXLAN UDP 端口, 默认 4789
+	overlayOptionLocal     = "local"      // 本机 VTEP 地址
+	overlayOptionDev       = "dev"        // 承载 VXLAN 流量的网卡
+	overlayOptionPeers     = "peers"      // 逗号分隔的对端 VTEP 地址
+	overlayOptionPeersFile = "peers_file" // 对端列表文件, 每次连接容器时重新加载
+	overlayOptionMTU       = "mtu"        // 容器网卡 MTU, 默认 1450, 留出 VXLAN 封装的 50 字节
+)
+
+const (
+	defaultVxlanPort  = 4789
+	defaultOverlayMTU = 1450
+)
+
+// 基于 VXLAN 的跨主机网络, 每个网络在每台主机上有一个网桥和一个挂在网桥上的 VXLAN 设备,
+// 不同主机上同名网络的容器处于同一个二层网络中.
+// 对端通过 FDB 表项指定: 全零 MAC 指向每个对端 VTEP 用于广播和未知单播, 对端文件中可以
+// 额外给出容器的 MAC 和 IP, 写入静态 FDB 和 ARP 表项
+//
+// overlay 网络没有出口 NAT, 只能创建为内部网络. 容器地址由每台主机的 IPAM 各自分配,
+// 所以每台主机必须用 --ip-range 指定互不重叠的地址范围
+type OverlayNetworkDriver struct {
+}
+
+// 对端文件中的一行: <vtep-ip> [<mac> <ip>]
+type overlayPeer struct {
+	VTEP net.IP
+	MAC  net.HardwareAddr
+	IP   net.IP
+}
+
+func (d *OverlayNetworkDriver) Name() string {
+	return "overlay"
+}
+
+func (d *OverlayNetworkDriver) Create(subnet string, name string, internal bool, options map[string]string) (*Network, error) {
+	if !internal {
+		return nil, fmt.Errorf("overlay network %s has no outbound nat, it can only be created as an internal network", name)
+	}
+	ip, ipRange, _ := net.ParseCIDR(subnet)
+	ipRange.IP = ip
+	n := &Network{
+		Name:     name,
+		IpRange:  ipRange,
+		Driver:   d.Name(),
+		Internal: internal,
+		Options:  options,
+	}
+	if n.Options == nil {
+		n.Options = map[string]string{}
+	}
+	if _, ok := n.Options[overlayOptionVNI]; !ok {
+		n.Options[overlayOptionVNI] = strconv.Itoa(defaultVNI(name))
+	}
+
+	if err := createOverlayDevices(n); err != nil {
+		log.ConsoleLog.Error("error init overlay: %v", err)
+		return n, err
+	}
+	if err := currentFirewall().SetupNetwork(n); err != nil {
+		return n, fmt.Errorf("Error setting %s rules for %s: %v", currentFirewall().Name(), name, err)
+	}
+	return n, nil
+}
+
+func (d *OverlayNetworkDriver) Delete(network Network) error {
+	if err := currentFirewall().TeardownNetwork(&network); err != nil {
+		log.ConsoleLog.Error("error teardown %s rules for %s: %v", currentFirewall().Name(), network.Name, err)
+	}
+	if vx, err := netlink.LinkByName(vxlanName(&network)); err == nil {
+		if err := netlink.LinkDel(vx); err != nil {
+			return err
+		}
+	}
+	br, err := netlink.LinkByName(network.bridgeName())
+	if err != nil {
+		return err
+	}
+	return netlink.LinkDel(br)
+}
+
+func (d *OverlayNetworkDriver) Connect(network *Network, endpoint *Endpoint) error {
+	// 对端文件可能已经更新, 连接容器时重新加载, 对端容器的地址和本机的范围重叠时拒绝连接
+	if err := checkOverlayRange(network); err != nil {
+		return err
+	}
+	if err := applyOverlayPeers(network); err != nil {
+		log.ConsoleLog.Error("error apply overlay peers of %s: %v", network.Name, err)
+	}
+	mtu, err := overlayMTU(network)
+	if err != nil {
+		return err
+	}
+	return connectVeth(network.bridgeName(), endpoint, mtu)
+}
+
+func (d *OverlayNetworkDriver) Disconnect(network Network, endpoint *Endpoint) error {
+	bridge := BridgeNetworkDriver{}
+	return bridge.Disconnect(network, endpoint)
+}
+
+// 网卡名最长15个字符, 用 VNI 命名, 网络名较长时也不会冲突
+func vxlanName(n *Network) string {
+	return "vx-" + n.Options[overlayOptionVNI]
+}
+
+func defaultVNI(name string) int {
+	return 256 + int(crc32.ChecksumIEEE([]byte(name))%(1<<24-256))
+}
+
+func overlayMTU(n *Network) (int, error) {
+	raw, ok := n.Options[overlayOptionMTU]
+	if !ok {
+		return defaultOverlayMTU, nil
+	}
+	mtu, err := strconv.Atoi(raw)
+	if err != nil || mtu < 68 {
+		return 0, fmt.Errorf("invalid overlay mtu %s", raw)
+	}
+	return mtu, nil
+}
+
+// 创建网桥和 VXLAN 设备, 设备已经存在时保持不变
+func createOverlayDevices(n *Network) error {
+	vni, err := strconv.Atoi(n.Options[overlayOptionVNI])
+	if err != nil || vni <= 0 || vni >= 1<<24 {
+		return fmt.Errorf("invalid vni %s", n.Options[overlayOptionVNI])
+	}
+	port := defaultVxlanPort
+	if raw, ok := n.Options[overlayOptionPort]; ok {
+		if port, err = parsePort(raw); err != nil {
+			return err
+		}
+	}
+	mtu, err := overlayMTU(n)
+	if err != nil {
+		return err
+	}
+
+	if err := createBridgeInterface(n.bridgeName()); err != nil {
+		return fmt.Errorf("Error add bridge： %s, Error: %v", n.bridgeName(), err)
+	}
+	br, err := netlink.LinkByName(n.bridgeName())
+	if err != nil {
+		return err
+	}
+
+	if _, err := netlink.LinkByName(vxlanName(n)); err != nil {
+		la := netlink.NewLinkAttrs()
+		la.Name = vxlanName(n)
+		la.MTU = mtu
+		vxlan := &netlink.Vxlan{
+			LinkAttrs: la,
+			VxlanId:   vni,
+			Port:      port,
+			Learning:  true,
+		}
+		if local, ok := n.Options[overlayOptionLocal]; ok {
+			if vxlan.SrcAddr = net.ParseIP(local); vxlan.SrcAddr == nil {
+				return fmt.Errorf("invalid local vtep address %s", local)
+			}
+		}
+		if dev, ok := n.Options[overlayOptionDev]; ok {
+			link, err := netlink.LinkByName(dev)
+			if err != nil {
+				return fmt.Errorf("Error get vxlan dev %s: %v", dev, err)
+			}
+			vxlan.VtepDevIndex = link.Attrs().Index
+		}
+		if err := netlink.LinkAdd(vxlan); err != nil {
+			return fmt.Errorf("Vxlan creation failed for %s: %v", la.Name, err)
+		}
+	}
+
+	vx, err := netlink.LinkByName(vxlanName(n))
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetMaster(vx, &netlink.Bridge{LinkAttrs: *br.Attrs()}); err != nil {
+		return fmt.Errorf("Error attach %s to bridge %s: %v", vx.Attrs().Name, n.bridgeName(), err)
+	}
+	if err := netlink.LinkSetUp(vx); err != nil {
+		return err
+	}
+	if err := setInterfaceUP(n.bridgeName()); err != nil {
+		return err
+	}
+	return applyOverlayPeers(n)
+}
+
+// 把静态对端和对端文件中的表项写入 VXLAN 设备
+func applyOverlayPeers(n *Network) error {
+	peers, err := loadOverlayPeers(n)
+	if err != nil {
+		return err
+	}
+	vx, err := netlink.LinkByName(vxlanName(n))
+	if err != nil {
+		return err
+	}
+	return addOverlayPeers(vx, peers)
+}
+
+// 本机必须有自己的 --ip-range, 对端文件中列出的其他主机的容器地址不能落在这个范围内
+func checkOverlayRange(n *Network) error {
+	if n.IPPool == nil {
+		return fmt.Errorf("overlay network %s needs an --ip-range that does not overlap with other hosts", n.Name)
+	}
+	peers, err := loadOverlayPeers(n)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if peer.IP != nil && n.IPPool.Contains(peer.IP) {
+			return fmt.Errorf("container ip %s of peer %s is in the local ip range %s, ip ranges of hosts must not overlap",
+				peer.IP, peer.VTEP, n.IPPool)
+		}
+	}
+	return nil
+}
+
+// 静态对端和对端文件中的全部表项
+func loadOverlayPeers(n *Network) ([]overlayPeer, error) {
+	var peers []overlayPeer
+	if raw := n.Options[overlayOptionPeers]; raw != "" {
+		for _, addr := range strings.Split(raw, ",") {
+			vtep := net.ParseIP(strings.TrimSpace(addr))
+			if vtep == nil {
+				return nil, fmt.Errorf("invalid peer address %s", addr)
+			}
+			peers = append(peers, overlayPeer{VTEP: vtep})
+		}
+	}
+	if path := n.Options[overlayOptionPeersFile]; path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		filePeers, err := parseOverlayPeers(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parse peers file %s: %v", path, err)
+		}
+		peers = append(peers, filePeers...)
+	}
+	return peers, nil
+}
+
+func addOverlayPeers(vx netlink.Link, peers []overlayPeer) error {
+	flooded := map[string]bool{}
+	for _, peer := range peers {
+		// 全零 MAC 的表项让广播和未知单播发给每个对端
+		if !flooded[peer.VTEP.String()] {
+			flooded[peer.VTEP.String()] = true
+			err := netlink.NeighAppend(&netlink.Neigh{
+				LinkIndex:    vx.Attrs().Index,
+				Family:       syscall.AF_BRIDGE,
+				State:        netlink.NUD_PERMANENT,
+				Flags:        netlink.NTF_SELF,
+				IP:           peer.VTEP,
+				HardwareAddr: make(net.HardwareAddr, 6),
+			})
+			if err != nil && err != syscall.EEXIST {
+				return fmt.Errorf("add flood entry for %s: %v", peer.VTEP, err)
+			}
+		}
+		if peer.MAC == nil {
+			continue
+		}
+		if err := netlink.NeighSet(&netlink.Neigh{
+			LinkIndex:    vx.Attrs().Index,
+			Family:       syscall.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT,
+			Flags:        netlink.NTF_SELF,
+			IP:           peer.VTEP,
+			HardwareAddr: peer.MAC,
+		}); err != nil {
+			return fmt.Errorf("add fdb entry %s -> %s: %v", peer.MAC, peer.VTEP, err)
+		}
+		if peer.IP == nil {
+			continue
+		}
+		if err := netlink.NeighSet(&netlink.Neigh{
+			LinkIndex:    vx.Attrs().Index,
+			Family:       netlink.FAMILY_V4,
+			State:        netlink.NUD_PERMANENT,
+			IP:           peer.IP,
+			HardwareAddr: peer.MAC,
+		}); err != nil {
+			return fmt.Errorf("add arp entry %s -> %s: %v", peer.IP, peer.MAC, err)
+		}
+	}
+	return nil
+}
+
+// 对端文件格式, 每行一个表项, # 开头为注释:
+//
+//	<vtep-ip>                 只添加广播表项
+//	<vtep-ip> <mac> [<ip>]    同时添加容器 MAC 的 FDB 表项和 ARP 表项
+func parseOverlayPeers(r io.Reader) ([]overlayPeer, error) {
+	var peers []overlayPeer
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: too many fields", line)
+		}
+		peer := overlayPeer{VTEP: net.ParseIP(fields[0])}
+		if peer.VTEP == nil {
+			return nil, fmt.Errorf("line %d: invalid vtep address %s", line, fields[0])
+		}
+		if len(fields) > 1 {
+			mac, err := net.ParseMAC(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			peer.MAC = mac
+		}
+		if len(fields) > 2 {
+			if peer.IP = net.ParseIP(fields[2]); peer.IP == nil {
+				return nil, fmt.Errorf("line %d: invalid ip %s", line, fields[2])
+			}
+		}
+		peers = append(peers, peer)
+	}
+	return peers, scanner.Err()
+}
@@ -0,0 +1,168 @@
+package network
+
+import (
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOverlayPeers(t *testing.T) {
+	peers, err := parseOverlayPeers(strings.NewReader(`
+# host b
+10.0.0.2
+10.0.0.3 02:42:ac:11:00:02 172.18.0.2
+`))
+	if err != nil {
+		t.Fatalf("parse peers error: %v", err)
+	}
+	if len(peers) != 2 {
+		t.Fatalf("expect 2 peers, got %d", len(peers))
+	}
+	if peers[1].MAC.String() != "02:42:ac:11:00:02" || !peers[1].IP.Equal(net.ParseIP("172.18.0.2")) {
+		t.Errorf("unexpected peer %v", peers[1])
+	}
+	if _, err := parseOverlayPeers(strings.NewReader("10.0.0.300")); err == nil {
+		t.Errorf("expect error for invalid vtep")
+	}
+}
+
+func TestCheckOverlayRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	peersFile := path.Join(dir, "peers")
+	_ = ioutil.WriteFile(peersFile, []byte("10.0.0.3 02:42:ac:11:00:02 10.200.1.2\n"), 0644)
+
+	n := &Network{Name: "ov", Options: map[string]string{overlayOptionPeersFile: peersFile}}
+	if err := checkOverlayRange(n); err == nil {
+		t.Errorf("overlay network without ip range should be rejected")
+	}
+	_, n.IPPool, _ = net.ParseCIDR("10.200.0.0/24")
+	if err := checkOverlayRange(n); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	_, n.IPPool, _ = net.ParseCIDR("10.200.1.0/24")
+	if err := checkOverlayRange(n); err == nil {
+		t.Errorf("peer container ip in the local range should be rejected")
+	}
+
+	d := &OverlayNetworkDriver{}
+	if _, err := d.Create("10.200.0.0/16", "ov", false, nil); err == nil {
+		t.Errorf("non internal overlay network should be rejected")
+	}
+	// 前缀相同的长网络名不会得到同一个设备名
+	a := &Network{Name: "production-frontend", Options: map[string]string{overlayOptionVNI: strconv.Itoa(defaultVNI("production-frontend"))}}
+	b := &Network{Name: "production-backend", Options: map[string]string{overlayOptionVNI: strconv.Itoa(defaultVNI("production-backend"))}}
+	if vxlanName(a) == vxlanName(b) || len(vxlanName(a)) > 15 {
+		t.Errorf("unexpected vxlan names %s %s", vxlanName(a), vxlanName(b))
+	}
+}
+
+// 用两个 net namespace 模拟两台主机, 通过 veth 相连, 在各自的 overlay 网桥上配置地址后互相发送 UDP 包
+func TestOverlayTwoHosts(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("need root to create network namespaces")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = netns.Set(origin)
+		_ = origin.Close()
+	}()
+
+	hostA, err := netns.New()
+	if err != nil {
+		t.Skipf("create netns error: %v", err)
+	}
+	defer hostA.Close()
+	hostB, err := netns.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hostB.Close()
+
+	// 在 hostB 中创建 veth, 一端移到 hostA 作为两台主机之间的物理网络
+	la := netlink.NewLinkAttrs()
+	la.Name = "underlay"
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: la, PeerName: "underlay-a"}); err != nil {
+		t.Fatal(err)
+	}
+	peer, _ := netlink.LinkByName("underlay-a")
+	if err := netlink.LinkSetNsFd(peer, int(hostA)); err != nil {
+		t.Fatal(err)
+	}
+
+	setupHost := func(h netns.NsHandle, link, underlayIP, peerIP, overlayIP string) {
+		if err := netns.Set(h); err != nil {
+			t.Fatal(err)
+		}
+		if err := setInterfaceIP(link, underlayIP+"/24"); err != nil {
+			t.Fatal(err)
+		}
+		if err := setInterfaceUP(link); err != nil {
+			t.Fatal(err)
+		}
+		_ = setInterfaceUP("lo")
+		_, ipRange, _ := net.ParseCIDR("10.200.0.0/24")
+		n := &Network{
+			Name:    "ovtest",
+			IpRange: ipRange,
+			Driver:  "overlay",
+			Options: map[string]string{
+				overlayOptionVNI:   "4242",
+				overlayOptionLocal: underlayIP,
+				overlayOptionPeers: peerIP,
+			},
+		}
+		if err := createOverlayDevices(n); err != nil {
+			t.Fatal(err)
+		}
+		if err := setInterfaceIP("ovtest", overlayIP+"/24"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setupHost(hostA, "underlay-a", "10.199.0.1", "10.199.0.2", "10.200.0.1")
+	setupHost(hostB, "underlay", "10.199.0.2", "10.199.0.1", "10.200.0.2")
+
+	// hostB 监听, hostA 通过 overlay 地址发送
+	conn, err := net.ListenPacket("udp4", "10.200.0.2:7946")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := netns.Set(hostA); err != nil {
+		t.Fatal(err)
+	}
+	sender, err := net.Dial("udp4", "10.200.0.2:7946")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	buf := make([]byte, 16)
+	for i := 0; i < 5; i++ {
+		// 第一个包可能因为 ARP 解析被丢弃, 重试几次
+		_, _ = sender.Write([]byte("bucket"))
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err == nil && string(buf[:n]) == "bucket" {
+			return
+		}
+	}
+	t.Fatalf("packet not received over overlay network")
+}
@@ -0,0 +1,194 @@
+package network
+
+import (
+	"bucket/container"
+	"bucket/log"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var supportedProtocols = map[string]bool{
+	"tcp":  true,
+	"udp":  true,
+	"sctp": true,
+}
+
+// 解析 -p 参数, 格式为 [hostIP:][hostPort[-end]:]containerPort[-end][/tcp|udp|sctp]
+// 端口范围会展开成逐个端口的映射, 宿主机端口省略时为0, 连接网络时再随机分配
+func ParsePortSpecs(specs []string) ([]container.PortBinding, error) {
+	var bindings []container.PortBinding
+	for _, spec := range specs {
+		pbs, err := parsePortSpec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port mapping %q: %v", spec, err)
+		}
+		bindings = append(bindings, pbs...)
+	}
+
+	// 同一个宿主机端口不能被映射两次
+	used := map[string]bool{}
+	for _, pb := range bindings {
+		if pb.HostPort == 0 {
+			continue
+		}
+		key := fmt.Sprintf("%s:%d/%s", pb.HostIP, pb.HostPort, pb.Protocol)
+		if used[key] {
+			return nil, fmt.Errorf("host port %s is mapped more than once", key)
+		}
+		used[key] = true
+	}
+	return bindings, nil
+}
+
+func parsePortSpec(spec string) ([]container.PortBinding, error) {
+	proto := "tcp"
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		proto = strings.ToLower(spec[i+1:])
+		spec = spec[:i]
+	}
+	if !supportedProtocols[proto] {
+		return nil, fmt.Errorf("unsupported protocol %s", proto)
+	}
+
+	var hostIP, hostPart, containerPart string
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 1:
+		containerPart = parts[0]
+	case 2:
+		hostPart, containerPart = parts[0], parts[1]
+	case 3:
+		hostIP, hostPart, containerPart = parts[0], parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("too many colons")
+	}
+
+	if hostIP != "" {
+		ip := net.ParseIP(hostIP)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid host ip %s", hostIP)
+		}
+		if ip.IsUnspecified() {
+			hostIP = ""
+		}
+	}
+
+	containerStart, containerEnd, err := parsePortRange(containerPart)
+	if err != nil {
+		return nil, fmt.Errorf("container port: %v", err)
+	}
+
+	hostStart, hostEnd := 0, 0
+	if hostPart != "" {
+		if hostStart, hostEnd, err = parsePortRange(hostPart); err != nil {
+			return nil, fmt.Errorf("host port: %v", err)
+		}
+		if hostEnd-hostStart != containerEnd-containerStart {
+			return nil, fmt.Errorf("host and container port ranges have different sizes")
+		}
+	}
+
+	var bindings []container.PortBinding
+	for port := containerStart; port <= containerEnd; port++ {
+		pb := container.PortBinding{
+			HostIP:        hostIP,
+			ContainerPort: port,
+			Protocol:      proto,
+		}
+		if hostStart != 0 {
+			pb.HostPort = hostStart + port - containerStart
+		}
+		bindings = append(bindings, pb)
+	}
+	return bindings, nil
+}
+
+func parsePortRange(raw string) (int, int, error) {
+	if raw == "" {
+		return 0, 0, fmt.Errorf("empty port")
+	}
+	startStr, endStr := raw, raw
+	if i := strings.Index(raw, "-"); i >= 0 {
+		startStr, endStr = raw[:i], raw[i+1:]
+	}
+	start, err := parsePort(startStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parsePort(endStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("invalid range %s", raw)
+	}
+	return start, end, nil
+}
+
+func parsePort(raw string) (int, error) {
+	port, err := strconv.Atoi(raw)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %s", raw)
+	}
+	return port, nil
+}
+
+// 为宿主机端口为0的映射分配一个当前空闲的端口
+func allocateHostPorts(bindings []container.PortBinding) error {
+	for i := range bindings {
+		if bindings[i].HostPort != 0 {
+			continue
+		}
+		port, err := freeHostPort(bindings[i].HostIP, bindings[i].Protocol)
+		if err != nil {
+			return fmt.Errorf("allocate host port for %d/%s: %v", bindings[i].ContainerPort, bindings[i].Protocol, err)
+		}
+		bindings[i].HostPort = port
+	}
+	return nil
+}
+
+func freeHostPort(hostIP, proto string) (int, error) {
+	// sctp 没有标准库支持, 使用 tcp 端口探测
+	if proto == "udp" {
+		conn, err := net.ListenPacket("udp4", net.JoinHostPort(hostIP, "0"))
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+	l, err := net.Listen("tcp4", net.JoinHostPort(hostIP, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func configPortMapping(ep *Endpoint) error {
+	fw := currentFirewall()
+	for i, pb := range ep.PortMapping {
+		if err := fw.AddPortMapping(ep.IPAddress, pb); err != nil {
+			// 回滚已经添加的映射
+			for _, added := range ep.PortMapping[:i] {
+				_ = fw.RemovePortMapping(ep.IPAddress, added)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func removePortMapping(ep *Endpoint) error {
+	var lastErr error
+	for _, pb := range ep.PortMapping {
+		if err := currentFirewall().RemovePortMapping(ep.IPAddress, pb); err != nil {
+			log.ConsoleLog.Error("remove port mapping %s error: %v", pb, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,51 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestParsePortSpecs(t *testing.T) {
+	bindings, err := ParsePortSpecs([]string{"8080:80", "127.0.0.1:53:53/udp", "9000-9001:90-91/sctp", "443"})
+	if err != nil {
+		t.Fatalf("parse port specs error: %v", err)
+	}
+	if len(bindings) != 5 {
+		t.Fatalf("expect 5 bindings, got %d", len(bindings))
+	}
+	if bindings[0].HostPort != 8080 || bindings[0].ContainerPort != 80 || bindings[0].Protocol != "tcp" {
+		t.Errorf("unexpected binding %v", bindings[0])
+	}
+	if bindings[1].HostIP != "127.0.0.1" || bindings[1].Protocol != "udp" {
+		t.Errorf("unexpected binding %v", bindings[1])
+	}
+	if bindings[3].HostPort != 9001 || bindings[3].ContainerPort != 91 {
+		t.Errorf("unexpected binding %v", bindings[3])
+	}
+	if bindings[4].HostPort != 0 || bindings[4].ContainerPort != 443 {
+		t.Errorf("unexpected binding %v", bindings[4])
+	}
+}
+
+func TestParsePortSpecsInvalid(t *testing.T) {
+	for _, spec := range []string{"", "80/icmp", "0:80", "8080-8081:80", "1.2.3:80:80", "80:80", "a:b:c:d"} {
+		specs := []string{spec}
+		if spec == "80:80" {
+			specs = append(specs, "80:81")
+		}
+		if _, err := ParsePortSpecs(specs); err == nil {
+			t.Errorf("expect error for %v", specs)
+		}
+	}
+}
+
+func TestAllocateHostPorts(t *testing.T) {
+	bindings, _ := ParsePortSpecs([]string{"80", "53/udp"})
+	if err := allocateHostPorts(bindings); err != nil {
+		t.Fatalf("allocate host ports error: %v", err)
+	}
+	for _, pb := range bindings {
+		if pb.HostPort == 0 {
+			t.Errorf("host port not allocated for %v", pb)
+		}
+	}
+}
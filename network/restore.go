@@ -0,0 +1,181 @@
+package network
+
+import (
+	"bucket/log"
+	"bytes"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+)
+
+// 内核每次启动生成的随机ID, 和上次恢复时记录的不同说明宿主机重启过
+var bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+// 根据持久化的网络定义恢复宿主机上的网桥、地址和防火墙规则, 例如重启之后.
+// 返回发现的差异, 每一项都已经尝试修复; full 为 true 时即使设备没有差异也重新下发防火墙规则
+func restoreNetwork(nw *Network, full bool) ([]string, error) {
+	var drift []string
+	var err error
+	switch nw.Driver {
+	case "bridge":
+		drift, err = restoreBridge(nw)
+	case "overlay":
+		drift, err = restoreOverlay(nw)
+	case "cni":
+		// CNI 网络的设备由插件在连接容器时创建, 只检查配置是否还在
+		if _, err := loadCNIConfList(nw); err != nil {
+			return []string{fmt.Sprintf("cni config missing: %v", err)}, nil
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("No Such Driver: %s", nw.Driver)
+	}
+	if err != nil {
+		return drift, err
+	}
+	if len(drift) == 0 && !full {
+		return nil, nil
+	}
+
+	// 规则的添加都是幂等的, 已经存在的不会重复添加
+	if err := currentFirewall().SetupNetwork(nw); err != nil {
+		return drift, fmt.Errorf("Error setting %s rules for %s: %v", currentFirewall().Name(), nw.Name, err)
+	}
+	if nw.Driver == "bridge" {
+		if err := setupLocalhostForwarding(nw.bridgeName()); err != nil {
+			return drift, err
+		}
+	}
+	return drift, nil
+}
+
+func restoreBridge(nw *Network) ([]string, error) {
+	var drift []string
+	bridgeName := nw.bridgeName()
+
+	br, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		drift = append(drift, fmt.Sprintf("bridge %s missing", bridgeName))
+		// 网桥不存在时按创建网络的流程重建, 包括地址和规则
+		d := BridgeNetworkDriver{}
+		return drift, d.initBridge(nw)
+	}
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+	if err != nil {
+		return drift, err
+	}
+	if !hasAddr(addrs, nw.IpRange) {
+		drift = append(drift, fmt.Sprintf("address %s missing on bridge %s", nw.IpRange.String(), bridgeName))
+		if err := setInterfaceIP(bridgeName, nw.IpRange.String()); err != nil {
+			return drift, err
+		}
+	}
+	if mtu, err := bridgeMTU(nw); err == nil && mtu > 0 && br.Attrs().MTU != mtu {
+		drift = append(drift, fmt.Sprintf("mtu of bridge %s is %d, expect %d", bridgeName, br.Attrs().MTU, mtu))
+		if err := netlink.LinkSetMTU(br, mtu); err != nil {
+			return drift, err
+		}
+	}
+	if br.Attrs().Flags&net.FlagUp == 0 {
+		drift = append(drift, fmt.Sprintf("bridge %s is down", bridgeName))
+		if err := setInterfaceUP(bridgeName); err != nil {
+			return drift, err
+		}
+	}
+	return drift, nil
+}
+
+func restoreOverlay(nw *Network) ([]string, error) {
+	var drift []string
+	if _, err := netlink.LinkByName(nw.bridgeName()); err != nil {
+		drift = append(drift, fmt.Sprintf("bridge %s missing", nw.bridgeName()))
+	}
+	if _, err := netlink.LinkByName(vxlanName(nw)); err != nil {
+		drift = append(drift, fmt.Sprintf("vxlan device %s missing", vxlanName(nw)))
+	}
+	if len(drift) == 0 {
+		return nil, nil
+	}
+	// 已经存在的设备会被保留
+	return drift, createOverlayDevices(nw)
+}
+
+func hasAddr(addrs []netlink.Addr, ipNet *net.IPNet) bool {
+	for _, addr := range addrs {
+		if addr.IPNet != nil && addr.IP.Equal(ipNet.IP) && addr.Mask.String() == ipNet.Mask.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// 恢复全部网络并重新下发防火墙规则, 返回每个网络发现的差异
+func RestoreNetworks() (map[string][]string, error) {
+	result := map[string][]string{}
+	for name, nw := range networks {
+		drift, err := restoreNetwork(nw, true)
+		result[name] = drift
+		if err != nil {
+			return result, fmt.Errorf("restore network %s: %v", name, err)
+		}
+	}
+	return result, nil
+}
+
+// 上次自动恢复网络时的 boot id, 和网络定义放在同一个目录下
+func bootMarkerFile() string {
+	return path.Join(path.Dir(path.Clean(defaultNetworkPath)), "boot_id")
+}
+
+// 宿主机重启后第一次执行需要网络的命令 (run, network create) 时重建全部网络,
+// network ls 这类只读命令不修改宿主机
+func RestoreAfterBoot() {
+	bootID, err := ioutil.ReadFile(bootIDFile)
+	if err != nil {
+		log.ConsoleLog.Error("read boot id error: %v", err)
+		return
+	}
+	if marker, err := ioutil.ReadFile(bootMarkerFile()); err == nil && bytes.Equal(marker, bootID) {
+		return
+	}
+	failed := false
+	for name, nw := range networks {
+		drift, err := restoreNetwork(nw, true)
+		for _, d := range drift {
+			log.ConsoleLog.Warning("network %s drifted: %s", name, d)
+		}
+		if err != nil {
+			log.ConsoleLog.Error("restore network %s error: %v", name, err)
+			failed = true
+		}
+	}
+	// 有网络恢复失败时不记录, 下次继续尝试
+	if failed {
+		return
+	}
+	err = os.MkdirAll(path.Dir(bootMarkerFile()), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(bootMarkerFile(), bootID, 0644)
+	}
+	if err != nil {
+		log.ConsoleLog.Error("write boot marker error: %v", err)
+	}
+}
+
+// 容器连接网络前检查这个网络, 防火墙规则总是重新下发, 没有重启但规则被清空的网络也能恢复.
+// 容器的端口映射不在这里恢复, 需要执行 bucket network reconcile
+func EnsureNetwork(name string) error {
+	nw, ok := networks[name]
+	if !ok {
+		// 网络不存在由 Connect 报错
+		return nil
+	}
+	drift, err := restoreNetwork(nw, true)
+	for _, d := range drift {
+		log.ConsoleLog.Warning("network %s drifted: %s", name, d)
+	}
+	return err
+}
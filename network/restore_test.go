@@ -0,0 +1,146 @@
+package network
+
+import (
+	"bucket/container"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+)
+
+// 只记录调用的防火墙, 测试时不修改宿主机规则
+type fakeFirewall struct {
+	setup []string
+}
+
+func (f *fakeFirewall) Name() string { return "fake" }
+func (f *fakeFirewall) SetupNetwork(nw *Network) error {
+	f.setup = append(f.setup, nw.Name)
+	return nil
+}
+func (f *fakeFirewall) TeardownNetwork(nw *Network) error { return nil }
+func (f *fakeFirewall) AddPortMapping(containerIP net.IP, pb container.PortBinding) error {
+	return nil
+}
+func (f *fakeFirewall) RemovePortMapping(containerIP net.IP, pb container.PortBinding) error {
+	return nil
+}
+func (f *fakeFirewall) Reset() error { return nil }
+
+func TestRestoreBridge(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("need root to create network namespaces")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = netns.Set(origin)
+		_ = origin.Close()
+	}()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("create netns error: %v", err)
+	}
+	defer ns.Close()
+
+	fw := &fakeFirewall{}
+	firewallBackend = fw
+	defer func() { firewallBackend = nil }()
+
+	ip, ipRange, _ := net.ParseCIDR("10.77.0.1/24")
+	ipRange.IP = ip
+	nw := &Network{
+		Name:    "restore",
+		IpRange: ipRange,
+		Driver:  "bridge",
+		Options: map[string]string{bridgeOptionName: "br-restore", bridgeOptionMTU: "1400"},
+	}
+
+	// 模拟重启后网桥不存在
+	drift, err := restoreNetwork(nw, false)
+	if err != nil {
+		t.Fatalf("restore error: %v", err)
+	}
+	if len(drift) != 1 || len(fw.setup) == 0 {
+		t.Fatalf("unexpected drift %v, firewall %v", drift, fw.setup)
+	}
+	br, err := netlink.LinkByName("br-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.Attrs().MTU != 1400 {
+		t.Errorf("unexpected mtu %d", br.Attrs().MTU)
+	}
+
+	// 再次恢复没有差异, 也不会重复下发规则
+	fw.setup = nil
+	if drift, err := restoreNetwork(nw, false); err != nil || len(drift) != 0 || len(fw.setup) != 0 {
+		t.Fatalf("unexpected second restore %v %v %v", drift, err, fw.setup)
+	}
+
+	// 地址被删掉且网桥被关闭
+	addr, _ := netlink.ParseAddr("10.77.0.1/24")
+	_ = netlink.AddrDel(br, addr)
+	_ = netlink.LinkSetDown(br)
+	drift, err = restoreNetwork(nw, false)
+	if err != nil || len(drift) != 2 {
+		t.Fatalf("unexpected drift %v %v", drift, err)
+	}
+	br, _ = netlink.LinkByName("br-restore")
+	addrs, _ := netlink.AddrList(br, netlink.FAMILY_V4)
+	if !hasAddr(addrs, ipRange) || br.Attrs().Flags&net.FlagUp == 0 {
+		t.Errorf("bridge not restored: %v %v", addrs, br.Attrs().Flags)
+	}
+}
+
+func TestRestoreAfterBoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldNetworkPath, oldNetworks, oldBootIDFile := defaultNetworkPath, networks, bootIDFile
+	defer func() {
+		defaultNetworkPath, networks, bootIDFile = oldNetworkPath, oldNetworks, oldBootIDFile
+	}()
+	// 记录 boot id 的目录还不存在
+	defaultNetworkPath = path.Join(dir, "bucket", "network") + "/"
+	bootIDFile = path.Join(dir, "kernel_boot_id")
+	_ = ioutil.WriteFile(bootIDFile, []byte("boot-1\n"), 0644)
+
+	// 有网络恢复失败时不记录, 下次继续尝试
+	networks = map[string]*Network{"broken": {Name: "broken", Driver: "none"}}
+	RestoreAfterBoot()
+	if _, err := os.Stat(bootMarkerFile()); !os.IsNotExist(err) {
+		t.Fatalf("boot marker should not be written after a failed restore: %v", err)
+	}
+
+	networks = map[string]*Network{}
+	RestoreAfterBoot()
+	if marker, err := ioutil.ReadFile(bootMarkerFile()); err != nil || string(marker) != "boot-1\n" {
+		t.Fatalf("unexpected boot marker %q %v", marker, err)
+	}
+	if info, err := os.Stat(path.Dir(bootMarkerFile())); err != nil || info.Mode().Perm()&0111 == 0 {
+		t.Errorf("boot marker dir should be searchable: %v", err)
+	}
+	// 同一次启动中不再恢复
+	networks = map[string]*Network{"broken": {Name: "broken", Driver: "none"}}
+	RestoreAfterBoot()
+	if marker, _ := ioutil.ReadFile(bootMarkerFile()); string(marker) != "boot-1\n" {
+		t.Errorf("boot marker changed %q", marker)
+	}
+	_ = ioutil.WriteFile(bootIDFile, []byte("boot-2\n"), 0644)
+	networks = map[string]*Network{}
+	RestoreAfterBoot()
+	if marker, _ := ioutil.ReadFile(bootMarkerFile()); string(marker) != "boot-2\n" {
+		t.Errorf("boot marker should be updated after reboot, got %q", marker)
+	}
+}
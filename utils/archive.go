@@ -0,0 +1,392 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// PAX 扩展头中保存 xattr 的前缀, 和 GNU tar 的 --xattrs 一致
+const paxXattrPrefix = "SCHILY.xattr."
+
+type TarOptions struct {
+	Excludes      []string // 不打包的路径, 相对于打包的目录
+	OneFileSystem bool     // 不进入挂载在目录中的其他文件系统, 例如数据卷
+	Name          string   // 在包中的名字, 为空时只打包目录中的内容
+}
+
+// 把目录打包成 tar 流, 保留属主、权限、xattr、设备文件和硬链接, 包内路径相对于 dir.
+// 指定了 Name 时 dir 也可以是单个文件
+func Tar(dir string, w io.Writer, opts *TarOptions) error {
+	if opts == nil {
+		opts = &TarOptions{}
+	}
+	rootInfo, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	rootDev := rootInfo.Sys().(*syscall.Stat_t).Dev
+	excludes := map[string]bool{}
+	for _, exclude := range opts.Excludes {
+		excludes[strings.TrimPrefix(filepath.Clean("/"+exclude), "/")] = true
+	}
+
+	tw := tar.NewWriter(w)
+	// 同一个 inode 第一次出现时的路径, 之后出现的写成硬链接
+	inodes := map[[2]uint64]string{}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || (rel == "." && opts.Name == "") {
+			return err
+		}
+		if excludes[rel] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// tar 不能保存 socket
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.Join(opts.Name, rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		// 用户名按宿主机查出来的没有意义, 只保留数字ID
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		hdr.Format = tar.FormatPAX
+
+		if info.Mode().IsRegular() && stat.Nlink > 1 {
+			key := [2]uint64{uint64(stat.Dev), uint64(stat.Ino)}
+			if first, ok := inodes[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				inodes[key] = hdr.Name
+			}
+		}
+		xattrs, err := listXattrs(p)
+		if err != nil {
+			return fmt.Errorf("read xattrs of %s error: %v", p, err)
+		}
+		for name, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[paxXattrPrefix+name] = value
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			_ = f.Close()
+			if err != nil {
+				return fmt.Errorf("write %s error: %v", p, err)
+			}
+		}
+		// 挂载点本身打包, 里面的内容不打包
+		if info.IsDir() && opts.OneFileSystem && uint64(stat.Dev) != uint64(rootDev) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// 把 tar 流解开到 dir 中. 包内路径和硬链接都按 dir 为根解析, 不会写到 dir 之外.
+// .wh. 文件原样保留, 由使用者决定如何处理
+func Untar(r io.Reader, dir string) error {
+	return UntarFiltered(r, dir, nil)
+}
+
+// 和 Untar 一样, 但跳过 skip 返回 true 的文件, 参数是以 / 开头的包内路径
+func UntarFiltered(r io.Reader, dir string, skip func(name string) bool) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read tar error: %v", err)
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" || (skip != nil && skip(name)) {
+			continue
+		}
+		target, err := untarPath(dir, name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		// 已经存在的目录保留, 其他情况用包里的覆盖
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		mode := uint32(hdr.Mode) & 07777
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+				return err
+			}
+			dirs = append(dirs, hdr)
+		case tar.TypeReg, tar.TypeRegA:
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				_ = f.Close()
+				return fmt.Errorf("write %s error: %v", name, err)
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := untarPath(dir, filepath.Clean("/"+hdr.Linkname))
+			if err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return fmt.Errorf("hardlink %s to %s error: %v", name, hdr.Linkname, err)
+			}
+			// 硬链接和源文件共用属性, 不需要再设置
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			fileType := uint32(unix.S_IFIFO)
+			if hdr.Typeflag == tar.TypeChar {
+				fileType = unix.S_IFCHR
+			} else if hdr.Typeflag == tar.TypeBlock {
+				fileType = unix.S_IFBLK
+			}
+			dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+			if err := unix.Mknod(target, fileType|mode, int(dev)); err != nil {
+				return fmt.Errorf("mknod %s error: %v", name, err)
+			}
+		default:
+			// 其他类型 (例如 GNU 的 sparse 头) 不支持, 跳过
+			continue
+		}
+		if err := setMetadata(target, hdr); err != nil {
+			return fmt.Errorf("set metadata of %s error: %v", name, err)
+		}
+	}
+	// 目录最后设置时间, 否则会被在其中创建文件修改
+	for _, hdr := range dirs {
+		target, err := untarPath(dir, filepath.Clean("/"+hdr.Name))
+		if err != nil {
+			return err
+		}
+		if err := setTimes(target, hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 包内路径对应的本地路径: 父目录按 dir 为根解析符号链接, 最后一级不解析, 以便覆盖符号链接本身
+func untarPath(dir, name string) (string, error) {
+	parent, err := SecureJoin(dir, filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(name)), nil
+}
+
+func setMetadata(target string, hdr *tar.Header) error {
+	// 非 root 用户不能修改属主, 忽略
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil && os.Geteuid() == 0 {
+		return err
+	}
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		err := unix.Lsetxattr(target, strings.TrimPrefix(key, paxXattrPrefix), []byte(value), 0)
+		// 目标文件系统不支持或者没有权限设置的 xattr 忽略
+		if err != nil && err != unix.ENOTSUP && err != unix.EPERM {
+			return err
+		}
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		// chown 会清除 setuid 位, 所以在之后设置权限
+		if err := unix.Chmod(target, uint32(hdr.Mode)&07777); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return setTimes(target, hdr)
+}
+
+func setTimes(target string, hdr *tar.Header) error {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func listXattrs(p string) (map[string]string, error) {
+	size, err := unix.Llistxattr(p, nil)
+	if err == unix.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return nil, err
+	}
+	xattrs := map[string]string{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		value, err := getXattr(p, name)
+		if err == unix.ENODATA {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		xattrs[name] = string(value)
+	}
+	return xattrs, nil
+}
+
+func getXattr(p, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(p, name, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Lgetxattr(p, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// 各压缩格式的文件头
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte("\xfd7zXZ\x00")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// 文件头是否是支持解压的压缩格式
+func IsCompressed(header []byte) bool {
+	for _, magic := range [][]byte{gzipMagic, bzip2Magic, xzMagic, zstdMagic} {
+		if bytes.HasPrefix(header, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// 按文件头判断压缩格式并解压, 支持 gzip, bzip2, xz 和 zstd, 其他当作未压缩.
+// xz 和 zstd 调用宿主机的命令, 解压失败的错误在 Close 时返回
+func DecompressStream(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	case bytes.HasPrefix(magic, xzMagic):
+		return newCmdReader(br, "xz", "-d", "-c", "-q")
+	case bytes.HasPrefix(magic, zstdMagic):
+		return newCmdReader(br, "zstd", "-d", "-c", "-q")
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// 从外部解压命令的标准输出读取
+type cmdReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func newCmdReader(r io.Reader, name string, args ...string) (io.ReadCloser, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = r
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s compressed input needs %s installed: %v", name, name, err)
+	}
+	return &cmdReader{ReadCloser: stdout, cmd: cmd, stderr: stderr}, nil
+}
+
+func (c *cmdReader) Close() error {
+	// 没有读完时关闭管道让命令退出
+	_ = c.ReadCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s error: %v, %s", c.cmd.Path, err, strings.TrimSpace(c.stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestTarUntar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "bin/app"), []byte("app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "bin/app"), 0755|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "bin/app"), filepath.Join(src, "bin/app2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/bin/app", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, ".wh..wh.aufs"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mkfifo(filepath.Join(src, "fifo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	root := os.Geteuid() == 0
+	if root {
+		if err := unix.Mknod(filepath.Join(src, "null"), unix.S_IFCHR|0666, int(unix.Mkdev(1, 3))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	xattr := unix.Setxattr(filepath.Join(src, "bin/app"), "user.bucket", []byte("yes"), 0) == nil
+
+	var buf bytes.Buffer
+	if err := Tar(src, &buf, &TarOptions{Excludes: []string{".wh..wh.aufs"}}); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	if err := Untar(bytes.NewReader(buf.Bytes()), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dst, "bin/app"))
+	if err != nil || info.Mode()&os.ModeSetuid == 0 || info.Mode().Perm() != 0755 {
+		t.Errorf("unexpected mode %v %v", info, err)
+	}
+	info2, err := os.Stat(filepath.Join(dst, "bin/app2"))
+	if err != nil || !os.SameFile(info, info2) {
+		t.Errorf("hardlink should be preserved: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "link")); err != nil || link != "/bin/app" {
+		t.Errorf("unexpected symlink %q %v", link, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dst, ".wh..wh.aufs")); !os.IsNotExist(err) {
+		t.Errorf("excluded file should not be archived")
+	}
+	if info, err := os.Lstat(filepath.Join(dst, "fifo")); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("fifo should be preserved %v", err)
+	}
+	if root {
+		info, err := os.Lstat(filepath.Join(dst, "null"))
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 || info.Sys().(*syscall.Stat_t).Rdev != unix.Mkdev(1, 3) {
+			t.Errorf("device should be preserved %v", err)
+		}
+	}
+	if xattr {
+		value, err := getXattr(filepath.Join(dst, "bin/app"), "user.bucket")
+		if err != nil || string(value) != "yes" {
+			t.Errorf("xattr should be preserved %q %v", value, err)
+		}
+	}
+}
+
+func TestUntarEscape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 先放一个指向外部的符号链接, 再通过它写文件, 文件只能写到 dst 里面
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []*tar.Header{
+		{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: dir, Mode: 0777},
+		{Name: "escape/pwned", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		{Name: "../../outside", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+	}
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	if err := Untar(&buf, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pwned")); !os.IsNotExist(err) {
+		t.Errorf("file written through symlink escaped")
+	}
+	if _, err := os.Stat(filepath.Join(dst, dir, "pwned")); err != nil {
+		t.Errorf("file should be written inside dst: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "outside")); err != nil {
+		t.Errorf(".. should be resolved inside dst: %v", err)
+	}
+}
+
+func TestDecompressStream(t *testing.T) {
+	content := []byte("plain content")
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write(content)
+	_ = zw.Close()
+	inputs := map[string][]byte{"plain": content, "gzip": gz.Bytes()}
+	// 用宿主机上有的命令生成其他格式的压缩数据
+	for _, name := range []string{"zstd", "xz", "bzip2"} {
+		if _, err := exec.LookPath(name); err != nil {
+			continue
+		}
+		cmd := exec.Command(name, "-c", "-q")
+		cmd.Stdin = bytes.NewReader(content)
+		compressed, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsCompressed(compressed) {
+			t.Errorf("%s: compressed data not detected", name)
+		}
+		inputs[name] = compressed
+	}
+
+	for name, input := range inputs {
+		r, err := DecompressStream(bytes.NewReader(input))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		out, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(out, content) {
+			t.Errorf("%s: unexpected content %q %v", name, out, err)
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("%s: close error %v", name, err)
+		}
+	}
+}
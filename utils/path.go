@@ -1,6 +1,11 @@
 package utils
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
 
 func PathExists(path string) (bool, error) {
 	_, err := os.Stat(path)
@@ -12,3 +17,55 @@ func PathExists(path string) (bool, error) {
 	}
 	return false, err
 }
+
+// 解析符号链接的最大次数, 防止链接成环
+const maxSymlinks = 255
+
+// 把 unsafePath 当作以 root 为根的路径拼接到 root 上: .. 不能越过 root,
+// 路径中的符号链接也按 root 为根解析, 所以结果总是在 root 之内. 不存在的部分按字面拼接
+func SecureJoin(root, unsafePath string) (string, error) {
+	resolved := "/"
+	remaining := filepath.Clean("/" + unsafePath)
+	links := 0
+	for remaining != "" {
+		remaining = strings.TrimPrefix(remaining, "/")
+		part := remaining
+		if i := strings.IndexByte(remaining, '/'); i >= 0 {
+			part, remaining = remaining[:i], remaining[i:]
+		} else {
+			remaining = ""
+		}
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", unsafePath)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		// 绝对路径的链接从 root 开始, 相对路径的从链接所在目录开始
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = "/" + target + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecureJoin(t *testing.T) {
+	root, err := ioutil.TempDir("", "bucket-securejoin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.MkdirAll(filepath.Join(root, "usr/bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"bin":     "usr/bin",
+		"etc":     "/../../usr",
+		"up":      "../../..",
+		"usr/abs": "/usr/bin",
+		"loop":    "loop",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := map[string]string{
+		"/bin/sh":          "/usr/bin/sh",
+		"../../etc/passwd": "/usr/passwd",
+		"etc/passwd":       "/usr/passwd",
+		"up/tmp":           "/tmp",
+		"usr/abs/ls":       "/usr/bin/ls",
+		"missing/../bin":   "/usr/bin",
+	}
+	for p, expect := range cases {
+		got, err := SecureJoin(root, p)
+		if err != nil || got != filepath.Join(root, expect) {
+			t.Errorf("SecureJoin(%q) = %q, %v, expect %q", p, got, err, filepath.Join(root, expect))
+		}
+	}
+	if _, err := SecureJoin(root, "loop/x"); err == nil {
+		t.Errorf("symlink loop should fail")
+	}
+}
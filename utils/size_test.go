@@ -0,0 +1,24 @@
+package utils
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"1024":   1024,
+		"64m":    64 << 20,
+		"64MB":   64 << 20,
+		"512KiB": 512 << 10,
+		"1.5g":   3 << 29,
+		"10b":    10,
+	}
+	for size, expect := range cases {
+		if got, err := ParseSize(size); err != nil || got != expect {
+			t.Errorf("ParseSize(%q) = %d %v, expect %d", size, got, err, expect)
+		}
+	}
+	for _, size := range []string{"", "m", "-1", "10x", "1.2.3k"} {
+		if _, err := ParseSize(size); err == nil {
+			t.Errorf("ParseSize(%q) should fail", size)
+		}
+	}
+}
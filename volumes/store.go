@@ -0,0 +1,299 @@
+package volumes
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	dataDir      = "_data"
+	metadataFile = "volume.json"
+	// 目前只有本地目录一种驱动
+	DriverLocal = "local"
+)
+
+// 卷名和 docker 一样, 不能以 . 或 / 开头, 这样 -v 中可以和宿主机路径区分
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// 命名卷的存储, 目录结构:
+//
+//	<root>/<name>/_data          卷的内容, 挂载到容器中
+//	<root>/<name>/volume.json    卷的元数据和使用它的容器
+type Store struct {
+	root string
+}
+
+type Volume struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	Mountpoint string            `json:"mountpoint"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	Labels     map[string]string `json:"labels"`
+	Containers []string          `json:"containers"` // 使用这个卷的容器ID, 用来做引用计数
+}
+
+type NotFoundError struct {
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("No such volume: %s", e.Name)
+}
+
+func IsNotFound(err error) bool {
+	_, ok := err.(*NotFoundError)
+	return ok
+}
+
+// -v 的来源是卷名而不是宿主机路径
+func IsName(source string) bool {
+	return validName.MatchString(source)
+}
+
+func NewStore(root string) (*Store, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{root: root}, nil
+}
+
+func (s *Store) volumeDir(name string) string {
+	return path.Join(s.root, name)
+}
+
+// 修改卷的元数据前对整个存储目录加 flock, 避免并发的 run, rm 和 prune 丢失引用
+func (s *Store) lock() (func(), error) {
+	f, err := os.Open(s.root)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("lock volume store error: %v", err)
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
+
+// 创建卷, 同名的卷已经存在时直接返回它. name 为空时生成一个随机的名字
+func (s *Store) Create(name string, labels map[string]string) (*Volume, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return s.create(name, labels)
+}
+
+// 容器使用卷: 不存在时创建, 并在同一把锁内记录引用, 中间不会被 prune 删除
+func (s *Store) Use(name, containerID string) (*Volume, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	v, err := s.create(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range v.Containers {
+		if id == containerID {
+			return v, nil
+		}
+	}
+	v.Containers = append(v.Containers, containerID)
+	return v, s.save(v)
+}
+
+func (s *Store) create(name string, labels map[string]string) (*Volume, error) {
+	if name == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		name = hex.EncodeToString(buf)
+	}
+	if !IsName(name) {
+		return nil, fmt.Errorf("invalid volume name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	if v, err := s.Get(name); err == nil || !IsNotFound(err) {
+		return v, err
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	v := &Volume{
+		Name:       name,
+		Driver:     DriverLocal,
+		Mountpoint: path.Join(s.volumeDir(name), dataDir),
+		CreatedAt:  time.Now().UTC(),
+		Labels:     labels,
+		Containers: []string{},
+	}
+	if err := os.MkdirAll(v.Mountpoint, 0755); err != nil {
+		return nil, err
+	}
+	if err := s.save(v); err != nil {
+		_ = os.RemoveAll(s.volumeDir(name))
+		return nil, err
+	}
+	return v, nil
+}
+
+func (s *Store) Get(name string) (*Volume, error) {
+	if !IsName(name) {
+		return nil, &NotFoundError{Name: name}
+	}
+	content, err := ioutil.ReadFile(path.Join(s.volumeDir(name), metadataFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &NotFoundError{Name: name}
+		}
+		return nil, err
+	}
+	v := &Volume{}
+	if err := json.Unmarshal(content, v); err != nil {
+		return nil, fmt.Errorf("load volume %s error: %v", name, err)
+	}
+	return v, nil
+}
+
+// 按名字排序的全部卷
+func (s *Store) List() ([]*Volume, error) {
+	files, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+	var volumes []*Volume
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		v, err := s.Get(file.Name())
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Name < volumes[j].Name
+	})
+	return volumes, nil
+}
+
+// 删除卷和其中的数据, 还有容器引用时拒绝删除. stale 不为空时先去掉它判断为已经不存在的容器的引用
+func (s *Store) Remove(name string, stale func(containerID string) bool) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.remove(name, stale)
+}
+
+func (s *Store) remove(name string, stale func(containerID string) bool) error {
+	v, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+	if stale != nil {
+		containers := []string{}
+		for _, id := range v.Containers {
+			if !stale(id) {
+				containers = append(containers, id)
+			}
+		}
+		if len(containers) != len(v.Containers) {
+			v.Containers = containers
+			if err := s.save(v); err != nil {
+				return err
+			}
+		}
+	}
+	if len(v.Containers) > 0 {
+		return fmt.Errorf("volume %s is in use by containers: %s", name, strings.Join(v.Containers, ", "))
+	}
+	return os.RemoveAll(s.volumeDir(name))
+}
+
+// 删除没有容器使用的卷, 返回被删除的卷名
+func (s *Store) Prune() ([]string, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	volumes, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	for _, v := range volumes {
+		if len(v.Containers) > 0 {
+			continue
+		}
+		if err := s.remove(v.Name, nil); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, v.Name)
+	}
+	return pruned, nil
+}
+
+// 容器删除后不再引用卷, 卷本身保留
+func (s *Store) Release(name, containerID string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	v, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+	containers := []string{}
+	for _, id := range v.Containers {
+		if id != containerID {
+			containers = append(containers, id)
+		}
+	}
+	v.Containers = containers
+	return s.save(v)
+}
+
+// 卷中还没有任何文件, 第一次使用时把镜像中对应目录的内容复制进来
+func (v *Volume) IsEmpty() (bool, error) {
+	files, err := ioutil.ReadDir(v.Mountpoint)
+	if err != nil {
+		return false, err
+	}
+	return len(files) == 0, nil
+}
+
+// 先写临时文件再改名, 避免写到一半时元数据损坏
+func (s *Store) save(v *Volume) error {
+	content, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(s.volumeDir(v.Name), metadataFile+".tmp")
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path.Join(s.volumeDir(v.Name), metadataFile))
+}
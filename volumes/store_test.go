@@ -0,0 +1,83 @@
+package volumes
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-volume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/data", "./data", "a", "data:ro"} {
+		if IsName(name) {
+			t.Errorf("%q should not be a volume name", name)
+		}
+		if _, err := store.Create(name, nil); err == nil {
+			t.Errorf("create volume %q should fail", name)
+		}
+	}
+	data, err := store.Create("data", map[string]string{"app": "db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty, err := data.IsEmpty(); err != nil || !empty {
+		t.Errorf("new volume should be empty %v", err)
+	}
+	_ = ioutil.WriteFile(path.Join(data.Mountpoint, "file"), []byte("x"), 0644)
+	again, err := store.Create("data", nil)
+	if err != nil || again.Labels["app"] != "db" {
+		t.Errorf("create existing volume should return it: %+v %v", again, err)
+	}
+	anonymous, err := store.Create("", nil)
+	if err != nil || len(anonymous.Name) != 64 {
+		t.Fatalf("unexpected anonymous volume %+v %v", anonymous, err)
+	}
+
+	if _, err := store.Use("data", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = store.Use("data", "c1")
+	_, _ = store.Use("data", "c2")
+	if v, _ := store.Get("data"); len(v.Containers) != 2 {
+		t.Errorf("unexpected containers %v", v.Containers)
+	}
+	if err := store.Remove("data", nil); err == nil {
+		t.Errorf("remove volume in use should fail")
+	}
+	// 强制删除只清理已经不存在的容器的引用, 还在使用的卷仍然不能删除
+	if err := store.Remove("data", func(id string) bool { return id == "c2" }); err == nil {
+		t.Errorf("remove volume used by a live container should fail")
+	}
+	if v, _ := store.Get("data"); len(v.Containers) != 1 || v.Containers[0] != "c1" {
+		t.Errorf("stale reference should be dropped: %v", v.Containers)
+	}
+	if used, err := store.Use("cache", "c3"); err != nil || len(used.Containers) != 1 {
+		t.Errorf("use should create the volume with a reference: %+v %v", used, err)
+	}
+	pruned, err := store.Prune()
+	if err != nil || len(pruned) != 1 || pruned[0] != anonymous.Name {
+		t.Errorf("unexpected pruned %v %v", pruned, err)
+	}
+	_ = store.Release("data", "c1")
+	_ = store.Release("cache", "c3")
+	list, err := store.List()
+	if err != nil || len(list) != 2 || len(list[0].Containers) != 0 || len(list[1].Containers) != 0 {
+		t.Errorf("unexpected volumes %v %v", list, err)
+	}
+	if err := store.Remove("data", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("data"); !IsNotFound(err) {
+		t.Errorf("removed volume should not be found: %v", err)
+	}
+}